@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/golang.org/x/crypto/chacha20poly1305"
+	"github.com/robmerrell/gosecret/vendor/golang.org/x/crypto/scrypt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Files can also be read and written in the age format
+// (https://age-encryption.org/v1), so they can be decrypted with the age
+// tool and the other way around. An age file has a text header of stanzas,
+// each wrapping the 16 byte file key for one recipient or a passphrase,
+// ending with a MAC of the header keyed by the file key:
+//
+//	age-encryption.org/v1
+//	-> X25519 <ephemeral share>
+//	<wrapped file key>
+//	--- <header MAC>
+//
+// The payload follows, sealed with ChaCha20-Poly1305 in chunks like version 3
+// gosecret files. Only the X25519 and scrypt stanzas are supported. The
+// same identities decrypt both formats, and age's own keys can be given
+// wherever gosecret's are.
+
+// ageFormat is the --format that reads and writes age files.
+const ageFormat = "age"
+
+const (
+	ageVersionLine = "age-encryption.org/v1"
+
+	ageRecipientHRP = "age"
+	ageIdentityHRP  = "AGE-SECRET-KEY-"
+
+	ageX25519Kind = "X25519"
+	ageScryptKind = "scrypt"
+
+	ageFileKeySize   = 16
+	ageWrappedSize   = ageFileKeySize + chacha20poly1305.Overhead
+	ageBodyColumns   = 64
+	ageScryptR       = 8
+	ageScryptP       = 1
+	ageScryptLabel   = "age-encryption.org/v1/scrypt"
+	ageX25519Label   = "age-encryption.org/v1/X25519"
+	ageHeaderMACSize = sha256.Size
+)
+
+// ageMagic starts every age file, whatever its version.
+var ageMagic = []byte("age-encryption.org/")
+
+var errBadAgeHeader = errors.New("File doesn't have a valid age header")
+var errAgeNoMatch = errors.New("None of the identities or passphrases given can decrypt this age file")
+
+// ageEncoding is the base64 used in age headers. Non-canonical encodings are
+// rejected so the header MAC covers exactly what was parsed.
+var ageEncoding = base64.RawStdEncoding.Strict()
+
+// ageStanza is the file key wrapped for one recipient or passphrase.
+type ageStanza struct {
+	kind string
+	args []string
+	body []byte
+}
+
+// ageHeader is the header of an age file.
+type ageHeader struct {
+	stanzas []*ageStanza
+	mac     []byte
+}
+
+// marshal encodes the stanza as its arguments on one line followed by the
+// body in lines of 64 columns. The last line is always shorter, possibly
+// empty.
+func (s *ageStanza) marshal(b *bytes.Buffer) {
+	b.WriteString("-> ")
+	b.WriteString(strings.Join(append([]string{s.kind}, s.args...), " "))
+	b.WriteString("\n")
+
+	body := ageEncoding.EncodeToString(s.body)
+	for ; len(body) >= ageBodyColumns; body = body[ageBodyColumns:] {
+		b.WriteString(body[:ageBodyColumns] + "\n")
+	}
+	b.WriteString(body + "\n")
+}
+
+// macInput encodes everything in the header the MAC covers, which is up to
+// and including the dashes of the last line.
+func (h *ageHeader) macInput() []byte {
+	var b bytes.Buffer
+	b.WriteString(ageVersionLine + "\n")
+	for _, s := range h.stanzas {
+		s.marshal(&b)
+	}
+	b.WriteString("---")
+	return b.Bytes()
+}
+
+// marshal encodes the header.
+func (h *ageHeader) marshal() []byte {
+	return append(h.macInput(), []byte(" "+ageEncoding.EncodeToString(h.mac)+"\n")...)
+}
+
+// headerMAC returns the MAC of h keyed by fileKey.
+func (h *ageHeader) headerMAC(fileKey []byte) []byte {
+	mac := hmac.New(sha256.New, hkdfSHA256(fileKey, nil, "header"))
+	mac.Write(h.macInput())
+	return mac.Sum(nil)
+}
+
+// peekAgeHeader reports whether the next bytes in r start an age file
+// without consuming them.
+func peekAgeHeader(r *bufio.Reader) bool {
+	b, _ := r.Peek(len(ageMagic))
+	return bytes.Equal(b, ageMagic)
+}
+
+// readAgeHeader reads and decodes the header at the start of r, leaving r
+// positioned at the start of the payload.
+func readAgeHeader(r *bufio.Reader) (*ageHeader, error) {
+	line, err := readAgeLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line != ageVersionLine {
+		if strings.HasPrefix(line, string(ageMagic)) && !strings.ContainsAny(line, "\r") {
+			return nil, fmt.Errorf("Unsupported age format version %s", line[len(ageMagic):])
+		}
+		return nil, errBadAgeHeader
+	}
+
+	h := &ageHeader{}
+	for {
+		line, err := readAgeLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(line, "---") {
+			if !strings.HasPrefix(line, "--- ") || len(h.stanzas) == 0 {
+				return nil, errBadAgeHeader
+			}
+			if h.mac, err = decodeAgeBase64(line[len("--- "):]); err != nil || len(h.mac) != ageHeaderMACSize {
+				return nil, errBadAgeHeader
+			}
+			return h, nil
+		}
+
+		if !strings.HasPrefix(line, "-> ") {
+			return nil, errBadAgeHeader
+		}
+		args := strings.Split(line[len("-> "):], " ")
+		for _, arg := range args {
+			if !validAgeArg(arg) {
+				return nil, errBadAgeHeader
+			}
+		}
+		s := &ageStanza{kind: args[0], args: args[1:]}
+
+		// the body ends with the first line shorter than a full one
+		for {
+			line, err := readAgeLine(r)
+			if err != nil {
+				return nil, err
+			}
+			b, err := decodeAgeBase64(line)
+			if err != nil || len(line) > ageBodyColumns {
+				return nil, errBadAgeHeader
+			}
+			s.body = append(s.body, b...)
+			if len(line) < ageBodyColumns {
+				break
+			}
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+}
+
+// readAgeLine reads a line of the header without its newline.
+func readAgeLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", errBadAgeHeader
+	}
+	return line[:len(line)-1], nil
+}
+
+// validAgeArg reports whether arg is a non-empty string of printable ASCII
+// characters other than space.
+func validAgeArg(arg string) bool {
+	if arg == "" {
+		return false
+	}
+	for i := 0; i < len(arg); i++ {
+		if arg[i] < 33 || arg[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeAgeBase64 decodes unpadded, canonical base64. Unlike the encoding
+// package, newlines aren't skipped.
+func decodeAgeBase64(s string) ([]byte, error) {
+	if strings.ContainsAny(s, "\r\n") {
+		return nil, errBadAgeHeader
+	}
+	return ageEncoding.DecodeString(s)
+}
+
+// ageWrap seals fileKey under wrapKey. Every wrap key is used only once, so
+// the nonce is always zero.
+func ageWrap(wrapKey, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+// ageUnwrap opens a file key wrapped by ageWrap, returning errAgeNoMatch if
+// wrapKey is wrong.
+func ageUnwrap(wrapKey, wrapped []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), wrapped, nil)
+	if err != nil {
+		return nil, errAgeNoMatch
+	}
+	return fileKey, nil
+}
+
+// newAgeX25519Stanza wraps fileKey for recipient with a key derived from an
+// ephemeral key pair.
+func newAgeX25519Stanza(recipient *x25519Recipient, fileKey []byte) (*ageStanza, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient.key)
+	if err != nil {
+		return nil, err
+	}
+
+	share := ephemeral.PublicKey().Bytes()
+	wrapKey := hkdfSHA256(shared, append(append([]byte{}, share...), recipient.key.Bytes()...), ageX25519Label)
+	wrapped, err := ageWrap(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ageStanza{kind: ageX25519Kind, args: []string{ageEncoding.EncodeToString(share)}, body: wrapped}, nil
+}
+
+// unwrapAgeX25519 opens the file key in s with whichever of identities it
+// was wrapped for.
+func unwrapAgeX25519(s *ageStanza, identities []*x25519Identity) ([]byte, error) {
+	if len(s.args) != 1 || len(s.body) != ageWrappedSize {
+		return nil, errBadAgeHeader
+	}
+	share, err := ageEncoding.DecodeString(s.args[0])
+	if err != nil || len(share) != x25519KeySize {
+		return nil, errBadAgeHeader
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(share)
+	if err != nil {
+		return nil, errBadAgeHeader
+	}
+
+	for _, identity := range identities {
+		// a low order share gives an all zero secret, which is an error
+		shared, err := identity.key.ECDH(ephemeral)
+		if err != nil {
+			return nil, errBadAgeHeader
+		}
+
+		wrapKey := hkdfSHA256(shared, append(append([]byte{}, share...), identity.key.PublicKey().Bytes()...), ageX25519Label)
+		fileKey, err := ageUnwrap(wrapKey, s.body)
+		if err == errAgeNoMatch {
+			continue
+		}
+		return fileKey, err
+	}
+	return nil, errAgeNoMatch
+}
+
+// ageScryptKey derives the key a file key is wrapped with from passphrase.
+func ageScryptKey(passphrase, salt []byte, logN int) ([]byte, error) {
+	return scrypt.Key(passphrase, append([]byte(ageScryptLabel), salt...), 1<<uint(logN), ageScryptR, ageScryptP, chacha20poly1305.KeySize)
+}
+
+// newAgeScryptStanza wraps fileKey with a key derived from passphrase, using
+// the salt and work factor in params. age always uses r 8 and p 1.
+func newAgeScryptStanza(passphrase []byte, params *scryptParams, fileKey []byte) (*ageStanza, error) {
+	if params.r != ageScryptR || params.p != ageScryptP {
+		return nil, fmt.Errorf("age files always use scrypt r %d and p %d", ageScryptR, ageScryptP)
+	}
+	wrapKey, err := ageScryptKey(passphrase, params.salt, int(params.logN))
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := ageWrap(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{ageEncoding.EncodeToString(params.salt), strconv.Itoa(int(params.logN))}
+	return &ageStanza{kind: ageScryptKind, args: args, body: wrapped}, nil
+}
+
+// unwrapAgeScrypt opens the file key in s with passphrase. The work factor
+// is capped like it is for gosecret's own files, but smaller ones written by
+// other age implementations are accepted.
+func unwrapAgeScrypt(s *ageStanza, passphrase []byte) ([]byte, error) {
+	if len(s.args) != 2 || len(s.body) != ageWrappedSize {
+		return nil, errBadAgeHeader
+	}
+	salt, err := ageEncoding.DecodeString(s.args[0])
+	if err != nil || len(salt) != scryptSaltSize {
+		return nil, errBadAgeHeader
+	}
+
+	// only plain decimal numbers are allowed, no signs or leading zeros
+	logN, err := strconv.Atoi(s.args[1])
+	if err != nil || logN < 1 || strconv.Itoa(logN) != s.args[1] {
+		return nil, errBadAgeHeader
+	}
+	if logN > maxScryptLogN || 128*int64(ageScryptR)<<uint(logN) > maxScryptMemory {
+		return nil, fmt.Errorf("The scrypt work factor of %d in the age file is too high", logN)
+	}
+
+	wrapKey, err := ageScryptKey(passphrase, salt, logN)
+	if err != nil {
+		return nil, err
+	}
+	return ageUnwrap(wrapKey, s.body)
+}
+
+// newAgeHeader returns the header of a new age file along with the random
+// file key, wrapped for each of the recipients or with the passphrase. age
+// has no stanza for symmetric keys, and a passphrase can't be combined with
+// anything else.
+func newAgeHeader(m *masterKeys) (*ageHeader, []byte, error) {
+	if len(m.keys) > 0 {
+		return nil, nil, errors.New("age files can't be encrypted with keys, please use recipients or a passphrase")
+	}
+	if m.scrypt != nil && len(m.recipients) > 0 {
+		return nil, nil, errors.New("age files encrypted with a passphrase can't have recipients")
+	}
+
+	fileKey := make([]byte, ageFileKeySize)
+	if _, err := io.ReadFull(rand.Reader, fileKey); err != nil {
+		return nil, nil, err
+	}
+
+	h := &ageHeader{}
+	for _, recipient := range m.recipients {
+		s, err := newAgeX25519Stanza(recipient, fileKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+	if m.scrypt != nil {
+		s, err := newAgeScryptStanza(m.passphrase, m.scrypt, fileKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+
+	if len(h.stanzas) == 0 {
+		return nil, nil, errors.New("Please provide a recipient with --recipient or a passphrase with --passphrase to encrypt an age file")
+	}
+	h.mac = h.headerMAC(fileKey)
+	return h, fileKey, nil
+}
+
+// unwrapAgeHeader returns the file key of an age file, unwrapped with
+// whichever of the credentials matches one of the stanzas. Stanzas of other
+// kinds are skipped.
+func unwrapAgeHeader(h *ageHeader, c *credentials) ([]byte, error) {
+	var hasScrypt, hasX25519 bool
+	for _, s := range h.stanzas {
+		hasScrypt = hasScrypt || s.kind == ageScryptKind
+		hasX25519 = hasX25519 || s.kind == ageX25519Kind
+	}
+	// a scrypt stanza has to be alone, or a file could be both passphrase
+	// protected and readable by a recipient
+	if hasScrypt && len(h.stanzas) != 1 {
+		return nil, errBadAgeHeader
+	}
+
+	for _, s := range h.stanzas {
+		var fileKey []byte
+		var err error
+		switch {
+		case s.kind == ageX25519Kind && len(c.identities) > 0:
+			fileKey, err = unwrapAgeX25519(s, c.identities)
+		case s.kind == ageScryptKind && len(c.passphrase) > 0:
+			fileKey, err = unwrapAgeScrypt(s, c.passphrase)
+		default:
+			continue
+		}
+		if err == errAgeNoMatch {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !hmac.Equal(h.mac, h.headerMAC(fileKey)) {
+			return nil, errAuthFailed
+		}
+		return fileKey, nil
+	}
+
+	// name what's needed when nothing given applies to this file
+	var needed []string
+	if hasScrypt {
+		needed = append(needed, "a passphrase with --passphrase or $GOSECRET_PASSPHRASE")
+	}
+	if hasX25519 {
+		needed = append(needed, "an identity file with --identity or $GOSECRET_IDENTITY")
+	}
+	applicable := (hasScrypt && len(c.passphrase) > 0) || (hasX25519 && len(c.identities) > 0)
+
+	switch {
+	case len(needed) == 0:
+		return nil, errors.New("age file was encrypted with a kind of recipient this version of gosecret doesn't support")
+	case !applicable:
+		return nil, fmt.Errorf("age file can't be decrypted with what was given, please provide %s", strings.Join(needed, " or "))
+	}
+	return nil, errAgeNoMatch
+}
+
+// newAgeDecryptReader reads the header of an age file from r and returns a
+// reader of the decrypted payload.
+func newAgeDecryptReader(r *bufio.Reader, c *credentials) (io.Reader, error) {
+	h, err := readAgeHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := unwrapAgeHeader(h, c)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := newAgeReader(r, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// decodeAgeKey decodes an age recipient or identity with the given human
+// readable part.
+func decodeAgeKey(hrp, s string) ([]byte, error) {
+	gotHRP, key, err := bech32Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if gotHRP != strings.ToLower(hrp) || len(key) != x25519KeySize {
+		return nil, errors.New("Malformed key")
+	}
+	return key, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"github.com/robmerrell/gosecret/vendor/golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"syscall"
+)
+
+// The payload of an age file is a random nonce followed by 64 KiB chunks
+// sealed with ChaCha20-Poly1305, using the same nonces as gosecret's stream.
+// Unlike gosecret's stream the last chunk can be full, and it can only be
+// empty when the whole payload is. A full chunk is opened as the last one
+// when it doesn't open as any other.
+
+const (
+	ageChunkSize = 64 * 1024
+	ageNonceSize = 16
+)
+
+var errTrailingData = errors.New("Encrypted file has data after its end")
+
+// newAgePayloadAEAD returns the cipher used to seal the chunks of an age
+// payload.
+func newAgePayloadAEAD(fileKey, nonce []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(hkdfSHA256(fileKey, nonce, "payload"))
+}
+
+// ageWriter encrypts everything written to it as an age payload. Close must
+// be called to write the final chunk.
+type ageWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+	err     error
+}
+
+// newAgeWriter writes header h and a new nonce to w and returns a writer
+// that encrypts into w with fileKey.
+func newAgeWriter(w io.Writer, h *ageHeader, fileKey []byte) (*ageWriter, error) {
+	nonce := make([]byte, ageNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	aead, err := newAgePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append(h.marshal(), nonce...)); err != nil {
+		return nil, err
+	}
+
+	return &ageWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, ageChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *ageWriter) Write(p []byte) (n int, err error) {
+	if s.closed {
+		return 0, syscall.EINVAL
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	for len(p) > 0 {
+		// a full chunk is held back until more arrives, since it could be
+		// the last one
+		if len(s.buf) == ageChunkSize {
+			if s.err = s.flush(false); s.err != nil {
+				return n, s.err
+			}
+		}
+
+		r := copy(s.buf[len(s.buf):ageChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+r]
+		p = p[r:]
+		n += r
+	}
+	return n, nil
+}
+
+// flush seals the buffered plaintext and writes it out.
+func (s *ageWriter) flush(last bool) error {
+	sealed := s.aead.Seal(s.buf[:0], chunkNonce(s.counter, last), s.buf, nil)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Close writes the final chunk. It doesn't close the underlying writer.
+func (s *ageWriter) Close() error {
+	if s.closed {
+		return syscall.EINVAL
+	}
+	s.closed = true
+	if s.err != nil {
+		return s.err
+	}
+	return s.flush(true)
+}
+
+// ageReader authenticates and decrypts the chunks of an age payload as they
+// are read.
+type ageReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	out     []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// newAgeReader reads the nonce of an age payload from r and returns a reader
+// that decrypts the rest of it.
+func newAgeReader(r *bufio.Reader, fileKey []byte) (*ageReader, error) {
+	nonce := make([]byte, ageNonceSize)
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, errBadAgeHeader
+	}
+	aead, err := newAgePayloadAEAD(fileKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ageReader{
+		r:    r,
+		aead: aead,
+		buf:  make([]byte, ageChunkSize+aead.Overhead()),
+		out:  make([]byte, ageChunkSize),
+	}, nil
+}
+
+func (s *ageReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.readChunk()
+	}
+
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// readChunk reads and opens the next chunk. A short chunk has to be the
+// last, and a full one is the last if it was sealed as one. Nothing can
+// follow the last chunk.
+func (s *ageReader) readChunk() error {
+	n, err := io.ReadFull(s.r, s.buf)
+	last := false
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+		// only a file with no payload ends with an empty chunk
+		if n == s.aead.Overhead() && s.counter > 0 {
+			return errAuthFailed
+		}
+		last = true
+	case io.EOF:
+		return errTruncated
+	default:
+		return err
+	}
+
+	plain, err := s.aead.Open(s.out[:0], chunkNonce(s.counter, last), s.buf[:n], nil)
+	if err != nil && !last {
+		last = true
+		plain, err = s.aead.Open(s.out[:0], chunkNonce(s.counter, last), s.buf[:n], nil)
+	}
+	if err != nil {
+		return errAuthFailed
+	}
+	s.counter++
+	s.plain = plain
+	s.done = last
+
+	if last {
+		if _, err := s.r.Peek(1); err == nil {
+			return errTrailingData
+		} else if err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
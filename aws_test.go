@@ -1,15 +1,79 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// keep the ETags the tests download and upload out of the home directory
+	dir, _ := ioutil.TempDir("", "gosecret-state")
+	os.Setenv("GOSECRET_STATE_FILE", filepath.Join(dir, "state.json"))
+
+	// give the retry flags their defaults, as parsing the command line would
+	for _, flagInit := range []func(*flag.FlagSet){downloadFlagInit, uploadFlagInit, editFlagInit, execFlagInit} {
+		flagInit(flag.NewFlagSet("defaults", flag.ContinueOnError))
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// readSignedBody reads the body of an upload request, which is signed in
+// aws-chunked chunks, and returns the data in it.
+func readSignedBody(t *testing.T, r *http.Request) []byte {
+	if r.Header.Get("Content-Encoding") != "aws-chunked" {
+		t.Fatalf("Expected an aws-chunked body, but got %q", r.Header.Get("Content-Encoding"))
+	}
+
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Couldn't read chunk header: %s", err)
+		}
+		var size int
+		if _, err := fmt.Sscanf(line, "%x;chunk-signature=", &size); err != nil {
+			t.Fatalf("Bad chunk header %q", line)
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			t.Fatalf("Couldn't read chunk: %s", err)
+		}
+		data = append(data, chunk[:size]...)
+		if size == 0 {
+			break
+		}
+	}
+
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != strconv.Itoa(len(data)) {
+		t.Errorf("Expected %s bytes of data, but got %d", decoded, len(data))
+	}
+	return data
+}
+
 func replaceUrl(newUrl string, refVar *string, testFunc func()) {
 	oldUrl := *refVar
 	*refVar = newUrl
@@ -30,7 +94,7 @@ func TestUpload(t *testing.T) {
 	defer server.Close()
 
 	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
-		err := upload("testbucket", "testdata/plain", nil)
+		_, err := upload("testbucket", "testdata/plain", nil, nil)
 		if err != nil {
 			t.Errorf("Couldn't upload file: %s", err)
 		}
@@ -40,6 +104,15 @@ func TestUpload(t *testing.T) {
 	})
 }
 
+func TestUploadShouldAbortWhenReadingFails(t *testing.T) {
+	requests := recordUploadRequests(func() {
+		if _, err := upload("testbucket", "testdata", nil, nil); err == nil {
+			t.Error("Expected the read error")
+		}
+	})
+	checkUploadAborted(t, requests)
+}
+
 func TestUploadFlagPostParse(t *testing.T) {
 	filename := "testdata/plain"
 
@@ -75,6 +148,58 @@ func TestUploadAction(t *testing.T) {
 	})
 }
 
+func TestS3RequestsAreSignedWithV4(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		w.Header().Add("ETag", "faketag")
+		if r.Method == "PUT" {
+			readSignedBody(t, r)
+		}
+		uploadRes, _ := ioutil.ReadFile("testdata/upload_res")
+		fmt.Fprint(w, string(uploadRes))
+	}))
+	defer server.Close()
+
+	uploadBucketNameFlag, downloadBucketNameFlag = "testbucket", "testbucket"
+	uploadAccessKeyFlag, downloadAccessKeyFlag = "testaccess", "testaccess"
+	uploadSecretKeyFlag, downloadSecretKeyFlag = "testsecret", "testsecret"
+	uploadSessionTokenFlag, downloadSessionTokenFlag = "testtoken", "testtoken"
+	uploadRegionFlag, downloadRegionFlag = "eu-west-2", "eu-west-2"
+	uploadFilenameArg = "testdata/plain"
+	downloadFilenameArg, downloadDestinationFilenameArg = "plain", "test_download_signed"
+	defer func() {
+		uploadSessionTokenFlag, downloadSessionTokenFlag = "", ""
+		uploadRegionFlag, downloadRegionFlag = "", ""
+		os.Remove("test_download_signed")
+	}()
+
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		if err := uploadAction(); err != nil {
+			t.Errorf("Couldn't upload file: %s", err)
+		}
+		if err := downloadAction(); err != nil {
+			t.Errorf("Couldn't download file: %s", err)
+		}
+	})
+
+	if len(requests) < 4 {
+		t.Fatalf("Expected the upload and download requests, but got %d requests", len(requests))
+	}
+	scope := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=testaccess/%s/eu-west-2/s3/aws4_request, ", time.Now().UTC().Format("20060102"))
+	for _, r := range requests {
+		if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, scope) || !strings.Contains(auth, "x-amz-security-token") {
+			t.Errorf("%s %s isn't signed with SigV4: %q", r.Method, r.URL, auth)
+		}
+		if r.Header.Get("X-Amz-Security-Token") != "testtoken" {
+			t.Errorf("%s %s doesn't have the session token", r.Method, r.URL)
+		}
+		if r.Header.Get("X-Amz-Content-Sha256") == "" {
+			t.Errorf("%s %s doesn't have a payload hash", r.Method, r.URL)
+		}
+	}
+}
+
 func TestGenerateS3Url(t *testing.T) {
 	url := generateS3Url("bucket", "file")
 	validUrl := "https://bucket.s3.amazonaws.com/file"
@@ -98,7 +223,7 @@ func TestDownload(t *testing.T) {
 			os.Remove(testfile)
 		}
 
-		err = download("testbucket", testfile, testfile, nil)
+		_, err = download("testbucket", testfile, "", testfile, nil, nil)
 		if err != nil {
 			t.Errorf("Couldn't download file: %s", err)
 		}
@@ -146,3 +271,1127 @@ func TestDownloadAction(t *testing.T) {
 		os.Remove(filename)
 	})
 }
+
+func TestPush(t *testing.T) {
+	var uploaded []byte
+	var uploadedPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("ETag", "faketag")
+		if r.Method == "PUT" {
+			uploadedPath = r.URL.Path
+			uploaded = readSignedBody(t, r)
+		}
+		uploadRes, _ := ioutil.ReadFile("testdata/upload_res")
+		fmt.Fprint(w, string(uploadRes))
+	}))
+	defer server.Close()
+
+	h, key, _ := newKeyHeader(testKey)
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		_, err := push("testbucket", "testdata/plain", "remote/plain.enc", h, key, nil, nil)
+		if err != nil {
+			t.Errorf("Couldn't push file: %s", err)
+		}
+	})
+
+	if uploadedPath != "/testbucket/remote/plain.enc" {
+		t.Errorf("Pushed to %s, but expected /testbucket/remote/plain.enc", uploadedPath)
+	}
+
+	plain, _ := ioutil.ReadFile("testdata/plain")
+	decrypted, err := decrypt(testKey, uploaded)
+	if err != nil {
+		t.Fatalf("Couldn't decrypt pushed file: %s", err)
+	}
+	if string(decrypted) != string(plain) {
+		t.Error("Pushed file doesn't decrypt to the original file")
+	}
+}
+
+func TestPushShouldAbortWhenReadingFails(t *testing.T) {
+	// reading a directory fails after the upload has started
+	h, key, _ := newKeyHeader(testKey)
+	requests := recordUploadRequests(func() {
+		if _, err := push("testbucket", "testdata", "remote/plain.enc", h, key, nil, nil); err == nil {
+			t.Error("Expected the read error")
+		}
+	})
+	checkUploadAborted(t, requests)
+}
+
+// recordUploadRequests runs f against a fake s3 accepting uploads, and
+// returns the method and query of each request made.
+func recordUploadRequests(f func()) []string {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RawQuery)
+		w.Header().Add("ETag", "faketag")
+		uploadRes, _ := ioutil.ReadFile("testdata/upload_res")
+		fmt.Fprint(w, string(uploadRes))
+	}))
+	defer server.Close()
+
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, f)
+	return requests
+}
+
+// checkUploadAborted checks that the upload made by requests was aborted
+// rather than completed.
+func checkUploadAborted(t *testing.T, requests []string) {
+	for _, request := range requests {
+		if strings.HasPrefix(request, "POST uploadId=") {
+			t.Errorf("Completed the upload after the read failed, requests were %q", requests)
+		}
+	}
+	if len(requests) == 0 || !strings.HasPrefix(requests[len(requests)-1], "DELETE uploadId=") {
+		t.Errorf("Expected the upload to be aborted, but requests were %q", requests)
+	}
+}
+
+func TestPushFlagPostParse(t *testing.T) {
+	filename := "testdata/plain"
+
+	fs := flag.NewFlagSet("name", flag.ExitOnError)
+	fs.Parse([]string{filename, "remote"})
+
+	pushFlagPostParse(fs)
+
+	if pushFilenameArg != filename {
+		t.Errorf("Got %s for filename, but expected %s", pushFilenameArg, filename)
+	}
+	if pushRemoteNameArg != "remote" {
+		t.Errorf("Got %s for remote name, but expected remote", pushRemoteNameArg)
+	}
+}
+
+func TestPushActionShouldFailWithBadKey(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	encryptKeyFlag = "bad key"
+	encryptPassphraseFlag = ""
+	uploadBucketNameFlag = "testbucket"
+	uploadAccessKeyFlag = "testaccess"
+	uploadSecretKeyFlag = "testsecret"
+	pushFilenameArg = "testdata/plain"
+
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		if err := pushAction(); err == nil {
+			t.Error("Expected an error, but didn't recive one")
+		}
+	})
+	if requests > 0 {
+		t.Error("Started an upload with a bad key")
+	}
+}
+
+func TestPull(t *testing.T) {
+	plain, _ := ioutil.ReadFile("testdata/plain")
+	encrypted, _ := encrypt(testKey, plain)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(encrypted)
+	}))
+	defer server.Close()
+
+	testfile := "test_pull_func"
+	defer os.Remove(testfile)
+
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		_, err := pull("testbucket", "plain.enc", testfile, &credentials{key: testKey}, nil)
+		if err != nil {
+			t.Fatalf("Couldn't pull file: %s", err)
+		}
+	})
+
+	pulled, _ := ioutil.ReadFile(testfile)
+	if string(pulled) != string(plain) {
+		t.Error("Pulled file doesn't match the original file")
+	}
+
+	fi, _ := os.Stat(testfile)
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Pulled file has permissions %s, but expected -rw-------", fi.Mode().Perm())
+	}
+}
+
+func TestPullShouldNotLeavePartialFile(t *testing.T) {
+	encrypted, _ := encrypt(testKey, bytes.Repeat([]byte("a"), 3*defaultChunkSize))
+	encrypted[len(encrypted)-1] ^= 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(encrypted)
+	}))
+	defer server.Close()
+
+	testfile := "test_pull_tampered"
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		_, err := pull("testbucket", "plain.enc", testfile, &credentials{key: testKey}, nil)
+		if err != errAuthFailed {
+			t.Errorf("Expected an authentication error, but got %v", err)
+		}
+	})
+
+	if _, err := os.Stat(testfile); err == nil {
+		os.Remove(testfile)
+		t.Error("Partially decrypted file was left behind")
+	}
+	if matches, _ := filepath.Glob("." + testfile + ".tmp*"); len(matches) > 0 {
+		t.Error("Temp file was left behind")
+	}
+}
+
+func TestPullFlagPostParse(t *testing.T) {
+	fs := flag.NewFlagSet("name", flag.ExitOnError)
+	fs.Parse([]string{"remote/plain.enc", "plain"})
+
+	pullFlagPostParse(fs)
+
+	if pullFilenameArg != "remote/plain.enc" {
+		t.Errorf("Got %s for filename, but expected remote/plain.enc", pullFilenameArg)
+	}
+	if pullDestinationFilenameArg != "plain" {
+		t.Errorf("Got %s for destination, but expected plain", pullDestinationFilenameArg)
+	}
+}
+
+func TestRotateS3(t *testing.T) {
+	newKey := []byte("4321432143214321")
+	plain, _ := ioutil.ReadFile("testdata/plain")
+	encrypted, _ := encrypt(testKey, plain)
+
+	uploaded := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("ETag", "faketag")
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("prefix") == "secrets/":
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>secrets/plain.enc</Key><Size>1</Size></Contents><CommonPrefixes><Prefix>secrets/sub/</Prefix></CommonPrefixes></ListBucketResult>`)
+		case r.Method == "GET" && r.URL.Query().Get("delimiter") != "":
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>secrets/sub/plain.enc</Key><Size>1</Size></Contents></ListBucketResult>`)
+		case r.Method == "GET":
+			w.Write(encrypted)
+		case r.Method == "PUT":
+			uploaded[r.URL.Path] = readSignedBody(t, r)
+		default:
+			uploadRes, _ := ioutil.ReadFile("testdata/upload_res")
+			fmt.Fprint(w, string(uploadRes))
+		}
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		store := &s3RotateStore{bucket: "testbucket", prefix: "secrets/", config: newS3Config("testaccess", "testsecret", "", "")}
+		r := &rotation{oldKey: testKey, newKey: newKey}
+		summary, err := r.run(store, &out)
+		if err != nil {
+			t.Fatalf("Couldn't rotate: %s", err)
+		}
+		if summary.rotated != 2 {
+			t.Errorf("Expected 2 rotated objects, but got %s", summary)
+		}
+	})
+
+	for _, path := range []string{"/testbucket/secrets/plain.enc", "/testbucket/secrets/sub/plain.enc"} {
+		decrypted, err := decrypt(newKey, uploaded[path])
+		if err != nil || !bytes.Equal(decrypted, plain) {
+			t.Errorf("%s doesn't decrypt with the new key: %v", path, err)
+		}
+	}
+}
+
+func TestInspectS3(t *testing.T) {
+	encrypted, _ := encrypt(testKey, make([]byte, 3*inspectHeaderSize))
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "plain.enc", time.Time{}, bytes.NewReader(encrypted))
+	}))
+	defer server.Close()
+
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		config := newS3Config("testaccess", "testsecret", "", "")
+		info, err := inspectFile("plain.enc", func(n int64) ([]byte, int64, error) {
+			return readS3Prefix("testbucket", "plain.enc", n, config)
+		})
+		if err != nil {
+			t.Fatalf("Couldn't inspect: %s", err)
+		}
+		if info.Size != int64(len(encrypted)) || *info.Plaintext != 3*inspectHeaderSize {
+			t.Errorf("Unexpected metadata: %+v", info)
+		}
+	})
+
+	expected := fmt.Sprintf("bytes=0-%d", inspectHeaderSize-1)
+	if len(ranges) != 1 || ranges[0] != expected {
+		t.Errorf("Expected a single request for %s, but got %q", expected, ranges)
+	}
+}
+
+func TestSetS3Endpoint(t *testing.T) {
+	tests := []struct {
+		endpoint  string
+		pathStyle bool
+		expected  string
+	}{
+		{"", false, "https://bucket.s3.amazonaws.com/file"},
+		{"", true, "https://s3.amazonaws.com/bucket/file"},
+		{"http://localhost:4566", true, "http://localhost:4566/bucket/file"},
+		{"https://minio.example.com/", false, "https://bucket.minio.example.com/file"},
+		{"https://ceph.example.com/s3/", true, "https://ceph.example.com/s3/bucket/file"},
+	}
+	for _, test := range tests {
+		replaceUrl(s3hostFmt, &s3hostFmt, func() {
+			if err := setS3Endpoint(newS3Config("", "", "", ""), test.endpoint, test.pathStyle, ""); err != nil {
+				t.Fatalf("Couldn't set endpoint %s: %s", test.endpoint, err)
+			}
+			if url := generateS3Url("bucket", "file"); url != test.expected {
+				t.Errorf("Got %s for %s, but expected %s", url, test.endpoint, test.expected)
+			}
+		})
+	}
+
+	for _, endpoint := range []string{"localhost:9000", "ftp://example.com", "https://example.com/?x=1"} {
+		replaceUrl(s3hostFmt, &s3hostFmt, func() {
+			if err := setS3Endpoint(newS3Config("", "", "", ""), endpoint, false, ""); err == nil {
+				t.Errorf("Expected an error for %s, but didn't receive one", endpoint)
+			}
+		})
+	}
+}
+
+func TestS3EndpointStyles(t *testing.T) {
+	plain, _ := ioutil.ReadFile("testdata/plain")
+	var hosts, paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		paths = append(paths, r.URL.Path)
+		if r.URL.Query().Get("delimiter") != "" {
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>secrets/plain</Key><Size>1</Size></Contents></ListBucketResult>`)
+			return
+		}
+		w.Write(plain)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	tests := []struct {
+		endpoint  string
+		pathStyle bool
+		host      string
+		paths     []string
+	}{
+		{server.URL, true, server.Listener.Addr().String(), []string{"/testbucket/", "/testbucket/secrets/plain"}},
+		{"http://s3.test:" + port, false, "testbucket.s3.test:" + port, []string{"/", "/secrets/plain"}},
+	}
+	for _, test := range tests {
+		hosts, paths = nil, nil
+		config := newS3Config("testaccess", "testsecret", "", "")
+		// every host name resolves to the test server
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, server.Listener.Addr().String())
+		}
+		config.Client = &http.Client{Transport: transport}
+
+		replaceUrl(s3hostFmt, &s3hostFmt, func() {
+			if err := setS3Endpoint(config, test.endpoint, test.pathStyle, ""); err != nil {
+				t.Fatalf("Couldn't set endpoint: %s", err)
+			}
+			store := &s3RotateStore{bucket: "testbucket", prefix: "secrets/", config: config}
+			names, err := store.list()
+			if err != nil || len(names) != 1 {
+				t.Fatalf("Couldn't list the bucket: %v %v", names, err)
+			}
+			var contents []byte
+			f, err := store.open(names[0])
+			if err == nil {
+				contents, err = ioutil.ReadAll(f)
+				f.Close()
+			}
+			if err != nil || !bytes.Equal(contents, plain) {
+				t.Errorf("Couldn't read %s: %v", names[0], err)
+			}
+		})
+
+		if len(paths) != 2 || paths[0] != test.paths[0] || paths[1] != test.paths[1] {
+			t.Errorf("Expected requests for %v, but got %v", test.paths, paths)
+		}
+		for _, host := range hosts {
+			if host != test.host {
+				t.Errorf("Expected requests to %s, but got %s", test.host, host)
+			}
+		}
+	}
+}
+
+func TestS3CABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "test message")
+	}))
+	defer server.Close()
+
+	bundle, _ := ioutil.TempFile("", "gosecret-ca")
+	defer os.Remove(bundle.Name())
+	pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	bundle.Close()
+
+	replaceUrl(s3hostFmt, &s3hostFmt, func() {
+		config := newS3Config("testaccess", "testsecret", "", "")
+		setS3Endpoint(config, server.URL, true, "")
+		if _, err := openS3File("testbucket", "plain", config); err == nil {
+			t.Error("Expected the server's certificate to be rejected")
+		}
+
+		if err := setS3Endpoint(config, server.URL, true, bundle.Name()); err != nil {
+			t.Fatalf("Couldn't use the CA bundle: %s", err)
+		}
+		s3File, err := openS3File("testbucket", "plain", config)
+		if err != nil {
+			t.Fatalf("Couldn't download with the CA bundle: %s", err)
+		}
+		defer s3File.Close()
+		if contents, _ := ioutil.ReadAll(s3File); string(contents) != "test message" {
+			t.Errorf("Got %q from the server", contents)
+		}
+	})
+
+	if err := setS3Endpoint(newS3Config("", "", "", ""), "", false, "testdata/plain"); err == nil {
+		t.Error("Expected an error for a bundle without certificates, but didn't receive one")
+	}
+}
+
+func TestListS3(t *testing.T) {
+	var markers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("prefix") == "secrets/" && q.Get("marker") == "":
+			// the first page is truncated, so the rest has to be asked for
+			fmt.Fprint(w, `<ListBucketResult><IsTruncated>true</IsTruncated><Contents><Key>secrets/a.enc</Key><Size>10</Size><LastModified>2026-01-02T03:04:05.000Z</LastModified><ETag>"abc"</ETag></Contents></ListBucketResult>`)
+		case q.Get("prefix") == "secrets/":
+			markers = append(markers, q.Get("marker"))
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>secrets/b.enc</Key><Size>200</Size><LastModified>2026-01-03T03:04:05.000Z</LastModified><ETag>"def"</ETag></Contents><CommonPrefixes><Prefix>secrets/sub/</Prefix></CommonPrefixes></ListBucketResult>`)
+		case q.Get("prefix") == "secrets/sub/":
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>secrets/sub/c.enc</Key><Size>3</Size><LastModified>2026-01-04T03:04:05.000Z</LastModified><ETag>"ghi"</ETag></Contents></ListBucketResult>`)
+		default:
+			t.Errorf("Unexpected request %s", r.URL)
+		}
+	}))
+	defer server.Close()
+
+	var entries, recursive []*s3Entry
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		config := newS3Config("testaccess", "testsecret", "", "")
+		var err error
+		if entries, err = listS3("testbucket", "secrets", false, config); err != nil {
+			t.Fatalf("Couldn't list: %s", err)
+		}
+		if recursive, err = listS3("testbucket", "/secrets/", true, config); err != nil {
+			t.Fatalf("Couldn't list recursively: %s", err)
+		}
+	})
+	if len(markers) == 0 || markers[0] != "secrets/a.enc" {
+		t.Errorf("Expected the next page to start after secrets/a.enc, but got %v", markers)
+	}
+
+	var out bytes.Buffer
+	writeList(&out, entries, false, false)
+	if expected := "secrets/a.enc\nsecrets/b.enc\nsecrets/sub/\n"; out.String() != expected {
+		t.Errorf("Got %q, but expected %q", out.String(), expected)
+	}
+
+	out.Reset()
+	writeList(&out, recursive, false, false)
+	if expected := "secrets/a.enc\nsecrets/b.enc\nsecrets/sub/c.enc\n"; out.String() != expected {
+		t.Errorf("Got %q, but expected %q", out.String(), expected)
+	}
+
+	out.Reset()
+	writeList(&out, entries, true, false)
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 4 || lines[1] != "200  2026-01-03T03:04:05Z  def  secrets/b.enc" || !strings.HasPrefix(lines[2], "-") || !strings.HasSuffix(lines[2], " secrets/sub/") {
+		t.Errorf("Unexpected long listing:\n%s", out.String())
+	}
+
+	out.Reset()
+	writeList(&out, entries, false, true)
+	var decoded []*s3Entry
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != 3 {
+		t.Fatalf("Couldn't decode JSON listing: %v\n%s", err, out.String())
+	}
+	if *decoded[0] != (s3Entry{Key: "secrets/a.enc", Size: 10, LastModified: "2026-01-02T03:04:05Z", ETag: "abc"}) || !decoded[2].Dir {
+		t.Errorf("Unexpected JSON listing:\n%s", out.String())
+	}
+}
+
+func TestListActionShouldRequireBucket(t *testing.T) {
+	downloadBucketNameFlag = ""
+	if err := listAction(); err == nil {
+		t.Error("Expected an error, but didn't receive one")
+	}
+}
+
+func TestDeleteS3(t *testing.T) {
+	var requests []string
+	var batches [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		switch {
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "POST" && r.URL.Query()["delete"] != nil:
+			var body struct {
+				Object []struct{ Key string }
+			}
+			if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatalf("Couldn't decode the delete request: %s", err)
+			}
+			var keys []string
+			fmt.Fprint(w, "<DeleteResult>")
+			for _, o := range body.Object {
+				keys = append(keys, o.Key)
+				if o.Key == "secrets/locked.enc" {
+					fmt.Fprintf(w, "<Error><Key>%s</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>", o.Key)
+				} else if o.Key == "secrets/b.enc" {
+					fmt.Fprintf(w, "<Deleted><Key>%s</Key><DeleteMarker>true</DeleteMarker></Deleted>", o.Key)
+				} else {
+					fmt.Fprintf(w, "<Deleted><Key>%s</Key></Deleted>", o.Key)
+				}
+			}
+			fmt.Fprint(w, "</DeleteResult>")
+			batches = append(batches, keys)
+		case r.Method == "GET" && r.URL.Query().Get("prefix") == "secrets/":
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>secrets/a.enc</Key></Contents><Contents><Key>secrets/b.enc</Key></Contents><CommonPrefixes><Prefix>secrets/sub/</Prefix></CommonPrefixes></ListBucketResult>`)
+		case r.Method == "GET" && r.URL.Query().Get("prefix") == "secrets/sub/":
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>secrets/sub/c.enc</Key></Contents></ListBucketResult>`)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	oldBatchSize := deleteBatchSize
+	deleteBatchSize = 2
+	defer func() { deleteBatchSize = oldBatchSize }()
+
+	var out bytes.Buffer
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		config := newS3Config("testaccess", "testsecret", "", "")
+
+		if err := deleteS3("testbucket", []string{"secrets/a.enc"}, "v1", config, &out); err != nil {
+			t.Fatalf("Couldn't delete a version: %s", err)
+		}
+		if expected := "DELETE /testbucket/secrets/a.enc?versionId=v1"; requests[0] != expected {
+			t.Errorf("Got request %q, but expected %q", requests[0], expected)
+		}
+
+		keys, err := listS3Prefixes("testbucket", []string{"secrets", "secrets/sub/"}, config)
+		if err != nil {
+			t.Fatalf("Couldn't list the prefixes: %s", err)
+		}
+		if expected := []string{"secrets/a.enc", "secrets/b.enc", "secrets/sub/c.enc"}; !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Got keys %v, but expected %v", keys, expected)
+		}
+		if _, err := listS3Prefixes("testbucket", []string{"/"}, config); err == nil {
+			t.Error("Expected an error for the whole bucket, but didn't receive one")
+		}
+
+		err = deleteS3("testbucket", append(keys, "secrets/locked.enc"), "", config, &out)
+		if err == nil || !strings.Contains(err.Error(), "1 files couldn't be deleted") {
+			t.Errorf("Expected an error for the locked file, but got %v", err)
+		}
+	})
+
+	if expected := [][]string{{"secrets/a.enc", "secrets/b.enc"}, {"secrets/sub/c.enc", "secrets/locked.enc"}}; !reflect.DeepEqual(batches, expected) {
+		t.Errorf("Got batches %v, but expected %v", batches, expected)
+	}
+	expected := "Deleted secrets/a.enc (version v1)\nDeleted secrets/a.enc\nDeleted secrets/b.enc, its versions are kept behind a delete marker\nDeleted secrets/sub/c.enc\nCouldn't delete secrets/locked.enc: AccessDenied: Access Denied\n"
+	if out.String() != expected {
+		t.Errorf("Got output %q, but expected %q", out.String(), expected)
+	}
+}
+
+func TestConfirmDelete(t *testing.T) {
+	tests := []struct {
+		answer string
+		ok     bool
+	}{
+		{"y\n", true},
+		{"YES\n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		ok, err := confirmDelete(strings.NewReader(test.answer), &out, []string{"a.enc", "b.enc"}, "")
+		if err != nil {
+			t.Fatalf("Couldn't confirm: %s", err)
+		}
+		if ok != test.ok {
+			t.Errorf("Answering %q gave %v, but expected %v", test.answer, ok, test.ok)
+		}
+		if expected := "a.enc\nb.enc\nDelete 2 files? [y/N] "; out.String() != expected {
+			t.Errorf("Got prompt %q, but expected %q", out.String(), expected)
+		}
+	}
+}
+
+func TestDeleteActionShouldRequireOneFileWithVersionID(t *testing.T) {
+	deleteKeyArgs = []string{"a.enc", "b.enc"}
+	deleteVersionIDFlag = "v1"
+	defer func() { deleteKeyArgs, deleteVersionIDFlag = nil, "" }()
+	if err := deleteAction(); err == nil {
+		t.Error("Expected an error, but didn't receive one")
+	}
+}
+
+// testVersionsRes is a ListObjectVersions response for secrets.yml, with a
+// file whose name starts the same way that isn't one of its versions.
+const testVersionsRes = `<ListVersionsResult>
+	<Name>testbucket</Name>
+	<Prefix>secrets.yml</Prefix>
+	<IsTruncated>false</IsTruncated>
+	<DeleteMarker><Key>secrets.yml</Key><VersionId>v3</VersionId><IsLatest>true</IsLatest><LastModified>2026-01-03T00:00:00.000Z</LastModified><Owner><ID>abc123</ID></Owner></DeleteMarker>
+	<Version><Key>secrets.yml</Key><VersionId>v2</VersionId><IsLatest>false</IsLatest><LastModified>2026-01-02T00:00:00.000Z</LastModified><ETag>"e2"</ETag><Size>20</Size><Owner><ID>abc123</ID><DisplayName>alice</DisplayName></Owner></Version>
+	<Version><Key>secrets.yml</Key><VersionId>v1</VersionId><IsLatest>false</IsLatest><LastModified>2026-01-01T00:00:00.000Z</LastModified><ETag>"e1"</ETag><Size>10</Size><Owner><ID>def456</ID><DisplayName>bob</DisplayName></Owner></Version>
+	<Version><Key>secrets.yml.bak</Key><VersionId>v9</VersionId><IsLatest>true</IsLatest><LastModified>2026-01-01T00:00:00.000Z</LastModified><Size>10</Size></Version>
+</ListVersionsResult>`
+
+func TestHistory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query()["versions"] == nil || r.URL.Query().Get("prefix") != "secrets.yml" {
+			t.Errorf("Unexpected request %s", r.URL)
+		}
+		fmt.Fprint(w, testVersionsRes)
+	}))
+	defer server.Close()
+
+	var versions []s3util.Version
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		var err error
+		versions, err = s3History("testbucket", "secrets.yml", newS3Config("testaccess", "testsecret", "", ""))
+		if err != nil {
+			t.Fatalf("Couldn't list the versions: %s", err)
+		}
+	})
+
+	var out bytes.Buffer
+	writeHistory(&out, versions)
+	expected := "v3  2026-01-03T00:00:00Z  -   abc123  latest, delete marker\n" +
+		"v2  2026-01-02T00:00:00Z  20  alice\n" +
+		"v1  2026-01-01T00:00:00Z  10  bob\n"
+	if out.String() != expected {
+		t.Errorf("Got history %q, but expected %q", out.String(), expected)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	var copySource, acl string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Query()["versions"] != nil:
+			fmt.Fprint(w, testVersionsRes)
+		case r.Method == "PUT" && r.URL.Path == "/testbucket/secrets.yml":
+			copySource = r.Header.Get("X-Amz-Copy-Source")
+			acl = r.Header.Get("X-Amz-Acl")
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"e1"</ETag></CopyObjectResult>`)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		config := newS3Config("testaccess", "testsecret", "", "")
+		if err := rollback("testbucket", "secrets.yml", "v1", config, &out); err != nil {
+			t.Fatalf("Couldn't roll back: %s", err)
+		}
+		for _, version := range []string{"v3", "v9", "nope"} {
+			if err := rollback("testbucket", "secrets.yml", version, config, &out); err == nil {
+				t.Errorf("Expected an error rolling back to %s, but didn't receive one", version)
+			}
+		}
+	})
+
+	if expected := "/testbucket/secrets.yml?versionId=v1"; copySource != expected {
+		t.Errorf("Got copy source %q, but expected %q", copySource, expected)
+	}
+	if acl != "private" {
+		t.Errorf("Expected a private copy, but got %q", acl)
+	}
+	if expected := "Rolled back secrets.yml to version v1\n"; out.String() != expected {
+		t.Errorf("Got %q, but expected %q", out.String(), expected)
+	}
+}
+
+func TestDownloadVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "version %s", r.URL.Query().Get("versionId"))
+	}))
+	defer server.Close()
+
+	testfile := "test_download_version"
+	defer os.Remove(testfile)
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		if _, err := download("testbucket", "secrets.yml", "v1", testfile, nil, nil); err != nil {
+			t.Fatalf("Couldn't download the version: %s", err)
+		}
+	})
+
+	if contents, _ := ioutil.ReadFile(testfile); string(contents) != "version v1" {
+		t.Errorf("Got %q, but expected the contents of version v1", contents)
+	}
+}
+
+// testSSECustomerKey is a base64 encoded 32 byte key for SSE-C.
+const testSSECustomerKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestUploadSSE(t *testing.T) {
+	tests := []struct {
+		mode, kmsKeyID, customerKey string
+		initiate, part              map[string]string
+	}{
+		{"aes256", "", "",
+			map[string]string{"X-Amz-Server-Side-Encryption": "AES256"},
+			map[string]string{"X-Amz-Server-Side-Encryption": ""},
+		},
+		{"aws:kms", "arn:aws:kms:us-east-1:123456789012:key/test", "",
+			map[string]string{"X-Amz-Server-Side-Encryption": "aws:kms", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "arn:aws:kms:us-east-1:123456789012:key/test"},
+			map[string]string{"X-Amz-Server-Side-Encryption": "", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": ""},
+		},
+		{"customer", "", testSSECustomerKey,
+			map[string]string{
+				"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256",
+				"X-Amz-Server-Side-Encryption-Customer-Key":       testSSECustomerKey,
+				"X-Amz-Server-Side-Encryption-Customer-Key-Md5":   "hRasmdxgYDKV3nvbahU1MA==",
+			},
+			map[string]string{
+				"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256",
+				"X-Amz-Server-Side-Encryption-Customer-Key":       testSSECustomerKey,
+				"X-Amz-Server-Side-Encryption-Customer-Key-Md5":   "hRasmdxgYDKV3nvbahU1MA==",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var initiated, parts int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			expected := map[string]string{}
+			switch {
+			case r.Method == "POST" && r.URL.Query()["uploads"] != nil:
+				initiated++
+				expected = test.initiate
+				fmt.Fprint(w, "<UploadId>testupload</UploadId>")
+			case r.Method == "PUT":
+				parts++
+				expected = test.part
+				w.Header().Add("ETag", `"faketag"`)
+			}
+			for k, v := range expected {
+				if got := r.Header.Get(k); got != v {
+					t.Errorf("%s %s: got %s %q, but expected %q", test.mode, r.Method, k, got, v)
+				}
+			}
+			if r.Header.Get("X-Amz-Acl") != "private" && r.Method == "POST" && r.URL.Query()["uploads"] != nil {
+				t.Errorf("%s: the upload isn't private", test.mode)
+			}
+		}))
+
+		sse, err := sseHeaders(test.mode, test.kmsKeyID, test.customerKey)
+		if err != nil {
+			t.Fatalf("%s: couldn't make the headers: %s", test.mode, err)
+		}
+		replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+			if _, err := upload("testbucket", "testdata/plain", sse, nil); err != nil {
+				t.Errorf("%s: couldn't upload file: %s", test.mode, err)
+			}
+		})
+		server.Close()
+
+		if initiated != 1 || parts < 1 {
+			t.Errorf("%s: expected an upload with parts, but got %d uploads and %d parts", test.mode, initiated, parts)
+		}
+	}
+}
+
+func TestSSEHeadersErrors(t *testing.T) {
+	tests := []struct{ mode, kmsKeyID, customerKey string }{
+		{"aes128", "", ""},
+		{"aes256", "key", ""},
+		{"", "", testSSECustomerKey},
+		{"customer", "", ""},
+		{"customer", "", "c2hvcnQ="},
+		{"customer", "", "not base64"},
+	}
+	for _, test := range tests {
+		if _, err := sseHeaders(test.mode, test.kmsKeyID, test.customerKey); err == nil {
+			t.Errorf("Expected an error for %+v, but didn't receive one", test)
+		}
+	}
+
+	if h, err := sseHeaders("AES256", "", ""); err != nil || h.Get("x-amz-server-side-encryption") != "AES256" {
+		t.Errorf("Expected AES256 to be accepted in upper case, but got %v, %v", h, err)
+	}
+	if h, err := sseHeaders("", "", ""); err != nil || len(h) != 0 {
+		t.Errorf("Expected no headers without --sse, but got %v, %v", h, err)
+	}
+}
+
+func TestDownloadSSECustomer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key") != testSSECustomerKey ||
+			r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "AES256" ||
+			r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "encrypted at rest")
+	}))
+	defer server.Close()
+
+	sse, err := sseCustomerHeaders(testSSECustomerKey)
+	if err != nil {
+		t.Fatalf("Couldn't make the headers: %s", err)
+	}
+	testfile := "test_download_sse"
+	defer os.Remove(testfile)
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		if _, err := download("testbucket", "secrets.yml", "", testfile, sse, nil); err != nil {
+			t.Fatalf("Couldn't download with the customer key: %s", err)
+		}
+		if _, err := download("testbucket", "secrets.yml", "", testfile, nil, nil); err == nil {
+			t.Error("Expected an error without the customer key, but didn't receive one")
+		}
+	})
+
+	if contents, _ := ioutil.ReadFile(testfile); string(contents) != "encrypted at rest" {
+		t.Errorf("Got %q, but expected the file", contents)
+	}
+}
+
+func TestWriteEditFileConflict(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Query()["uploads"] != nil:
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>testupload</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == "PUT":
+			w.Header().Add("ETag", `"part"`)
+		case r.Method == "POST":
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}
+	}))
+	defer server.Close()
+	defer os.Remove("secrets.yml.conflict")
+
+	config := newS3Config("testaccess", "testsecret", "", "")
+	setS3Retry(config, 1, 0, 0)
+	editBucketNameFlag, editFilenameArg = "editbucket", "secrets.yml"
+	defer func() { editBucketNameFlag = "" }()
+
+	// merge is only suggested when it can be used
+	tests := []struct {
+		format    string
+		versionID string
+		merge     bool
+	}{
+		{"yaml", "v1", true},
+		{"yaml", "", false},
+		{"", "v1", false},
+	}
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		for _, test := range tests {
+			read := &s3util.ObjectInfo{ETag: "etag1", VersionId: test.versionID}
+			err := writeEditFile(config, test.format, []byte("encrypted"), read)
+			if err == nil || !strings.Contains(err.Error(), "secrets.yml.conflict") {
+				t.Fatalf("Expected a conflict error, but got %v", err)
+			}
+			if strings.Contains(err.Error(), "gosecret merge") != test.merge {
+				t.Errorf("Got %q for format %q and version %q", err, test.format, test.versionID)
+			}
+		}
+	})
+	if contents, _ := ioutil.ReadFile("secrets.yml.conflict"); string(contents) != "encrypted" {
+		t.Errorf("Got %q in the conflict file, but expected the changes", contents)
+	}
+}
+
+func TestS3StateKeyShouldIncludeEndpoint(t *testing.T) {
+	oldFmt := s3hostFmt
+	defer func() { s3hostFmt = oldFmt }()
+
+	if key := s3StateKey("bucket", "secrets.yml"); key != "bucket/secrets.yml" {
+		t.Errorf("Got %s for AWS, but expected bucket/secrets.yml", key)
+	}
+
+	// the same bucket at another endpoint is another file, whichever style
+	// its URLs are in
+	config := newS3Config("testaccess", "testsecret", "", "")
+	for _, pathStyle := range []bool{false, true} {
+		setS3Endpoint(config, "https://minio.example.com:9000", pathStyle, "")
+		if key := s3StateKey("bucket", "secrets.yml"); key != "minio.example.com:9000/bucket/secrets.yml" {
+			t.Errorf("Got %s, but expected minio.example.com:9000/bucket/secrets.yml", key)
+		}
+	}
+}
+
+func TestUploadActionConditional(t *testing.T) {
+	var conditions []string
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Query()["uploads"] != nil:
+			fmt.Fprint(w, "<UploadId>testupload</UploadId>")
+		case r.Method == "PUT":
+			w.Header().Add("ETag", `"part"`)
+		case r.Method == "POST":
+			conditions = append(conditions, "If-Match: "+r.Header.Get("If-Match")+", If-None-Match: "+r.Header.Get("If-None-Match"))
+			if fail {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"etag1"</ETag></CompleteMultipartUploadResult>`)
+		}
+	}))
+	defer server.Close()
+
+	uploadBucketNameFlag = "conditionalbucket"
+	uploadAccessKeyFlag = "testaccess"
+	uploadSecretKeyFlag = "testsecret"
+	uploadFilenameArg = "testdata/plain"
+	defer func() { uploadForceFlag = false }()
+
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		// the first upload expects a new file, the next the one uploaded
+		for i := 0; i < 2; i++ {
+			if err := uploadAction(); err != nil {
+				t.Fatalf("Couldn't upload file: %s", err)
+			}
+		}
+
+		fail = true
+		err := uploadAction()
+		if err == nil || !strings.Contains(err.Error(), "--force") {
+			t.Errorf("Expected a conflict error, but got %v", err)
+		}
+
+		fail = false
+		uploadForceFlag = true
+		if err := uploadAction(); err != nil {
+			t.Errorf("Couldn't force the upload: %s", err)
+		}
+	})
+
+	expected := []string{
+		"If-Match: , If-None-Match: *",
+		`If-Match: "etag1", If-None-Match: `,
+		`If-Match: "etag1", If-None-Match: `,
+		"If-Match: , If-None-Match: ",
+	}
+	if !reflect.DeepEqual(conditions, expected) {
+		t.Errorf("Got conditions %q, but expected %q", conditions, expected)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	h, key, _ := newKeyHeader(testKey)
+	base, _ := encryptStructured("yaml", h, key, []byte("a: 1\nb: 2\n"))
+	theirs, _ := encryptStructured("yaml", h, key, []byte("a: 1\nb: 3\n"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("versionId") == "v1" {
+			w.Write(base)
+			return
+		}
+		w.Header().Set("ETag", `"e2"`)
+		w.Header().Set("X-Amz-Version-Id", "v2")
+		w.Write(theirs)
+	}))
+	defer server.Close()
+
+	ours, _ := encryptStructured("yaml", h, key, []byte("a: 10\nb: 2\n"))
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		merged, conflicts, info, err := merge("testbucket", "secrets.yml", "yaml", "v1", ours, &credentials{key: testKey}, nil)
+		if err != nil {
+			t.Fatalf("Couldn't merge: %s", err)
+		}
+		if string(merged) != "a: 10\nb: 3\n" || len(conflicts) > 0 {
+			t.Errorf("Got %q with conflicts %q, but expected both changes", merged, conflicts)
+		}
+		if info == nil || info.ETag != "e2" || info.VersionId != "v2" {
+			t.Errorf("Got %+v, but expected the latest version", info)
+		}
+	})
+}
+
+func TestMergeActionShouldRequireBaseVersion(t *testing.T) {
+	mergeFilenameArg = "testdata/secrets.yml"
+	mergeDestinationFilenameArg = "test_merge_action"
+	mergeRemoteNameArg = "never-downloaded.yml"
+	downloadBucketNameFlag = "testbucket"
+	downloadAccessKeyFlag = "testaccess"
+	downloadSecretKeyFlag = "testsecret"
+	decryptKeyFlag = string(testKey)
+	defer func() { decryptKeyFlag = "" }()
+
+	err := mergeAction()
+	if err == nil || !strings.Contains(err.Error(), "versioning") {
+		t.Errorf("Expected an error about the base version, but got %v", err)
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "contents")
+	}))
+	defer server.Close()
+
+	config := newS3Config("testaccess", "testsecret", "", "")
+	if err := setS3Retry(config, 3, time.Millisecond, 2*time.Millisecond); err != nil {
+		t.Fatalf("Couldn't set the retries: %s", err)
+	}
+
+	testfile := "test_download_retries"
+	defer os.Remove(testfile)
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		if _, err := download("testbucket", "plain", "", testfile, nil, config); err != nil {
+			t.Fatalf("Couldn't download after retrying: %s", err)
+		}
+	})
+	if contents, _ := ioutil.ReadFile(testfile); string(contents) != "contents" || requests != 3 {
+		t.Errorf("Got %q after %d requests, but expected contents after 3", contents, requests)
+	}
+}
+
+func TestSetS3RetryErrors(t *testing.T) {
+	tests := []struct {
+		maxAttempts     int
+		delay, maxDelay time.Duration
+	}{
+		{0, time.Second, time.Second},
+		{3, -time.Second, time.Second},
+		{3, time.Minute, time.Second},
+	}
+	for _, test := range tests {
+		if err := setS3Retry(newS3Config("a", "b", "", ""), test.maxAttempts, test.delay, test.maxDelay); err == nil {
+			t.Errorf("Expected an error for %+v", test)
+		}
+	}
+}
+
+func TestUploadResumable(t *testing.T) {
+	failPut := true
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		requests = append(requests, r.Method)
+		switch {
+		case r.Method == "POST" && q["uploads"] != nil:
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>testupload</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == "GET":
+			fmt.Fprint(w, "<ListPartsResult></ListPartsResult>")
+		case r.Method == "PUT" && failPut:
+			w.WriteHeader(http.StatusBadRequest)
+		case r.Method == "PUT":
+			w.Header().Add("ETag", `"part"`)
+		case r.Method == "POST":
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"done"</ETag></CompleteMultipartUploadResult>`)
+		}
+	}))
+	defer server.Close()
+
+	config := newS3Config("testaccess", "testsecret", "", "")
+	setS3Retry(config, 1, 0, 0)
+	state, _ := loadS3State()
+	var key string
+
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		key = s3StateKey("resumablebucket", "plain")
+		_, err := uploadResumable("resumablebucket", "testdata/plain", nil, state, config)
+		if err == nil || !strings.Contains(err.Error(), "--resumable") {
+			t.Errorf("Expected an error saying how to resume, but got %v", err)
+		}
+		if u := state.Uploads[key]; u == nil || u.UploadId != "testupload" {
+			t.Fatalf("Got %+v in the state, but expected the upload", u)
+		}
+
+		// the upload is carried on rather than started again
+		failPut, requests = false, nil
+		info, err := uploadResumable("resumablebucket", "testdata/plain", nil, state, config)
+		if err != nil {
+			t.Fatalf("Couldn't resume the upload: %s", err)
+		}
+		if info.ETag != "done" || strings.Join(requests, " ") != "GET PUT POST" {
+			t.Errorf("Got %+v after requests %q, but expected the upload carried on", info, requests)
+		}
+	})
+	if reloaded, _ := loadS3State(); reloaded.Uploads[key] != nil {
+		t.Error("The finished upload is still in the state")
+	}
+}
+
+func TestUploadResumableShouldKeepUploadWhenReadingFails(t *testing.T) {
+	config := newS3Config("testaccess", "testsecret", "", "")
+	state, _ := loadS3State()
+
+	// the file can't be read past its start
+	r := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("read failed")))
+	requests := recordUploadRequests(func() {
+		_, err := resumeUpload("resumablebucket", "failed", r, nil, state, config)
+		if err == nil || !strings.Contains(err.Error(), "read failed") || !strings.Contains(err.Error(), "--resumable") {
+			t.Errorf("Expected the read error and how to resume, but got %v", err)
+		}
+		if u := state.Uploads[s3StateKey("resumablebucket", "failed")]; u == nil || u.UploadId == "" {
+			t.Errorf("Got %+v in the state, but expected the upload to carry on", u)
+		}
+	})
+
+	if strings.Join(requests, ",") != "POST uploads" {
+		t.Errorf("Expected the upload left open, but requests were %q", requests)
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	recent := time.Now().UTC().Format(time.RFC3339)
+	var aborted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			aborted = append(aborted, r.URL.Path+" "+r.URL.Query().Get("uploadId"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprintf(w, `<ListMultipartUploadsResult>
+<Upload><Key>old</Key><UploadId>u1</UploadId><Initiated>2020-01-02T03:04:05.000Z</Initiated></Upload>
+<Upload><Key>new</Key><UploadId>u2</UploadId><Initiated>%s</Initiated></Upload>
+</ListMultipartUploadsResult>`, recent)
+	}))
+	defer server.Close()
+
+	state, _ := loadS3State()
+	var out bytes.Buffer
+	replaceUrl(server.URL+"/%s/%s", &s3hostFmt, func() {
+		state.recordUpload("stalebucket", "old", &s3util.UploadState{UploadId: "u1"})
+		if err := abortStaleUploads("stalebucket", time.Hour, state, nil, &out); err != nil {
+			t.Fatalf("Couldn't abort the stale uploads: %s", err)
+		}
+		if state.Uploads[s3StateKey("stalebucket", "old")] != nil {
+			t.Error("The aborted upload is still in the state")
+		}
+	})
+
+	if strings.Join(aborted, ",") != "/stalebucket/old u1" {
+		t.Errorf("Aborted %q, but expected only the old upload", aborted)
+	}
+	if out.String() != "Aborted the upload of old started at 2020-01-02T03:04:05Z\n" {
+		t.Errorf("Got output %q", out.String())
+	}
+}
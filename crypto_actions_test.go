@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 var testKey = []byte("1234123412341234")
@@ -20,6 +31,166 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 }
 
+func TestEncryptWritesHeader(t *testing.T) {
+	encrypted, _ := encrypt(testKey, []byte("test message"))
+
+	h, _, err := parseHeader(encrypted)
+	if err != nil {
+		t.Fatalf("Couldn't parse header: %s", err)
+	}
+	if h.version != formatVersion || h.algorithm != algAESGCM {
+		t.Errorf("Got version %d and algorithm %d, expected %d and %d", h.version, h.algorithm, formatVersion, algAESGCM)
+	}
+}
+
+func TestDecryptShouldFailWithWrongKey(t *testing.T) {
+	encrypted, _ := encrypt(testKey, []byte("test message"))
+
+	// the error names the key the file needs
+	_, err := decrypt([]byte("4321432143214321"), encrypted)
+	if !strings.Contains(fmt.Sprint(err), formatKeyID(keyID(testKey))) {
+		t.Errorf("Expected an error naming the missing key, but got %v", err)
+	}
+}
+
+func TestDecryptShouldFailWhenTampered(t *testing.T) {
+	encrypted, _ := encrypt(testKey, []byte("test message"))
+
+	// flip a bit in the header and in the body
+	for _, i := range []int{len(formatMagic) + 1, len(encrypted) - 1} {
+		tampered := append([]byte{}, encrypted...)
+		tampered[i] ^= 1
+
+		_, err := decrypt(testKey, tampered)
+		if err == nil {
+			t.Errorf("Expected an error after changing byte %d, but didn't recive one", i)
+		}
+	}
+}
+
+func TestDecryptVersion1(t *testing.T) {
+	message := []byte("test message")
+
+	// version 1 is the header followed by a single AES-GCM message
+	block, _ := aes.NewCipher(testKey)
+	gcm, _ := cipher.NewGCM(block)
+	encrypted := (&header{version: 1, algorithm: algAESGCM}).marshal()
+	nonce := make([]byte, gcm.NonceSize())
+	encrypted = gcm.Seal(append(encrypted, nonce...), nonce, message, encrypted)
+
+	decrypted, err := decrypt(testKey, encrypted)
+	if err != nil {
+		t.Fatalf("Couldn't decrypt a version 1 file: %s", err)
+	}
+	if string(decrypted) != string(message) {
+		t.Error("Couldn't decrypt version 1 message correctly")
+	}
+}
+
+func TestEncryptDecryptMultipleChunks(t *testing.T) {
+	// exactly a multiple of the chunk size and something in between
+	for _, size := range []int{0, defaultChunkSize, 3*defaultChunkSize + 17} {
+		message := bytes.Repeat([]byte("a"), size)
+
+		encrypted, _ := encrypt(testKey, message)
+		decrypted, err := decrypt(testKey, encrypted)
+		if err != nil {
+			t.Fatalf("Couldn't decrypt %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(decrypted, message) {
+			t.Errorf("Couldn't decrypt %d bytes correctly", size)
+		}
+	}
+}
+
+func TestDecryptShouldFailWhenTruncated(t *testing.T) {
+	message := bytes.Repeat([]byte("a"), 2*defaultChunkSize+17)
+	encrypted, _ := encrypt(testKey, message)
+	h, body, _ := parseHeader(encrypted)
+	headerLen := len(encrypted) - len(body)
+	chunkLen := int(h.chunkSize) + 16
+
+	// dropping the final chunk leaves the file ending on a chunk boundary
+	_, err := decrypt(testKey, encrypted[:headerLen+2*chunkLen])
+	if err != errTruncated {
+		t.Errorf("Expected a truncation error, but got %v", err)
+	}
+
+	// cutting a chunk short makes it look like the final one
+	_, err = decrypt(testKey, encrypted[:headerLen+chunkLen+100])
+	if err != errAuthFailed {
+		t.Errorf("Expected an authentication error, but got %v", err)
+	}
+}
+
+func TestDecryptShouldFailWhenChunksReordered(t *testing.T) {
+	message := bytes.Repeat([]byte("a"), 2*defaultChunkSize+17)
+	encrypted, _ := encrypt(testKey, message)
+	h, body, _ := parseHeader(encrypted)
+	headerLen := len(encrypted) - len(body)
+	chunkLen := int(h.chunkSize) + 16
+
+	reordered := append([]byte{}, encrypted[:headerLen]...)
+	reordered = append(reordered, body[chunkLen:2*chunkLen]...)
+	reordered = append(reordered, body[:chunkLen]...)
+	reordered = append(reordered, body[2*chunkLen:]...)
+
+	_, err := decrypt(testKey, reordered)
+	if err != errAuthFailed {
+		t.Errorf("Expected an authentication error, but got %v", err)
+	}
+}
+
+func TestEncryptDecryptWithPassphrase(t *testing.T) {
+	message := []byte("test message")
+	params, _ := newScryptParams(minScryptLogN, minScryptR, minScryptP)
+
+	encrypted, err := encryptWithPassphrase([]byte("correct horse"), params, message)
+	if err != nil {
+		t.Fatalf("Couldn't encrypt with a passphrase: %s", err)
+	}
+
+	decrypted, err := decryptWithPassphrase([]byte("correct horse"), encrypted)
+	if err != nil {
+		t.Fatalf("Couldn't decrypt with a passphrase: %s", err)
+	}
+	if string(decrypted) != string(message) {
+		t.Error("Couldn't decrypt passphrase encrypted message correctly")
+	}
+
+	_, err = decryptWithPassphrase([]byte("battery staple"), encrypted)
+	if err != errAuthFailed {
+		t.Errorf("Expected an authentication error, but got %v", err)
+	}
+
+	_, err = decrypt(testKey, encrypted)
+	if err == nil {
+		t.Error("Expected an error decrypting with a key, but didn't recive one")
+	}
+}
+
+func TestDecryptWithPassphraseRejectsWeakParams(t *testing.T) {
+	params, _ := newScryptParams(minScryptLogN, minScryptR, minScryptP)
+	encrypted, _ := encryptWithPassphrase([]byte("correct horse"), params, []byte("test message"))
+
+	// lower log N in the passphrase stanza below the minimum
+	h, _, _ := parseHeader(encrypted)
+	h.stanzas[0].scrypt.logN = minScryptLogN - 1
+	copy(encrypted, h.marshal())
+
+	_, err := decryptWithPassphrase([]byte("correct horse"), encrypted)
+	if err == nil || err == errAuthFailed {
+		t.Errorf("Expected a cost parameter error, but got %v", err)
+	}
+}
+
+func TestNewScryptParamsShouldFailWithWeakParams(t *testing.T) {
+	_, err := newScryptParams(10, defaultScryptR, defaultScryptP)
+	if err == nil {
+		t.Error("Expected an error, but didn't recive one")
+	}
+}
+
 func TestEncryptShouldFailWithBadKey(t *testing.T) {
 	_, err := encrypt([]byte("bad key"), []byte("adsf"))
 	if err == nil {
@@ -92,6 +263,82 @@ func TestEncryptAction(t *testing.T) {
 	}
 }
 
+func TestEncryptActionInPlace(t *testing.T) {
+	filename := "testdata/test_encrypt_in_place"
+	defer os.Remove(filename)
+	plain, _ := ioutil.ReadFile("testdata/plain")
+	ioutil.WriteFile(filename, plain, 0644)
+
+	encryptKeyFlag = string(testKey)
+	encryptInFilenameArg = filename
+	encryptOutFilenameArg = filename
+	if err := encryptAction(); err != nil {
+		t.Fatalf("Couldn't encrypt a file in place: %s", err)
+	}
+
+	contents, _ := ioutil.ReadFile(filename)
+	decrypted, err := decrypt(testKey, contents)
+	if err != nil {
+		t.Fatalf("Couldn't decrypt the file: %s", err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Errorf("Got %q after encrypting in place, but expected the original file", decrypted)
+	}
+}
+
+func TestEncryptActionShouldKeepOutfileWithBadKey(t *testing.T) {
+	outfile := "testdata/test_encrypt_bad_key"
+	defer os.Remove(outfile)
+	ioutil.WriteFile(outfile, []byte("existing"), 0644)
+
+	encryptKeyFlag = "short"
+	encryptInFilenameArg = "testdata/plain"
+	encryptOutFilenameArg = outfile
+	if err := encryptAction(); err == nil {
+		t.Error("Expected an error with a bad key")
+	}
+
+	if contents, _ := ioutil.ReadFile(outfile); string(contents) != "existing" {
+		t.Errorf("Got %q in the outfile, but expected it left as it was", contents)
+	}
+}
+
+func TestEncryptDecryptActionWithPassphrase(t *testing.T) {
+	encfile := "testdata/test_encrypt_passphrase"
+	decfile := "testdata/test_decrypt_passphrase"
+	defer os.Remove(encfile)
+	defer os.Remove(decfile)
+
+	encryptKeyFlag = ""
+	encryptPassphraseFlag = "correct horse"
+	encryptScryptLogNFlag = minScryptLogN
+	encryptScryptRFlag = minScryptR
+	encryptScryptPFlag = minScryptP
+	encryptInFilenameArg = "testdata/plain"
+	encryptOutFilenameArg = encfile
+	defer func() { encryptPassphraseFlag = "" }()
+
+	if err := encryptAction(); err != nil {
+		t.Fatalf("Couldn't encrypt with a passphrase: %s", err)
+	}
+
+	decryptKeyFlag = ""
+	decryptPassphraseFlag = "correct horse"
+	decryptInFilenameArg = encfile
+	decryptOutFilenameArg = decfile
+	defer func() { decryptPassphraseFlag = "" }()
+
+	if err := decryptAction(); err != nil {
+		t.Fatalf("Couldn't decrypt with a passphrase: %s", err)
+	}
+
+	plain, _ := ioutil.ReadFile("testdata/plain")
+	contents, _ := ioutil.ReadFile(decfile)
+	if string(contents) != string(plain) {
+		t.Errorf("Expected %s but got %s", plain, contents)
+	}
+}
+
 func TestDecryptAction(t *testing.T) {
 	outfile := "testdata/test_decrypt_action"
 
@@ -114,3 +361,1409 @@ func TestDecryptAction(t *testing.T) {
 		t.Errorf("Expected This is a test file but got %s", message)
 	}
 }
+
+func TestDecryptActionRemovesOutputWhenTampered(t *testing.T) {
+	infile := "testdata/test_decrypt_tampered"
+	outfile := "testdata/test_decrypt_tampered_out"
+	defer os.Remove(infile)
+
+	encrypted, _ := encrypt(testKey, bytes.Repeat([]byte("a"), 2*defaultChunkSize))
+	encrypted[len(encrypted)-1] ^= 1
+	ioutil.WriteFile(infile, encrypted, 0644)
+
+	decryptKeyFlag = string(testKey)
+	decryptInFilenameArg = infile
+	decryptOutFilenameArg = outfile
+
+	if err := decryptAction(); err != errAuthFailed {
+		t.Errorf("Expected an authentication error, but got %v", err)
+	}
+	if _, err := os.Stat(outfile); err == nil {
+		os.Remove(outfile)
+		t.Error("Partially decrypted output was left behind")
+	}
+}
+
+func runEditAction(editor string) error {
+	oldEditor := os.Getenv("EDITOR")
+	os.Setenv("EDITOR", editor)
+	defer os.Setenv("EDITOR", oldEditor)
+
+	decryptKeyFlag = string(testKey)
+	decryptPassphraseFlag = ""
+	editBucketNameFlag = ""
+	return editAction()
+}
+
+func TestEditAction(t *testing.T) {
+	filename := "testdata/test_edit_action"
+	defer os.Remove(filename)
+	encrypted, _ := encrypt(testKey, []byte("This is a test file"))
+	ioutil.WriteFile(filename, encrypted, 0644)
+	editFilenameArg = filename
+
+	if err := runEditAction("sed -i s/test/edited/"); err != nil {
+		t.Fatalf("Couldn't edit file: %s", err)
+	}
+
+	contents, _ := ioutil.ReadFile(filename)
+	decrypted, err := decrypt(testKey, contents)
+	if err != nil {
+		t.Fatalf("Couldn't decrypt edited file: %s", err)
+	}
+	if string(decrypted) != "This is a edited file" {
+		t.Errorf("Expected This is a edited file but got %s", decrypted)
+	}
+}
+
+func TestEditActionShouldKeepOtherKeys(t *testing.T) {
+	filename := "testdata/test_edit_keys"
+	defer os.Remove(filename)
+	otherKey := []byte("abcdefghijklmnopqrstuvwxyz123456")
+	h, key, _ := newEnvelopeHeader(&masterKeys{keys: [][]byte{testKey, otherKey}})
+	var b bytes.Buffer
+	w, _ := newStreamWriter(&b, h, key)
+	encrypted, _ := finishEncrypt(&b, w, []byte("This is a test file"))
+	ioutil.WriteFile(filename, encrypted, 0644)
+	editFilenameArg = filename
+
+	// the other key has to be given to wrap the data key for it again
+	if err := runEditAction("sed -i s/test/edited/"); err == nil || !strings.Contains(err.Error(), "--add-key") {
+		t.Errorf("Expected an error asking for the other key, but got %v", err)
+	}
+	if contents, _ := ioutil.ReadFile(filename); !bytes.Equal(contents, encrypted) {
+		t.Error("The file was changed without the other key")
+	}
+
+	encryptAddKeyFlag = stringsFlag{string(otherKey)}
+	defer func() { encryptAddKeyFlag = nil }()
+	if err := runEditAction("sed -i s/test/edited/"); err != nil {
+		t.Fatalf("Couldn't edit file: %s", err)
+	}
+	contents, _ := ioutil.ReadFile(filename)
+	for _, key := range [][]byte{testKey, otherKey} {
+		if decrypted, err := decrypt(key, contents); err != nil || string(decrypted) != "This is a edited file" {
+			t.Errorf("Couldn't decrypt the edited file with key %s: %v", key, err)
+		}
+	}
+}
+
+func TestEditActionWithIdentity(t *testing.T) {
+	identityFile := "testdata/test_edit_identity"
+	filename := "testdata/test_edit_identity.enc"
+	defer os.Remove(identityFile)
+	defer os.Remove(filename)
+
+	identity, _ := newX25519Identity()
+	ioutil.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)
+	h, key, _ := newEnvelopeHeader(&masterKeys{recipients: []*x25519Recipient{identity.recipient()}})
+	var b bytes.Buffer
+	w, _ := newStreamWriter(&b, h, key)
+	encrypted, _ := finishEncrypt(&b, w, []byte("This is a test file"))
+	ioutil.WriteFile(filename, encrypted, 0644)
+	editFilenameArg = filename
+	decryptIdentityFlag = identityFile
+	defer func() { decryptIdentityFlag = "" }()
+
+	if err := runEditAction("sed -i s/test/edited/"); err != nil {
+		t.Fatalf("Couldn't edit file with an identity: %s", err)
+	}
+	contents, _ := ioutil.ReadFile(filename)
+	r, err := newDecryptReader(bytes.NewReader(contents), &credentials{identities: []*x25519Identity{identity}})
+	if err != nil {
+		t.Fatalf("Couldn't decrypt the edited file with the identity: %s", err)
+	}
+	if decrypted, err := ioutil.ReadAll(r); err != nil || string(decrypted) != "This is a edited file" {
+		t.Errorf("Expected This is a edited file but got %s, %v", decrypted, err)
+	}
+}
+
+func TestEditActionShouldKeepAgeFormat(t *testing.T) {
+	identityFile := "testdata/test_edit_age_identity"
+	filename := "testdata/test_edit_age.age"
+	defer os.Remove(identityFile)
+	defer os.Remove(filename)
+
+	identity, _ := newX25519Identity()
+	other, _ := newX25519Identity()
+	ioutil.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)
+	h, fileKey, _ := newAgeHeader(&masterKeys{recipients: []*x25519Recipient{identity.recipient(), other.recipient()}})
+	var b bytes.Buffer
+	w, _ := newAgeWriter(&b, h, fileKey)
+	encrypted, _ := finishEncrypt(&b, w, []byte("This is a test file"))
+	ioutil.WriteFile(filename, encrypted, 0644)
+	editFilenameArg = filename
+	decryptIdentityFlag = identityFile
+	defer func() { decryptIdentityFlag = "" }()
+
+	if err := runEditAction("sed -i s/test/edited/"); err != nil {
+		t.Fatalf("Couldn't edit age file: %s", err)
+	}
+	contents, _ := ioutil.ReadFile(filename)
+	if !bytes.HasPrefix(contents, ageMagic) {
+		t.Fatal("The edited file isn't an age file anymore")
+	}
+	for _, id := range []*x25519Identity{identity, other} {
+		r, err := newDecryptReader(bytes.NewReader(contents), &credentials{identities: []*x25519Identity{id}})
+		if err == nil {
+			var decrypted []byte
+			decrypted, err = ioutil.ReadAll(r)
+			if string(decrypted) != "This is a edited file" {
+				t.Errorf("Expected This is a edited file but got %s", decrypted)
+			}
+		}
+		if err != nil {
+			t.Errorf("Couldn't decrypt the edited file with each identity: %s", err)
+		}
+	}
+}
+
+func TestEditActionShouldKeepPGPFormat(t *testing.T) {
+	filename := "testdata/test_edit_pgp.asc"
+	defer os.Remove(filename)
+	encrypted, _ := ioutil.ReadFile("testdata/pgp/all.asc")
+	ioutil.WriteFile(filename, encrypted, 0644)
+	editFilenameArg = filename
+
+	oldEditor := os.Getenv("EDITOR")
+	os.Setenv("EDITOR", "sed -i s/hunter2/hunter3/")
+	defer os.Setenv("EDITOR", oldEditor)
+	decryptKeyFlag, decryptPassphraseFlag = "", "test passphrase"
+	decryptPGPKeyringFlag = "testdata/pgp/secring.asc"
+	defer func() { decryptPassphraseFlag, decryptPGPKeyringFlag = "", "" }()
+
+	if err := editAction(); err != nil {
+		t.Fatalf("Couldn't edit OpenPGP message: %s", err)
+	}
+	contents, _ := ioutil.ReadFile(filename)
+	if !bytes.HasPrefix(contents, pgpMessageArmor) {
+		t.Fatal("The edited file isn't an armored OpenPGP message anymore")
+	}
+
+	// it is still encrypted to each of the keys it was encrypted to
+	c := pgpTestCredentials(t, "test passphrase")
+	for _, key := range c.pgpKeys {
+		if key.secret == nil || !key.canEncrypt(time.Now()) {
+			continue
+		}
+		r, err := newDecryptReader(bytes.NewReader(contents), &credentials{pgpKeys: []*pgpKey{key}, passphrase: c.passphrase})
+		if err != nil {
+			t.Errorf("Couldn't decrypt with key %s: %s", formatPGPKeyID(key.keyID()), err)
+			continue
+		}
+		if decrypted, err := ioutil.ReadAll(r); err != nil || !bytes.Contains(decrypted, []byte("hunter3")) {
+			t.Errorf("Expected the edited message with key %s, but got %s, %v", formatPGPKeyID(key.keyID()), decrypted, err)
+		}
+	}
+}
+
+func TestEditActionShouldKeepStructuredHeader(t *testing.T) {
+	filename := "testdata/test_edit_keys.yml"
+	defer os.Remove(filename)
+	otherKey := []byte("abcdefghijklmnopqrstuvwxyz123456")
+	yml, _ := ioutil.ReadFile("testdata/secrets.yml")
+	h, key, _ := newEnvelopeHeader(&masterKeys{keys: [][]byte{testKey, otherKey}})
+	encrypted, _ := encryptStructured("yaml", h, key, yml)
+	ioutil.WriteFile(filename, encrypted, 0644)
+	editFilenameArg = filename
+	decryptStructuredFlag = true
+	defer func() { decryptStructuredFlag, encryptStructuredFlag = false, false }()
+
+	// the values are sealed with random nonces, so the header can stay
+	if err := runEditAction("sed -i s/sk_test_abc/sk_test_xyz/"); err != nil {
+		t.Fatalf("Couldn't edit file: %s", err)
+	}
+	contents, _ := ioutil.ReadFile(filename)
+	for _, key := range [][]byte{testKey, otherKey} {
+		decrypted, err := decryptStructured("yaml", contents, &credentials{key: key})
+		if err != nil || !bytes.Contains(decrypted, []byte("sk_test_xyz")) {
+			t.Errorf("Couldn't decrypt the edited file with key %s: %v", key, err)
+		}
+	}
+}
+
+func TestEditActionShouldKeepMode(t *testing.T) {
+	filename := "testdata/test_edit_mode"
+	defer os.Remove(filename)
+	encrypted, _ := encrypt(testKey, []byte("This is a test file"))
+	ioutil.WriteFile(filename, encrypted, 0640)
+	os.Chmod(filename, 0640)
+	editFilenameArg = filename
+
+	if err := runEditAction("sed -i s/test/edited/"); err != nil {
+		t.Fatalf("Couldn't edit file: %s", err)
+	}
+	if fi, _ := os.Stat(filename); fi.Mode().Perm() != 0640 {
+		t.Errorf("Edited file has permissions %s, but expected -rw-r-----", fi.Mode().Perm())
+	}
+
+	// a new file is only readable by the user
+	os.Remove(filename)
+	if err := runEditAction("cp testdata/plain"); err != nil {
+		t.Fatalf("Couldn't create file: %s", err)
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Created file has permissions %v, but expected -rw-------", fi)
+	}
+}
+
+func TestEditActionShouldNotSaveWhenEditorFails(t *testing.T) {
+	filename := "testdata/test_edit_fails"
+	defer os.Remove(filename)
+	encrypted, _ := encrypt(testKey, []byte("This is a test file"))
+	ioutil.WriteFile(filename, encrypted, 0644)
+	editFilenameArg = filename
+
+	if err := runEditAction("false"); err == nil {
+		t.Error("Expected an error, but didn't recive one")
+	}
+
+	contents, _ := ioutil.ReadFile(filename)
+	if !bytes.Equal(contents, encrypted) {
+		t.Error("File was changed even though the editor failed")
+	}
+}
+
+func TestEditActionShouldNotSaveWithoutChanges(t *testing.T) {
+	filename := "testdata/test_edit_unchanged"
+	defer os.Remove(filename)
+	encrypted, _ := encrypt(testKey, []byte("This is a test file"))
+	ioutil.WriteFile(filename, encrypted, 0644)
+	editFilenameArg = filename
+
+	if err := runEditAction("true"); err != nil {
+		t.Fatalf("Couldn't edit file: %s", err)
+	}
+
+	contents, _ := ioutil.ReadFile(filename)
+	if !bytes.Equal(contents, encrypted) {
+		t.Error("File was re-encrypted without any changes")
+	}
+}
+
+func TestRunEditorShredsTempFile(t *testing.T) {
+	// the editor records the name of the temp file it was given
+	script := "testdata/test_edit_editor.sh"
+	seen := "testdata/test_edit_seen"
+	ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" > "+seen+"\n"), 0755)
+	defer os.Remove(script)
+	defer os.Remove(seen)
+
+	oldEditor := os.Getenv("EDITOR")
+	os.Setenv("EDITOR", script)
+	defer os.Setenv("EDITOR", oldEditor)
+
+	if _, err := runEditor([]byte("secret"), ".yml"); err != nil {
+		t.Fatalf("Couldn't run editor: %s", err)
+	}
+
+	name, _ := ioutil.ReadFile(seen)
+	tmpName := strings.TrimSpace(string(name))
+	if !strings.HasSuffix(tmpName, ".yml") {
+		t.Errorf("Temp file %s doesn't keep the extension", tmpName)
+	}
+	if _, err := os.Stat(tmpName); err == nil {
+		t.Errorf("Temp file %s was left behind", tmpName)
+	}
+}
+
+func TestExecAction(t *testing.T) {
+	filename := "testdata/test_exec.env.enc"
+	defer os.Remove(filename)
+	encrypted, _ := encrypt(testKey, []byte("GOSECRET_TEST_VALUE=hunter2\n"))
+	ioutil.WriteFile(filename, encrypted, 0644)
+
+	decryptKeyFlag = string(testKey)
+	decryptPassphraseFlag = ""
+	execFileFlag = filename
+	execBucketNameFlag = ""
+
+	execCommandArgs = []string{"sh", "-c", `test "$GOSECRET_TEST_VALUE" = hunter2`}
+	if err := execAction(); err != nil {
+		t.Errorf("Expected the secret in the environment, but got %s", err)
+	}
+
+	execCommandArgs = []string{"sh", "-c", "exit 3"}
+	err := execAction()
+	if exitErr, ok := err.(*exitError); !ok || exitErr.code != 3 {
+		t.Errorf("Expected exit status 3, but got %v", err)
+	}
+
+	execCommandArgs = []string{"sh", "-c", "kill -TERM $$"}
+	err = execAction()
+	if exitErr, ok := err.(*exitError); !ok || exitErr.code != 128+15 {
+		t.Errorf("Expected exit status 143, but got %v", err)
+	}
+}
+
+func TestExecActionShouldNotPassOnTerminalSignals(t *testing.T) {
+	filename := "testdata/test_exec_signals.env.enc"
+	trapped := "testdata/test_exec_signals"
+	defer os.Remove(filename)
+	defer os.Remove(trapped)
+	encrypted, _ := encrypt(testKey, []byte("GOSECRET_TEST_VALUE=hunter2\n"))
+	ioutil.WriteFile(filename, encrypted, 0644)
+
+	decryptKeyFlag = string(testKey)
+	decryptPassphraseFlag = ""
+	execFileFlag = filename
+	execBucketNameFlag = ""
+
+	// a terminal would have sent the SIGINT to the command itself
+	execCommandArgs = []string{"sh", "-c", `trap "echo INT >> ` + trapped + `" INT
+trap "echo TERM >> ` + trapped + `; exit 0" TERM
+kill -INT $PPID; sleep 0.2; kill -TERM $PPID
+sleep 5 & wait`}
+	if err := execAction(); err != nil {
+		t.Fatalf("Couldn't run the command: %s", err)
+	}
+	if contents, _ := ioutil.ReadFile(trapped); string(contents) != "TERM\n" {
+		t.Errorf("Got signals %q, but expected only TERM", contents)
+	}
+}
+
+func TestExecActionShouldRequireCommand(t *testing.T) {
+	execFileFlag = "testdata/secrets.env"
+	execCommandArgs = nil
+	if err := execAction(); err == nil {
+		t.Error("Expected an error, but didn't recive one")
+	}
+}
+
+func TestDecryptVersion3(t *testing.T) {
+	message := []byte("test message")
+
+	// version 3 streams are sealed with the key itself
+	h := &header{version: 3, algorithm: algAESGCM, kdf: kdfNone, chunkSize: defaultChunkSize, nonce: make([]byte, streamNonceSize)}
+	var b bytes.Buffer
+	w, _ := newStreamWriter(&b, h, testKey)
+	encrypted, _ := finishEncrypt(&b, w, message)
+
+	decrypted, err := decrypt(testKey, encrypted)
+	if err != nil {
+		t.Fatalf("Couldn't decrypt a version 3 file: %s", err)
+	}
+	if string(decrypted) != string(message) {
+		t.Error("Couldn't decrypt version 3 message correctly")
+	}
+}
+
+func TestDecryptVersion4(t *testing.T) {
+	message := []byte("test message")
+
+	// version 4 headers are the same without the creation time
+	h := &header{version: 4, algorithm: algAESGCM, chunkSize: defaultChunkSize, nonce: make([]byte, streamNonceSize)}
+	dataKey := bytes.Repeat([]byte{1}, dataKeySize)
+	h.addStanzas(dataKey, &masterKeys{keys: [][]byte{testKey}})
+	h.seal(dataKey)
+	var b bytes.Buffer
+	w, _ := newStreamWriter(&b, h, dataKey)
+	encrypted, _ := finishEncrypt(&b, w, message)
+
+	decrypted, err := decrypt(testKey, encrypted)
+	if err != nil || string(decrypted) != string(message) {
+		t.Errorf("Couldn't decrypt a version 4 file: %v", err)
+	}
+}
+
+func TestHeaderRecordsCreationTime(t *testing.T) {
+	encrypted, _ := encrypt(testKey, []byte("test message"))
+	h, _, err := parseHeader(encrypted)
+	if err != nil {
+		t.Fatalf("Couldn't parse header: %s", err)
+	}
+	if age := time.Now().Unix() - h.created; age < 0 || age > 60 {
+		t.Errorf("Header was created at %d, which isn't now", h.created)
+	}
+
+	// the creation time is authenticated
+	encrypted[len(formatMagic)+2+4+streamNonceSize] ^= 1
+	if _, err := decrypt(testKey, encrypted); err != errAuthFailed {
+		t.Errorf("Expected an authentication error, but got %v", err)
+	}
+}
+
+func TestEncryptWithSeveralMasterKeys(t *testing.T) {
+	otherKey := []byte("abcdefghijklmnopqrstuvwxyz123456")
+	encryptKeyFlag = string(testKey)
+	encryptPassphraseFlag = ""
+	encryptAddKeyFlag = stringsFlag{string(otherKey)}
+	defer func() { encryptAddKeyFlag = nil }()
+
+	h, key, err := encryptFlagHeader()
+	if err != nil {
+		t.Fatalf("Couldn't create header: %s", err)
+	}
+	var b bytes.Buffer
+	w, _ := newStreamWriter(&b, h, key)
+	encrypted, _ := finishEncrypt(&b, w, []byte("test message"))
+
+	for _, key := range [][]byte{testKey, otherKey} {
+		decrypted, err := decrypt(key, encrypted)
+		if err != nil || string(decrypted) != "test message" {
+			t.Errorf("Couldn't decrypt with key %s: %v", key, err)
+		}
+	}
+}
+
+func TestDecryptShouldFailWhenStanzaTampered(t *testing.T) {
+	encrypted, _ := encrypt(testKey, []byte("test message"))
+	h, body, _ := parseHeader(encrypted)
+
+	// wrap the same data key for a second key without updating the MAC
+	dataKey, _ := unlockKey(h, &credentials{key: testKey})
+	otherKey := []byte("abcdefghijklmnopqrstuvwxyz123456")
+	s, _ := newKeyStanza(h, otherKey, dataKey)
+	h.stanzas = append(h.stanzas, s)
+	tampered := append(h.marshal(), body...)
+
+	_, err := decrypt(otherKey, tampered)
+	if err != errAuthFailed {
+		t.Errorf("Expected an authentication error, but got %v", err)
+	}
+}
+
+func rewrapTestHeader(key []byte, newKeys [][]byte, keep bool) func(h *header) (*header, []byte, error) {
+	return func(h *header) (*header, []byte, error) {
+		dataKey, err := unlockKey(h, &credentials{key: key})
+		if err != nil {
+			return nil, nil, err
+		}
+		rewrapped, err := h.rewrap(dataKey, &masterKeys{keys: newKeys}, keep)
+		return rewrapped, dataKey, err
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	message := bytes.Repeat([]byte("a"), 2*defaultChunkSize+17)
+	newKey := []byte("abcdefghijklmnopqrstuvwxyz123456")
+	encrypted, _ := encrypt(testKey, message)
+
+	r, err := rewrap(bytes.NewReader(encrypted), rewrapTestHeader(testKey, [][]byte{newKey}, false))
+	if err != nil {
+		t.Fatalf("Couldn't rewrap: %s", err)
+	}
+	rewrapped, _ := ioutil.ReadAll(r)
+
+	_, body, _ := parseHeader(encrypted)
+	if !bytes.HasSuffix(rewrapped, body) {
+		t.Error("Rewrapping changed the encrypted contents")
+	}
+
+	decrypted, err := decrypt(newKey, rewrapped)
+	if err != nil || !bytes.Equal(decrypted, message) {
+		t.Errorf("Couldn't decrypt with the new key: %v", err)
+	}
+	if _, err := decrypt(testKey, rewrapped); !strings.Contains(fmt.Sprint(err), formatKeyID(keyID(newKey))) {
+		t.Errorf("Expected the old key to fail, but got %v", err)
+	}
+}
+
+func TestRewrapShouldFailWithWrongKey(t *testing.T) {
+	newKey := []byte("abcdefghijklmnopqrstuvwxyz123456")
+	encrypted, _ := encrypt(testKey, []byte("test message"))
+
+	_, err := rewrap(bytes.NewReader(encrypted), rewrapTestHeader(newKey, [][]byte{newKey}, false))
+	if _, ok := err.(*missingKeyError); !ok {
+		t.Errorf("Expected a missing key error, but got %v", err)
+	}
+}
+
+func TestRewrapAction(t *testing.T) {
+	filename := "testdata/test_rewrap_action"
+	defer os.Remove(filename)
+	newKey := "abcdefghijklmnopqrstuvwxyz123456"
+	encrypted, _ := encrypt(testKey, []byte("This is a test file"))
+	ioutil.WriteFile(filename, encrypted, 0600)
+
+	decryptKeyFlag = string(testKey)
+	decryptPassphraseFlag = ""
+	rewrapNewKeyFlag = stringsFlag{newKey}
+	rewrapAddFlag = true
+	rewrapFilenameArg = filename
+	defer func() { rewrapNewKeyFlag, rewrapAddFlag = nil, false }()
+
+	if err := rewrapAction(); err != nil {
+		t.Fatalf("Couldn't rewrap file: %s", err)
+	}
+
+	contents, _ := ioutil.ReadFile(filename)
+	for _, key := range []string{string(testKey), newKey} {
+		decrypted, err := decrypt([]byte(key), contents)
+		if err != nil || string(decrypted) != "This is a test file" {
+			t.Errorf("Couldn't decrypt with key %s: %v", key, err)
+		}
+	}
+	if fi, _ := os.Stat(filename); fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the file mode to be kept, but got %s", fi.Mode())
+	}
+}
+
+func TestRewrapActionShouldRequireNewKey(t *testing.T) {
+	rewrapFilenameArg = "testdata/encrypted"
+	rewrapNewKeyFlag = nil
+	rewrapNewPassphraseFlag = ""
+	if err := rewrapAction(); err == nil {
+		t.Error("Expected an error, but didn't recive one")
+	}
+}
+
+func TestEncryptDecryptWithRecipient(t *testing.T) {
+	identity, _ := newX25519Identity()
+	other, _ := newX25519Identity()
+
+	encryptKeyFlag = ""
+	encryptPassphraseFlag = ""
+	encryptRecipientFlag = stringsFlag{identity.recipient().String()}
+	defer func() { encryptRecipientFlag = nil }()
+
+	h, key, err := encryptFlagHeader()
+	if err != nil {
+		t.Fatalf("Couldn't create header: %s", err)
+	}
+	if len(h.stanzas) != 1 || h.stanzas[0].kind != stanzaX25519 {
+		t.Fatalf("Expected a single recipient stanza, but got %d stanzas", len(h.stanzas))
+	}
+	var b bytes.Buffer
+	w, _ := newStreamWriter(&b, h, key)
+	encrypted, _ := finishEncrypt(&b, w, []byte("test message"))
+
+	r, err := newDecryptReader(bytes.NewReader(encrypted), &credentials{identities: []*x25519Identity{other, identity}})
+	if err != nil {
+		t.Fatalf("Couldn't decrypt with the identity: %s", err)
+	}
+	decrypted, _ := ioutil.ReadAll(r)
+	if string(decrypted) != "test message" {
+		t.Error("Couldn't decrypt message for a recipient correctly")
+	}
+
+	if _, err := newDecryptReader(bytes.NewReader(encrypted), &credentials{identities: []*x25519Identity{other}}); err != errAuthFailed {
+		t.Errorf("Expected an authentication error, but got %v", err)
+	}
+	_, err = newDecryptReader(bytes.NewReader(encrypted), &credentials{key: testKey})
+	if err == nil || !strings.Contains(err.Error(), "--identity") {
+		t.Errorf("Expected an error asking for an identity, but got %v", err)
+	}
+}
+
+func TestParseX25519Recipient(t *testing.T) {
+	identity, _ := newX25519Identity()
+	encoded := identity.recipient().String()
+
+	recipient, err := parseX25519Recipient(strings.ToUpper(encoded))
+	if err != nil {
+		t.Fatalf("Couldn't parse recipient: %s", err)
+	}
+	if recipient.String() != encoded {
+		t.Errorf("Expected %s but got %s", encoded, recipient)
+	}
+
+	// change one character of the key
+	typo := []byte(encoded)
+	if typo[len(recipientPrefix)] == 'a' {
+		typo[len(recipientPrefix)] = 'b'
+	} else {
+		typo[len(recipientPrefix)] = 'a'
+	}
+	if _, err := parseX25519Recipient(string(typo)); err == nil {
+		t.Error("Expected an error for a mistyped recipient, but didn't recive one")
+	}
+	if _, err := parseX25519Recipient(identity.String()); err == nil {
+		t.Error("Expected an error for an identity, but didn't recive one")
+	}
+}
+
+func TestKeygenAction(t *testing.T) {
+	filename := "testdata/test_keygen_identity"
+	defer os.Remove(filename)
+	keygenOutFilenameArg = filename
+
+	if err := keygenAction(); err != nil {
+		t.Fatalf("Couldn't generate identity: %s", err)
+	}
+	if fi, _ := os.Stat(filename); fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the identity file to be private, but got %s", fi.Mode())
+	}
+
+	contents, _ := ioutil.ReadFile(filename)
+	identities, err := parseX25519Identities(contents)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("Couldn't read the identity file: %v", err)
+	}
+	if !strings.Contains(string(contents), "# recipient: "+identities[0].recipient().String()) {
+		t.Error("Expected the identity file to name its recipient")
+	}
+
+	if err := keygenAction(); err == nil {
+		t.Error("Expected an error overwriting an identity, but didn't recive one")
+	}
+}
+
+func TestDecryptActionWithIdentity(t *testing.T) {
+	identityFile := "testdata/test_decrypt_identity"
+	encfile := "testdata/test_decrypt_identity.enc"
+	decfile := "testdata/test_decrypt_identity_out"
+	defer os.Remove(identityFile)
+	defer os.Remove(encfile)
+	defer os.Remove(decfile)
+
+	identity, _ := newX25519Identity()
+	ioutil.WriteFile(identityFile, []byte("# test\n"+identity.String()+"\n"), 0600)
+
+	h, key, _ := newEnvelopeHeader(&masterKeys{recipients: []*x25519Recipient{identity.recipient()}})
+	var b bytes.Buffer
+	w, _ := newStreamWriter(&b, h, key)
+	encrypted, _ := finishEncrypt(&b, w, []byte("This is a test file"))
+	ioutil.WriteFile(encfile, encrypted, 0644)
+
+	decryptKeyFlag = ""
+	decryptIdentityFlag = identityFile
+	decryptInFilenameArg = encfile
+	decryptOutFilenameArg = decfile
+	defer func() { decryptIdentityFlag = "" }()
+
+	if err := decryptAction(); err != nil {
+		t.Fatalf("Couldn't decrypt with an identity file: %s", err)
+	}
+	contents, _ := ioutil.ReadFile(decfile)
+	if string(contents) != "This is a test file" {
+		t.Errorf("Expected This is a test file but got %s", contents)
+	}
+}
+
+// ageVector is a test vector from testdata/age, taken from the age test
+// suite at https://c2sp.org/CCTV/age.
+type ageVector struct {
+	expect     string
+	payload    string
+	identities string
+	passphrase string
+	armored    bool
+	compressed bool
+	file       []byte
+}
+
+func readAgeVector(t *testing.T, filename string) *ageVector {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %s", filename, err)
+	}
+
+	v := &ageVector{}
+	for {
+		i := bytes.IndexByte(contents, '\n')
+		line := string(contents[:i])
+		contents = contents[i+1:]
+		if line == "" {
+			break
+		}
+
+		parts := strings.SplitN(line, ": ", 2)
+		switch parts[0] {
+		case "expect":
+			v.expect = parts[1]
+		case "payload":
+			v.payload = parts[1]
+		case "identity":
+			v.identities += parts[1] + "\n"
+		case "passphrase":
+			v.passphrase = parts[1]
+		case "armored":
+			v.armored = parts[1] == "yes"
+		case "compressed":
+			v.compressed = true
+		}
+	}
+
+	v.file = contents
+	if v.compressed {
+		r, err := zlib.NewReader(bytes.NewReader(contents))
+		if err != nil {
+			t.Fatalf("Couldn't decompress %s: %s", filename, err)
+		}
+		if v.file, err = ioutil.ReadAll(r); err != nil {
+			t.Fatalf("Couldn't decompress %s: %s", filename, err)
+		}
+	}
+	return v
+}
+
+func TestAgeVectors(t *testing.T) {
+	filenames, _ := filepath.Glob("testdata/age/*")
+	if len(filenames) == 0 {
+		t.Fatal("No age test vectors found")
+	}
+
+	for _, filename := range filenames {
+		v := readAgeVector(t, filename)
+		name := filepath.Base(filename)
+
+		// armor and the post-quantum recipients aren't supported
+		if v.armored || strings.Contains(v.identities, "AGE-SECRET-KEY-PQ-") {
+			continue
+		}
+
+		c := &credentials{passphrase: []byte(v.passphrase)}
+		if v.identities != "" {
+			var err error
+			if c.identities, err = parseX25519Identities([]byte(v.identities)); err != nil {
+				t.Errorf("%s: couldn't parse identities: %s", name, err)
+				continue
+			}
+		}
+
+		// anything with a valid header has to encode back to the same bytes
+		if v.expect != "header failure" {
+			h, err := readAgeHeader(bufio.NewReader(bytes.NewReader(v.file)))
+			if err != nil {
+				t.Errorf("%s: couldn't parse header: %s", name, err)
+			} else if !bytes.HasPrefix(v.file, h.marshal()) {
+				t.Errorf("%s: header didn't encode to the same bytes", name)
+			}
+		}
+
+		r, err := newDecryptReader(bytes.NewReader(v.file), c)
+		var decrypted []byte
+		if err == nil {
+			decrypted, err = ioutil.ReadAll(r)
+		}
+		sum := sha256.Sum256(decrypted)
+
+		switch v.expect {
+		case "success":
+			if err != nil {
+				t.Errorf("%s: expected success, but got %s", name, err)
+			} else if hex.EncodeToString(sum[:]) != v.payload {
+				t.Errorf("%s: decrypted the wrong payload", name)
+			}
+		case "payload failure":
+			if err == nil || r == nil {
+				t.Errorf("%s: expected a payload failure, but got %v", name, err)
+			} else if hex.EncodeToString(sum[:]) != v.payload {
+				t.Errorf("%s: released the wrong part of the payload", name)
+			}
+		case "HMAC failure":
+			if err != errAuthFailed || r != nil {
+				t.Errorf("%s: expected the header MAC to fail, but got %v", name, err)
+			}
+		case "no match":
+			if err == nil || err == errAuthFailed || r != nil {
+				t.Errorf("%s: expected no match, but got %v", name, err)
+			}
+		case "header failure":
+			if err == nil || r != nil {
+				t.Errorf("%s: expected a header failure, but got %v", name, err)
+			}
+		default:
+			t.Errorf("%s: unknown expectation %s", name, v.expect)
+		}
+	}
+}
+
+func TestEncryptDecryptAge(t *testing.T) {
+	identity, _ := newX25519Identity()
+	ageRecipient, _ := bech32Encode(ageRecipientHRP, identity.recipient().key.Bytes())
+
+	encryptKeyFlag = ""
+	encryptPassphraseFlag = ""
+	encryptFormatFlag = ageFormat
+	encryptRecipientFlag = stringsFlag{ageRecipient}
+	defer func() {
+		encryptFormatFlag = ""
+		encryptRecipientFlag = nil
+	}()
+
+	// a payload that fills the last chunk exactly
+	for _, message := range [][]byte{[]byte("test message"), {}, bytes.Repeat([]byte("a"), 2*ageChunkSize)} {
+		var b bytes.Buffer
+		w, err := encryptFlagWriter(&b)
+		if err != nil {
+			t.Fatalf("Couldn't create writer: %s", err)
+		}
+		encrypted, _ := finishEncrypt(&b, w, message)
+		if !bytes.HasPrefix(encrypted, []byte(ageVersionLine+"\n-> X25519 ")) {
+			t.Fatal("Expected an age file for the recipient")
+		}
+
+		r, err := newDecryptReader(bytes.NewReader(encrypted), &credentials{identities: []*x25519Identity{identity}})
+		if err != nil {
+			t.Fatalf("Couldn't decrypt age file: %s", err)
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decrypted, message) {
+			t.Errorf("Couldn't decrypt a %d byte age file correctly: %v", len(message), err)
+		}
+	}
+}
+
+func TestEncryptDecryptAgeWithPassphrase(t *testing.T) {
+	encryptKeyFlag = ""
+	encryptPassphraseFlag = "test passphrase"
+	encryptScryptLogNFlag, encryptScryptRFlag, encryptScryptPFlag = minScryptLogN, defaultScryptR, defaultScryptP
+	encryptFormatFlag = ageFormat
+	defer func() {
+		encryptPassphraseFlag = ""
+		encryptFormatFlag = ""
+	}()
+
+	var b bytes.Buffer
+	w, err := encryptFlagWriter(&b)
+	if err != nil {
+		t.Fatalf("Couldn't create writer: %s", err)
+	}
+	encrypted, _ := finishEncrypt(&b, w, []byte("test message"))
+
+	decrypted, err := decryptWithPassphrase([]byte("test passphrase"), encrypted)
+	if err != nil || string(decrypted) != "test message" {
+		t.Errorf("Couldn't decrypt age file with passphrase: %v", err)
+	}
+	if _, err := decryptWithPassphrase([]byte("wrong passphrase"), encrypted); err != errAgeNoMatch {
+		t.Errorf("Expected no match, but got %v", err)
+	}
+
+	// a passphrase can't be mixed with recipients
+	identity, _ := newX25519Identity()
+	encryptRecipientFlag = stringsFlag{identity.recipient().String()}
+	defer func() { encryptRecipientFlag = nil }()
+	if _, err := encryptFlagWriter(&b); err == nil {
+		t.Error("Expected an error, but didn't recive one")
+	}
+}
+
+func TestParseAgeKeys(t *testing.T) {
+	identity, _ := newX25519Identity()
+	secret, _ := bech32Encode(ageIdentityHRP, identity.key.Bytes())
+	public, _ := bech32Encode(ageRecipientHRP, identity.recipient().key.Bytes())
+
+	identities, err := parseX25519Identities([]byte("# public key: " + public + "\n" + strings.ToUpper(secret) + "\n"))
+	if err != nil {
+		t.Fatalf("Couldn't parse age identity: %s", err)
+	}
+	recipient, err := parseX25519Recipient(public)
+	if err != nil {
+		t.Fatalf("Couldn't parse age recipient: %s", err)
+	}
+	if !bytes.Equal(identities[0].recipient().id(), recipient.id()) {
+		t.Error("age identity and recipient don't match")
+	}
+
+	// change the last character of the checksum to another one
+	last := "q"
+	if strings.HasSuffix(public, last) {
+		last = "p"
+	}
+	if _, err := parseX25519Recipient(public[:len(public)-1] + last); err == nil {
+		t.Error("Expected an error for a bad checksum, but didn't recive one")
+	}
+}
+
+// pgpTestCredentials returns credentials with the keys of the test keyring,
+// which are protected with the passphrase "test passphrase".
+func pgpTestCredentials(t *testing.T, passphrase string) *credentials {
+	contents, _ := ioutil.ReadFile("testdata/pgp/secring.asc")
+	certs, err := readPGPKeyring(contents)
+	if err != nil {
+		t.Fatalf("Couldn't read keyring: %s", err)
+	}
+	c := &credentials{passphrase: []byte(passphrase)}
+	for _, cert := range certs {
+		c.pgpKeys = append(append(c.pgpKeys, cert.primary), cert.subkeys...)
+	}
+	return c
+}
+
+func TestDecryptPGP(t *testing.T) {
+	plain, _ := ioutil.ReadFile("testdata/pgp/plain")
+
+	// messages from gpg to RSA, Curve25519, ElGamal and P-256 keys, all of
+	// them armored, and a passphrase
+	for _, name := range []string{"rsa.gpg", "cv.gpg", "elg.gpg", "p256.gpg", "all.asc", "symmetric.gpg"} {
+		contents, _ := ioutil.ReadFile(filepath.Join("testdata/pgp", name))
+		r, err := newDecryptReader(bytes.NewReader(contents), pgpTestCredentials(t, "test passphrase"))
+		if err != nil {
+			t.Errorf("%s: couldn't decrypt: %s", name, err)
+			continue
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decrypted, plain) {
+			t.Errorf("%s: decrypted incorrectly: %v", name, err)
+		}
+	}
+}
+
+func TestDecryptPGPShouldFail(t *testing.T) {
+	rsa, _ := ioutil.ReadFile("testdata/pgp/rsa.gpg")
+	symmetric, _ := ioutil.ReadFile("testdata/pgp/symmetric.gpg")
+
+	tests := []struct {
+		contents []byte
+		c        *credentials
+		message  string
+	}{
+		{rsa, &credentials{passphrase: []byte("test passphrase")}, "please provide a secret keyring"},
+		{rsa, pgpTestCredentials(t, ""), "is protected"},
+		{rsa, pgpTestCredentials(t, "wrong passphrase"), "is wrong"},
+		{symmetric, &credentials{}, "please provide a passphrase"},
+		{symmetric, &credentials{passphrase: []byte("wrong passphrase")}, errAuthFailed.Error()},
+	}
+	for _, test := range tests {
+		_, err := newDecryptReader(bytes.NewReader(test.contents), test.c)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("Expected an error containing %q, but got %v", test.message, err)
+		}
+	}
+
+	// the modification detection code catches changes to the data
+	tampered := append([]byte{}, symmetric...)
+	tampered[len(tampered)-30] ^= 1
+	r, err := newDecryptReader(bytes.NewReader(tampered), &credentials{passphrase: []byte("test passphrase")})
+	if err == nil {
+		_, err = ioutil.ReadAll(r)
+	}
+	if err == nil {
+		t.Error("Expected an error for a tampered message, but didn't recive one")
+	}
+}
+
+func TestEncryptDecryptPGP(t *testing.T) {
+	encryptKeyFlag = ""
+	encryptPassphraseFlag = "test passphrase"
+	encryptFormatFlag = pgpFormat
+	encryptPGPKeyringFlag = "testdata/pgp/pubring.asc"
+	defer func() {
+		encryptPassphraseFlag = ""
+		encryptFormatFlag = ""
+		encryptPGPKeyringFlag = ""
+	}()
+
+	// messages that fit in one part and span several
+	for _, message := range [][]byte{[]byte("test message"), {}, bytes.Repeat([]byte("a"), 3*pgpPartialSize+1)} {
+		var b bytes.Buffer
+		w, err := encryptFlagWriter(&b)
+		if err != nil {
+			t.Fatalf("Couldn't create writer: %s", err)
+		}
+		encrypted, _ := finishEncrypt(&b, w, message)
+
+		// each of the keys can decrypt it, and so can the passphrase
+		c := pgpTestCredentials(t, "test passphrase")
+		for _, key := range c.pgpKeys {
+			if key.secret == nil {
+				continue
+			}
+			r, err := newDecryptReader(bytes.NewReader(encrypted), &credentials{pgpKeys: []*pgpKey{key}, passphrase: c.passphrase})
+			if err != nil && key.canEncrypt(time.Now()) {
+				t.Errorf("Couldn't decrypt with key %s: %s", formatPGPKeyID(key.keyID()), err)
+				continue
+			}
+			if err == nil {
+				decrypted, err := ioutil.ReadAll(r)
+				if err != nil || !bytes.Equal(decrypted, message) {
+					t.Errorf("Couldn't decrypt a %d byte message correctly: %v", len(message), err)
+				}
+			}
+		}
+
+		decrypted, err := decryptWithPassphrase([]byte("test passphrase"), encrypted)
+		if err != nil || !bytes.Equal(decrypted, message) {
+			t.Errorf("Couldn't decrypt a %d byte message with passphrase: %v", len(message), err)
+		}
+	}
+
+	// there's nothing to encrypt to without a keyring or passphrase
+	encryptPassphraseFlag, encryptPGPKeyringFlag = "", ""
+	var b bytes.Buffer
+	if _, err := encryptFlagWriter(&b); err == nil {
+		t.Error("Expected an error, but didn't recive one")
+	}
+}
+
+func TestPGPEncryptionKeys(t *testing.T) {
+	contents, _ := ioutil.ReadFile("testdata/pgp/pubring.asc")
+	certs, err := readPGPKeyring(contents)
+	if err != nil {
+		t.Fatalf("Couldn't read keyring: %s", err)
+	}
+
+	// each certificate has a signing primary key and an encryption subkey
+	expected := []string{"C303E454F2970E25", "EB36A0AEA8EE9A8D", "D7DFB6B380D5CE1C", "04C6F3E41116B4DD"}
+	if len(certs) != len(expected) {
+		t.Fatalf("Expected %d certificates, but got %d", len(expected), len(certs))
+	}
+	for i, cert := range certs {
+		key := cert.encryptionKey(time.Now())
+		if key == nil || formatPGPKeyID(key.keyID()) != expected[i] {
+			t.Errorf("Expected encryption key %s, but got %v", expected[i], key)
+		}
+	}
+
+	// a revoked subkey can't be used
+	certs[0].subkeys[0].revoked = true
+	if key := certs[0].encryptionKey(time.Now()); key != nil {
+		t.Errorf("Expected no encryption key, but got %s", formatPGPKeyID(key.keyID()))
+	}
+}
+
+func TestPGPEncryptionKeysShouldIgnoreForgedSubkeys(t *testing.T) {
+	// the RSA certificate with a newer encryption subkey added by someone
+	// else, whose binding signature claims to be from the primary key
+	contents, _ := ioutil.ReadFile("testdata/pgp/forged.gpg")
+	certs, err := readPGPKeyring(contents)
+	if err != nil {
+		t.Fatalf("Couldn't read keyring: %s", err)
+	}
+	if len(certs) != 1 || len(certs[0].subkeys) != 2 {
+		t.Fatalf("Expected a certificate with 2 subkeys, but got %d certificates", len(certs))
+	}
+
+	key := certs[0].encryptionKey(time.Now())
+	if key == nil || formatPGPKeyID(key.keyID()) != "C303E454F2970E25" {
+		t.Errorf("Expected encryption key C303E454F2970E25, but got %v", key)
+	}
+	if forged := certs[0].subkeys[1]; forged.signed != 0 {
+		t.Error("The forged binding signature was accepted")
+	}
+}
+
+func TestAESKeyWrap(t *testing.T) {
+	// RFC 3394 section 4.1
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F")
+	plain, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF")
+	expected, _ := hex.DecodeString("1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5")
+
+	wrapped, _ := aesKeyWrap(kek, plain)
+	if !bytes.Equal(wrapped, expected) {
+		t.Errorf("Expected %x, but got %x", expected, wrapped)
+	}
+	unwrapped, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil || !bytes.Equal(unwrapped, plain) {
+		t.Errorf("Couldn't unwrap key: %v", err)
+	}
+	wrapped[0] ^= 1
+	if _, err := aesKeyUnwrap(kek, wrapped); err != errAuthFailed {
+		t.Errorf("Expected an authentication failure, but got %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	newKey := []byte("4321432143214321")
+	plain, _ := ioutil.ReadFile("testdata/plain")
+	dir, _ := ioutil.TempDir("", "gosecret-rotate")
+	defer os.RemoveAll(dir)
+
+	// a whole file and a structured file under the old key, one already
+	// rotated, one under another key and one that isn't encrypted
+	encrypted, _ := encrypt(testKey, plain)
+	rotated, _ := encrypt(newKey, plain)
+	other, _ := encrypt([]byte("5678567856785678"), plain)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "plain.enc"), encrypted, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "secrets.yml"), encryptTestYAML(t), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "rotated.enc"), rotated, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "other.enc"), other, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README"), plain, 0644)
+
+	// a dry run doesn't change anything
+	var out bytes.Buffer
+	r := &rotation{oldKey: testKey, newKey: newKey, dryRun: true}
+	summary, err := r.run(&localRotateStore{dir: dir}, &out)
+	if err != nil {
+		t.Fatalf("Couldn't rotate: %s", err)
+	}
+	if summary.rotated != 2 || summary.skipped != 1 || summary.ignored != 1 || summary.failed != 1 {
+		t.Errorf("Unexpected dry run summary: %s", summary)
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "plain.enc")); !bytes.Equal(contents, encrypted) {
+		t.Error("Dry run changed a file")
+	}
+
+	r.dryRun = false
+	if summary, _ = r.run(&localRotateStore{dir: dir}, &out); summary.rotated != 2 || summary.failed != 1 {
+		t.Errorf("Unexpected summary: %s", summary)
+	}
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "plain.enc"))
+	if decrypted, err := decrypt(newKey, contents); err != nil || !bytes.Equal(decrypted, plain) {
+		t.Errorf("Rotated file doesn't decrypt with the new key: %v", err)
+	}
+	if _, err := decrypt(testKey, contents); err == nil {
+		t.Error("Rotated file still decrypts with the old key")
+	}
+	if fi, _ := os.Stat(filepath.Join(dir, "plain.enc")); fi.Mode().Perm() != 0600 {
+		t.Errorf("Rotated file has permissions %s, but expected -rw-------", fi.Mode().Perm())
+	}
+
+	yml, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "secrets.yml"))
+	expected, _ := ioutil.ReadFile("testdata/secrets.yml")
+	if decrypted, err := decryptStructured("yaml", yml, &credentials{key: newKey}); err != nil || !bytes.Equal(decrypted, expected) {
+		t.Errorf("Rotated structured file doesn't decrypt with the new key: %v", err)
+	}
+
+	// running again picks up where it left off
+	if summary, _ = r.run(&localRotateStore{dir: dir}, &out); summary.rotated != 0 || summary.skipped != 3 {
+		t.Errorf("Expected everything to be rotated already, but got %s", summary)
+	}
+}
+
+func TestRotateShouldNotReplaceTamperedFiles(t *testing.T) {
+	newKey := []byte("4321432143214321")
+	plain := bytes.Repeat([]byte("a"), 3*defaultChunkSize)
+	dir, _ := ioutil.TempDir("", "gosecret-rotate")
+	defer os.RemoveAll(dir)
+
+	// files streamed through whole, or with only their stanza swapped, are
+	// checked as they are written
+	single, _ := encrypt(testKey, plain)
+	h, key, _ := newEnvelopeHeader(&masterKeys{keys: [][]byte{testKey, []byte("abcdefghijklmnopqrstuvwxyz123456")}})
+	var b bytes.Buffer
+	w, _ := newStreamWriter(&b, h, key)
+	shared, _ := finishEncrypt(&b, w, plain)
+	for _, encrypted := range [][]byte{single, shared} {
+		encrypted[len(encrypted)-1] ^= 1
+	}
+	ioutil.WriteFile(filepath.Join(dir, "single.enc"), single, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "shared.enc"), shared, 0600)
+
+	var out bytes.Buffer
+	r := &rotation{oldKey: testKey, newKey: newKey}
+	if summary, _ := r.run(&localRotateStore{dir: dir}, &out); summary.failed != 2 {
+		t.Errorf("Expected both files to fail, but got %s", summary)
+	}
+	for name, encrypted := range map[string][]byte{"single.enc": single, "shared.enc": shared} {
+		if contents, _ := ioutil.ReadFile(filepath.Join(dir, name)); !bytes.Equal(contents, encrypted) {
+			t.Errorf("%s was replaced though it doesn't decrypt", name)
+		}
+	}
+}
+
+// rotateTestContents rotates a file in format, streaming it if format is
+// empty.
+func rotateTestContents(format string, contents []byte, oldKey, newKey []byte) ([]byte, error) {
+	if format != "" {
+		return rotateContents(format, contents, oldKey, newKey)
+	}
+	h, rest, err := parseHeader(contents)
+	if err != nil {
+		return nil, err
+	}
+	r, err := rotateStream(h, contents[:len(contents)-len(rest)], bytes.NewReader(rest), oldKey, newKey)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestRotateShouldKeepOtherStanzas(t *testing.T) {
+	newKey := []byte("4321432143214321")
+	otherKey := []byte("abcdefghijklmnopqrstuvwxyz123456")
+	identity, _ := newX25519Identity()
+	plain, _ := ioutil.ReadFile("testdata/plain")
+	yml, _ := ioutil.ReadFile("testdata/secrets.yml")
+	m := &masterKeys{keys: [][]byte{testKey, otherKey}, recipients: []*x25519Recipient{identity.recipient()}}
+
+	// a whole file and a structured file that another key and a recipient
+	// can decrypt too
+	h, key, _ := newEnvelopeHeader(m)
+	var b bytes.Buffer
+	w, _ := newStreamWriter(&b, h, key)
+	encrypted, _ := finishEncrypt(&b, w, plain)
+	h, key, _ = newEnvelopeHeader(m)
+	structured, _ := encryptStructured("yaml", h, key, yml)
+
+	for _, test := range []struct {
+		format    string
+		contents  []byte
+		plaintext []byte
+	}{{"", encrypted, plain}, {"yaml", structured, yml}} {
+		rotated, err := rotateTestContents(test.format, test.contents, testKey, newKey)
+		if err != nil {
+			t.Fatalf("%q: couldn't rotate: %s", test.format, err)
+		}
+		if !rotatedTo(test.format, rotated, testKey, newKey) {
+			t.Errorf("%q: rotated file isn't under the new key alone", test.format)
+		}
+
+		decryptRotated := func(c *credentials) ([]byte, error) {
+			if test.format != "" {
+				return decryptStructured(test.format, rotated, c)
+			}
+			r, err := newDecryptReader(bytes.NewReader(rotated), c)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		}
+		for _, c := range []*credentials{{key: newKey}, {key: otherKey}, {identities: []*x25519Identity{identity}}} {
+			if decrypted, err := decryptRotated(c); err != nil || !bytes.Equal(decrypted, test.plaintext) {
+				t.Errorf("%q: rotated file doesn't decrypt with the other stanzas: %v", test.format, err)
+			}
+		}
+		if _, err := decryptRotated(&credentials{key: testKey}); err == nil {
+			t.Errorf("%q: rotated file still decrypts with the old key", test.format)
+		}
+	}
+}
+
+func TestRotateActionShouldRequireDifferentKeys(t *testing.T) {
+	rotatePathArg = "testdata"
+	rotateOldKeyFlag = string(testKey)
+	rotateNewKeyFlag = string(testKey)
+	defer func() { rotateOldKeyFlag, rotateNewKeyFlag = "", "" }()
+
+	if err := rotateAction(); err == nil {
+		t.Error("Expected an error, but didn't recive one")
+	}
+}
+
+func TestDecryptWithKeyring(t *testing.T) {
+	encrypted, _ := encrypt(testKey, []byte("test message"))
+
+	keyring, err := parseKeyring([]byte("# team keys\nold = 4321432143214321\ncurrent=" + string(testKey) + "\n"))
+	if err != nil {
+		t.Fatalf("Couldn't parse keyring: %s", err)
+	}
+	if len(keyring) != 2 || keyring[1].name != "current" {
+		t.Fatalf("Keyring wasn't parsed correctly")
+	}
+
+	r, err := newDecryptReader(bytes.NewReader(encrypted), &credentials{keyring: keyring})
+	if err != nil {
+		t.Fatalf("Couldn't decrypt with keyring: %s", err)
+	}
+	if decrypted, _ := ioutil.ReadAll(r); string(decrypted) != "test message" {
+		t.Error("Decrypted message doesn't match the original")
+	}
+
+	_, err = newDecryptReader(bytes.NewReader(encrypted), &credentials{keyring: keyring[:1]})
+	if missing, ok := err.(*missingKeyError); !ok || !bytes.Equal(missing.ids[0], keyID(testKey)) {
+		t.Errorf("Expected a missing key error, but got %v", err)
+	}
+
+	// legacy files don't say which key to use
+	if _, err := newDecryptReader(bytes.NewReader(make([]byte, 32)), &credentials{keyring: keyring}); err == nil {
+		t.Error("Expected an error, but didn't recive one")
+	}
+}
+
+func TestParseKeyringShouldFail(t *testing.T) {
+	for _, contents := range []string{"", "# nothing\n", "no pair", "=1234123412341234", "a=short", "a=1234123412341234\na=4321432143214321"} {
+		if _, err := parseKeyring([]byte(contents)); err == nil {
+			t.Errorf("Expected an error for %q, but didn't recive one", contents)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	// the plaintext size is exact for files that aren't truncated, even
+	// when they end on a chunk boundary
+	identity, _ := newX25519Identity()
+	encryptRecipientFlag = stringsFlag{identity.recipient().String()}
+	encryptFormatFlag = ageFormat
+	defer func() {
+		encryptRecipientFlag = nil
+		encryptFormatFlag = ""
+	}()
+	for _, size := range []int{0, 12, defaultChunkSize, 3*defaultChunkSize + 1} {
+		plain := make([]byte, size)
+		encrypted, _ := encrypt(testKey, plain)
+		info, err := inspect("plain.enc", encrypted, int64(len(encrypted)))
+		if err != nil {
+			t.Fatalf("Couldn't inspect: %s", err)
+		}
+		if info.Format != "gosecret" || info.Version != formatVersion || !info.Authenticated || *info.Plaintext != int64(size) {
+			t.Errorf("Unexpected metadata for %d bytes: %+v", size, info)
+		}
+		if len(info.Keys) != 1 || info.Keys[0].ID != formatKeyID(keyID(testKey)) {
+			t.Errorf("Expected the ID of the key, but got %+v", info.Keys)
+		}
+		if created, _ := time.Parse(time.RFC3339, info.Created); time.Since(created) > time.Minute {
+			t.Errorf("Unexpected creation time %s", info.Created)
+		}
+
+		var b bytes.Buffer
+		w, _ := encryptFlagWriter(&b)
+		encrypted, _ = finishEncrypt(&b, w, plain)
+		info, err = inspect("plain.age", encrypted, int64(len(encrypted)))
+		if err != nil {
+			t.Fatalf("Couldn't inspect age file: %s", err)
+		}
+		if info.Format != "age" || *info.Plaintext != int64(size) || len(info.Keys) != 1 || info.Keys[0].Type != "x25519" {
+			t.Errorf("Unexpected metadata for %d bytes of age: %+v", size, info)
+		}
+	}
+
+	// passphrases, structured files and files in other formats
+	params, _ := newScryptParams(minScryptLogN, defaultScryptR, defaultScryptP)
+	withPassphrase, _ := encryptWithPassphrase([]byte("test passphrase"), params, []byte("test message"))
+	symmetric, _ := ioutil.ReadFile("testdata/pgp/symmetric.gpg")
+	armored, _ := ioutil.ReadFile("testdata/pgp/all.asc")
+	tests := []struct {
+		name     string
+		contents []byte
+		expected string
+	}{
+		{"plain.enc", withPassphrase, "passphrase:     scrypt logN=14 r=8 p=1\n"},
+		{"secrets.yml", encryptTestYAML(t), "structured:     yaml\n"},
+		{"symmetric.gpg", symmetric, "passphrase:     s2k iterated SHA-1 iterations=65011712\n"},
+		{"all.asc", armored, "recipient:      elgamal D7DFB6B380D5CE1C\n"},
+		{"plain", []byte("not encrypted at all"), "format:         legacy AES-CFB, unauthenticated\n"},
+	}
+	for _, test := range tests {
+		info, err := inspect(test.name, test.contents, int64(len(test.contents)))
+		if err != nil {
+			t.Errorf("Couldn't inspect %s: %s", test.name, err)
+		} else if !strings.Contains(info.String(), test.expected) {
+			t.Errorf("Expected %s to contain %q, but got:\n%s", test.name, test.expected, info)
+		}
+	}
+}
+
+func TestInspectVersion4(t *testing.T) {
+	h, key, _ := newKeyHeader(testKey)
+	h.version = 4
+	h.seal(key)
+	info, err := inspect("plain.enc", h.marshal(), int64(len(h.marshal())))
+	if err != nil {
+		t.Fatalf("Couldn't inspect: %s", err)
+	}
+	if info.Version != 4 || info.Created != "" || !strings.Contains(info.String(), "created:        not recorded\n") {
+		t.Errorf("Expected no creation time, but got %+v", info)
+	}
+}
+
+func TestInspectFileReadsHeaderOnly(t *testing.T) {
+	encrypted, _ := encrypt(testKey, make([]byte, 5*inspectHeaderSize))
+	var reads []int64
+	readPrefix := func(n int64) ([]byte, int64, error) {
+		reads = append(reads, n)
+		if n < 0 {
+			return encrypted, int64(len(encrypted)), nil
+		}
+		return encrypted[:n], int64(len(encrypted)), nil
+	}
+	info, err := inspectFile("plain.enc", readPrefix)
+	if err != nil {
+		t.Fatalf("Couldn't inspect: %s", err)
+	}
+	if len(reads) != 1 || reads[0] != inspectHeaderSize || *info.Plaintext != 5*inspectHeaderSize {
+		t.Errorf("Expected one read of the header, but got %v and %+v", reads, info)
+	}
+
+	// an armored message can't be decoded from a prefix, so it is read again
+	armored, _ := ioutil.ReadFile("testdata/pgp/all.asc")
+	reads = nil
+	readPrefix = func(n int64) ([]byte, int64, error) {
+		reads = append(reads, n)
+		if n < 0 {
+			return armored, int64(len(armored)), nil
+		}
+		return armored[:100], int64(len(armored)), nil
+	}
+	if info, err = inspectFile("all.asc", readPrefix); err != nil || len(info.Keys) != 4 {
+		t.Errorf("Couldn't inspect armored message: %v", err)
+	}
+	if len(reads) != 2 || reads[1] != -1 {
+		t.Errorf("Expected the whole message to be read, but got reads %v", reads)
+	}
+}
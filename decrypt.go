@@ -1,23 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"errors"
 	"flag"
+	"io"
 	"io/ioutil"
 	"os"
 )
 
 // flags
 var decryptKeyFlag string
+var decryptKeyringFlag string
+var decryptPassphraseFlag string
+var decryptIdentityFlag string
+var decryptPGPKeyringFlag string
+var decryptStructuredFlag bool
+var decryptFormatFlag string
 var decryptInFilenameArg string
 var decryptOutFilenameArg string
 
 var decryptDoc = `
 Usage: decrypt [options] in-file out-file
 
-Decrypt an input file using a key and write the results to an output file
+Decrypt an input file using a key and write the results to an output file.
+Files record the IDs of the keys they were encrypted with, so with a
+keyring of named keys the right one is picked automatically. A keyring
+file has a name=key pair on each line.
+Files encrypted with a passphrase need the same passphrase to decrypt, and
+files encrypted to a recipient need the matching identity file from keygen.
+Files in the age format are detected and decrypted with the identities or
+passphrase given. OpenPGP messages are detected too, and decrypted with a
+secret key from --pgp-keyring or the passphrase.
+Use --structured for files encrypted with encrypt --structured. The format
+is guessed from the file extension, ignoring .enc, unless --format is given.
 `
 
 // decryptAction is the action invoked by comandante
@@ -30,24 +49,111 @@ func decryptAction() error {
 		return errors.New("Please provide a valid output file")
 	}
 
-	// read the input file
+	if decryptStructuredFlag || decryptFormatFlag != "" {
+		return decryptStructuredAction()
+	}
+
+	// open the input file
+	inFile, err := os.Open(decryptInFilenameArg)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	c, err := decryptFlagCredentials()
+	if err != nil {
+		return err
+	}
+	decrypted, err := newDecryptReader(inFile, c)
+	if err != nil {
+		return err
+	}
+
+	// decrypt into the outfile. Nothing is written if the input turns out to
+	// be corrupt part way through.
+	return writeFileAtomic(decryptOutFilenameArg, decrypted, 0600)
+}
+
+// decryptStructuredAction decrypts the values of a structured input file
+func decryptStructuredAction() error {
+	format, err := structuredFormat(decryptInFilenameArg, decryptFormatFlag)
+	if err != nil {
+		return err
+	}
+
 	contents, err := ioutil.ReadFile(decryptInFilenameArg)
 	if err != nil {
 		return err
 	}
 
-	// decrypt and write to the outfile
-	decrypted, err := decrypt([]byte(decryptKeyFlag), []byte(contents))
+	c, err := decryptFlagCredentials()
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(decryptOutFilenameArg, decrypted, 0644)
+	decrypted, err := decryptStructured(format, contents, c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(decryptOutFilenameArg, bytes.NewReader(decrypted), 0600)
 }
 
 // decryptFlagInit initializes the flagset for the decrypt command
 func decryptFlagInit(fs *flag.FlagSet) {
 	defaultKey := os.Getenv("GOSECRET_KEY")
 	fs.StringVar(&decryptKeyFlag, "key", defaultKey, "A 16, 24 or 32 byte key to use for decryption. Defaults to value in $GOSECRET_KEY")
+
+	defaultKeyring := os.Getenv("GOSECRET_KEYRING")
+	fs.StringVar(&decryptKeyringFlag, "keyring", defaultKeyring, "A file of name=key pairs to pick the key from. Defaults to value in $GOSECRET_KEYRING")
+
+	defaultPassphrase := os.Getenv("GOSECRET_PASSPHRASE")
+	fs.StringVar(&decryptPassphraseFlag, "passphrase", defaultPassphrase, "The passphrase for files encrypted with one. Defaults to value in $GOSECRET_PASSPHRASE")
+
+	defaultIdentity := os.Getenv("GOSECRET_IDENTITY")
+	fs.StringVar(&decryptIdentityFlag, "identity", defaultIdentity, "An identity file from keygen for files encrypted to a recipient. Defaults to value in $GOSECRET_IDENTITY")
+
+	defaultPGPKeyring := os.Getenv("GOSECRET_PGP_KEYRING")
+	fs.StringVar(&decryptPGPKeyringFlag, "pgp-keyring", defaultPGPKeyring, "An OpenPGP secret keyring, as exported by gpg, for OpenPGP messages. Defaults to value in $GOSECRET_PGP_KEYRING")
+
+	fs.BoolVar(&decryptStructuredFlag, "structured", false, "Decrypt the values of a file encrypted with --structured")
+	fs.StringVar(&decryptFormatFlag, "format", "", "Format of a structured file: yaml, json or dotenv. Implies --structured")
+}
+
+// decryptFlagCredentials returns the key, keyring, passphrase, identities and
+// OpenPGP keys given with the flags.
+func decryptFlagCredentials() (*credentials, error) {
+	c := &credentials{key: []byte(decryptKeyFlag), passphrase: []byte(decryptPassphraseFlag)}
+	if decryptKeyringFlag != "" {
+		contents, err := ioutil.ReadFile(decryptKeyringFlag)
+		if err != nil {
+			return nil, err
+		}
+		if c.keyring, err = parseKeyring(contents); err != nil {
+			return nil, err
+		}
+	}
+	if decryptIdentityFlag != "" {
+		contents, err := ioutil.ReadFile(decryptIdentityFlag)
+		if err != nil {
+			return nil, err
+		}
+		if c.identities, err = parseX25519Identities(contents); err != nil {
+			return nil, err
+		}
+	}
+	if decryptPGPKeyringFlag != "" {
+		contents, err := ioutil.ReadFile(decryptPGPKeyringFlag)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := readPGPKeyring(contents)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range certs {
+			c.pgpKeys = append(append(c.pgpKeys, cert.primary), cert.subkeys...)
+		}
+	}
+	return c, nil
 }
 
 // decryptFlagPostParse sets filenames from the arguments provided by the flagset
@@ -62,21 +168,141 @@ func decryptFlagPostParse(fs *flag.FlagSet) {
 	decryptOutFilenameArg = fs.Arg(1)
 }
 
-// decrypt decrypts a message using a given key
+// decrypt decrypts a message using a given key. Files with a gosecret header
+// are authenticated while being decrypted, anything else is assumed to be in
+// the legacy AES-CFB format.
 func decrypt(key, contents []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(contents), &credentials{key: key})
+	if err != nil {
+		return []byte{}, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// decryptWithPassphrase decrypts a message using a key derived from a
+// passphrase with the parameters stored in the header.
+func decryptWithPassphrase(passphrase, contents []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(contents), &credentials{passphrase: passphrase})
+	if err != nil {
+		return []byte{}, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// newDecryptReader reads the header from r and returns a reader of the
+// decrypted contents, unlocked with whichever of the credentials the file
+// needs. Legacy files always use the key, and age files and OpenPGP messages
+// are recognized by their first bytes.
+//
+// Reading from the returned reader fails as soon as a chunk doesn't
+// authenticate, so callers must discard anything read when an error occurs.
+func newDecryptReader(r io.Reader, c *credentials) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if peekAgeHeader(br) {
+		return newAgeDecryptReader(br, c)
+	}
+	if peekPGPMessage(br) {
+		return newPGPDecryptReader(br, c)
+	}
+	if !peekHeader(br) {
+		if len(c.key) == 0 && len(c.keyring) > 0 {
+			return nil, errors.New("Legacy files don't record which key encrypted them, please provide it with --key or $GOSECRET_KEY")
+		}
+		return newLegacyReader(br, c.key)
+	}
+
+	var rawHeader bytes.Buffer
+	h, err := readHeader(io.TeeReader(br, &rawHeader))
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := unlockKey(h, c)
+	if err != nil {
+		return nil, err
+	}
+
+	// versions before 3 are a single AES-GCM message
+	if h.version < 3 {
+		body, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		decrypted, err := open(fileKey, rawHeader.Bytes(), body)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(decrypted), nil
+	}
+
+	return newStreamReader(br, h, fileKey)
+}
+
+// unlockKey returns the key a file with header h was encrypted with, using
+// either the key or the passphrase depending on the key derivation function,
+// or the stanzas of a version 4 file.
+func unlockKey(h *header, c *credentials) ([]byte, error) {
+	if h.version >= 4 {
+		return unwrapHeader(h, c)
+	}
+	key, passphrase := c.key, c.passphrase
+
+	if h.kdf == kdfScrypt {
+		if len(passphrase) == 0 {
+			return nil, errors.New("File was encrypted with a passphrase, please provide one with --passphrase or $GOSECRET_PASSPHRASE")
+		}
+		return h.scrypt.deriveKey(passphrase)
+	}
+
+	if len(key) == 0 && len(c.keyring) > 0 {
+		return nil, errors.New("File was encrypted before key IDs were recorded, please provide its key with --key or $GOSECRET_KEY")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("File was encrypted with a key, please provide one with --key or $GOSECRET_KEY")
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// open authenticates and decrypts a version 1 or 2 AES-GCM body. The raw
+// header bytes are the additional data it was sealed with.
+func open(key, rawHeader, body []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	if len(contents) < aes.BlockSize {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(body) < gcm.NonceSize() {
 		return []byte{}, errors.New("File to decrypt is too small")
 	}
 
-	iv := contents[:aes.BlockSize]
-	decrypted := contents[aes.BlockSize:]
-	cfb := cipher.NewCFBDecrypter(block, iv)
-	cfb.XORKeyStream(decrypted, decrypted)
+	nonce := body[:gcm.NonceSize()]
+	decrypted, err := gcm.Open(nil, nonce, body[gcm.NonceSize():], rawHeader)
+	if err != nil {
+		return []byte{}, errAuthFailed
+	}
 
 	return decrypted, nil
 }
+
+// newLegacyReader decrypts a file written by older versions of gosecret,
+// which is the IV followed by AES-CFB ciphertext with no authentication.
+func newLegacyReader(r io.Reader, key []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return nil, errors.New("File to decrypt is too small")
+	}
+
+	return &cipher.StreamReader{S: cipher.NewCFBDecrypter(block, iv), R: r}, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io"
+	"os"
+	"strings"
+)
+
+// flags and args. delete takes the download flags for the bucket and AWS
+// keys, so it shares their variables.
+var deleteYesFlag bool
+var deletePrefixFlag bool
+var deleteVersionIDFlag string
+var deleteKeyArgs []string
+
+// deleteBatchSize is how many files are deleted with each request.
+var deleteBatchSize = s3util.MaxDeleteObjects
+
+var deleteDoc = `
+Usage: delete [options] file...
+
+Delete files from the --bucket. The files to delete are listed and have to
+be confirmed first, unless --yes is given.
+
+With --prefix every file under the directories given is deleted instead,
+including those in subdirectories.
+
+On a bucket with versioning turned on, deleting a file only hides it behind
+a delete marker, and the versions before it can still be downloaded. Give
+the --version-id of one version of a file to delete that version for good.
+`
+
+func deleteAction() error {
+	// make sure that we have all of the required data
+	if len(deleteKeyArgs) == 0 {
+		return errors.New("Please provide a valid filename to delete")
+	}
+	if deleteVersionIDFlag != "" && (len(deleteKeyArgs) > 1 || deletePrefixFlag) {
+		return errors.New("Please provide a single file to delete with --version-id")
+	}
+	if downloadBucketNameFlag == "" {
+		return errors.New("Please provide an S3 bucket name with --bucket or $GOSECRET_BUCKET")
+	}
+	if downloadAccessKeyFlag == "" {
+		return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+	}
+	if downloadSecretKeyFlag == "" {
+		return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+	}
+
+	config := newS3Config(downloadAccessKeyFlag, downloadSecretKeyFlag, downloadSessionTokenFlag, downloadRegionFlag)
+	if err := setS3Endpoint(config, downloadEndpointFlag, downloadPathStyleFlag, downloadCABundleFlag); err != nil {
+		return err
+	}
+	if err := setS3Retry(config, downloadMaxAttemptsFlag, downloadRetryDelayFlag, downloadRetryMaxDelayFlag); err != nil {
+		return err
+	}
+
+	keys := deleteKeyArgs
+	if deletePrefixFlag {
+		var err error
+		if keys, err = listS3Prefixes(downloadBucketNameFlag, deleteKeyArgs, config); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			fmt.Println("No files to delete")
+			return nil
+		}
+	}
+
+	if !deleteYesFlag {
+		ok, err := confirmDelete(os.Stdin, os.Stdout, keys, deleteVersionIDFlag)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("Nothing was deleted")
+		}
+	}
+
+	return deleteS3(downloadBucketNameFlag, keys, deleteVersionIDFlag, config, os.Stdout)
+}
+
+// deleteFlagInit initializes the flagset for the delete command
+func deleteFlagInit(fs *flag.FlagSet) {
+	downloadFlagInit(fs)
+
+	fs.BoolVar(&deleteYesFlag, "yes", false, "Delete without asking for confirmation")
+	fs.BoolVar(&deletePrefixFlag, "prefix", false, "Delete every file under the directories given")
+	fs.StringVar(&deleteVersionIDFlag, "version-id", "", "Permanently delete this version of the file")
+}
+
+// deleteFlagPostParse sets the files to delete from the arguments provided by the flagset
+func deleteFlagPostParse(fs *flag.FlagSet) {
+	deleteKeyArgs = fs.Args()
+}
+
+// listS3Prefixes returns the keys of every file under the prefixes of an s3
+// bucket, each key once.
+func listS3Prefixes(bucket string, prefixes []string, config *s3util.Config) ([]string, error) {
+	var keys []string
+	seen := map[string]bool{}
+	for _, prefix := range prefixes {
+		// an empty prefix would be the whole bucket
+		if strings.Trim(prefix, "/") == "" {
+			return nil, errors.New("Please provide a prefix that isn't the whole bucket")
+		}
+		entries, err := listS3(bucket, prefix, true, config)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !seen[e.Key] {
+				seen[e.Key] = true
+				keys = append(keys, e.Key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// confirmDelete lists the keys that will be deleted on w and asks whether to
+// go ahead, reading the answer from r.
+func confirmDelete(r io.Reader, w io.Writer, keys []string, versionID string) (bool, error) {
+	for _, key := range keys {
+		if versionID != "" {
+			fmt.Fprintf(w, "%s (version %s)\n", key, versionID)
+		} else {
+			fmt.Fprintln(w, key)
+		}
+	}
+	fmt.Fprintf(w, "Delete %d files? [y/N] ", len(keys))
+
+	answer, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// deleteS3 deletes keys from an s3 bucket, or only the version versionID of
+// the one key given, and reports each file deleted on w. Several keys are
+// deleted in batches.
+func deleteS3(bucket string, keys []string, versionID string, config *s3util.Config, w io.Writer) error {
+	if len(keys) == 1 {
+		if err := s3util.Delete(generateS3Url(bucket, keys[0]), versionID, config); err != nil {
+			return err
+		}
+		if versionID != "" {
+			fmt.Fprintf(w, "Deleted %s (version %s)\n", keys[0], versionID)
+		} else {
+			fmt.Fprintf(w, "Deleted %s\n", keys[0])
+		}
+		return nil
+	}
+
+	failed := 0
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]s3util.ObjectID, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, s3util.ObjectID{Key: key})
+		}
+
+		result, err := s3util.DeleteObjects(generateS3Url(bucket, ""), objects, config)
+		if err != nil {
+			return err
+		}
+		for _, d := range result.Deleted {
+			if d.DeleteMarker {
+				fmt.Fprintf(w, "Deleted %s, its versions are kept behind a delete marker\n", d.Key)
+			} else {
+				fmt.Fprintf(w, "Deleted %s\n", d.Key)
+			}
+		}
+		for _, e := range result.Errors {
+			fmt.Fprintf(w, "Couldn't delete %s: %s\n", e.Key, &e)
+		}
+		failed += len(result.Errors)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d files couldn't be deleted", failed)
+	}
+	return nil
+}
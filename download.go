@@ -3,17 +3,29 @@ package main
 import (
 	"errors"
 	"flag"
-	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3"
 	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 )
 
 // flags and args
 var downloadBucketNameFlag string
 var downloadAccessKeyFlag string
 var downloadSecretKeyFlag string
+var downloadSessionTokenFlag string
+var downloadRegionFlag string
+var downloadEndpointFlag string
+var downloadPathStyleFlag bool
+var downloadCABundleFlag string
+var downloadMaxAttemptsFlag int
+var downloadRetryDelayFlag time.Duration
+var downloadRetryMaxDelayFlag time.Duration
+var downloadVersionIDFlag string
+var downloadSSECustomerKeyFlag string
 var downloadFilenameArg string
 var downloadDestinationFilenameArg string
 
@@ -22,6 +34,12 @@ Usage: download [options] file [destination file]
 
 Download a file from an s3 bucket.
 If a destination file isn't specified the downloaded file will be named the same as the soruce file.
+
+On a bucket with versioning turned on, --version-id downloads an older
+version of the file. The history command lists them.
+
+Files uploaded with --sse customer need the same --sse-customer-key to be
+downloaded.
 `
 
 func downloadAction() error {
@@ -42,16 +60,30 @@ func downloadAction() error {
 		return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
 	}
 
+	sse, err := sseCustomerHeaders(downloadSSECustomerKeyFlag)
+	if err != nil {
+		return err
+	}
+
 	// create the config needed for the downloader
-	config := &s3util.Config{
-		Keys: &s3.Keys{
-			AccessKey: downloadAccessKeyFlag,
-			SecretKey: downloadSecretKeyFlag,
-		},
-		Service: s3.DefaultService,
+	config := newS3Config(downloadAccessKeyFlag, downloadSecretKeyFlag, downloadSessionTokenFlag, downloadRegionFlag)
+	if err := setS3Endpoint(config, downloadEndpointFlag, downloadPathStyleFlag, downloadCABundleFlag); err != nil {
+		return err
+	}
+	if err := setS3Retry(config, downloadMaxAttemptsFlag, downloadRetryDelayFlag, downloadRetryMaxDelayFlag); err != nil {
+		return err
 	}
 
-	return download(downloadBucketNameFlag, downloadFilenameArg, downloadDestinationFilenameArg, config)
+	state, err := loadS3State()
+	if err != nil {
+		return err
+	}
+	info, err := download(downloadBucketNameFlag, downloadFilenameArg, downloadVersionIDFlag, downloadDestinationFilenameArg, sse, config)
+	if err != nil {
+		return err
+	}
+	// uploading the file again will check it hasn't changed since
+	return state.record(downloadBucketNameFlag, downloadFilenameArg, info)
 }
 
 // downloadFlagInit initializes the flagset for the download command
@@ -64,6 +96,39 @@ func downloadFlagInit(fs *flag.FlagSet) {
 
 	defaultSecretKey := os.Getenv("GOSECRET_SECRET_KEY")
 	fs.StringVar(&downloadSecretKeyFlag, "secret-key", defaultSecretKey, "S3 Secret Key. Defaults to value in $GOSECRET_SECRET_KEY")
+
+	defaultSessionToken := os.Getenv("GOSECRET_SESSION_TOKEN")
+	fs.StringVar(&downloadSessionTokenFlag, "session-token", defaultSessionToken, "S3 session token for temporary credentials. Defaults to value in $GOSECRET_SESSION_TOKEN")
+
+	defaultRegion := os.Getenv("GOSECRET_REGION")
+	fs.StringVar(&downloadRegionFlag, "region", defaultRegion, "AWS region of the S3 bucket. Defaults to value in $GOSECRET_REGION, or us-east-1")
+
+	defaultEndpoint := os.Getenv("GOSECRET_ENDPOINT")
+	fs.StringVar(&downloadEndpointFlag, "endpoint", defaultEndpoint, "URL of an S3-compatible service to use instead of AWS. Defaults to value in $GOSECRET_ENDPOINT")
+
+	defaultPathStyle, _ := strconv.ParseBool(os.Getenv("GOSECRET_PATH_STYLE"))
+	fs.BoolVar(&downloadPathStyleFlag, "path-style", defaultPathStyle, "Put the bucket in the URL path instead of the host name. Defaults to value in $GOSECRET_PATH_STYLE")
+
+	defaultCABundle := os.Getenv("GOSECRET_CA_BUNDLE")
+	fs.StringVar(&downloadCABundleFlag, "ca-bundle", defaultCABundle, "PEM file of the certificates to trust for the S3 endpoint. Defaults to value in $GOSECRET_CA_BUNDLE")
+
+	defaultMaxAttempts, defaultRetryDelay, defaultRetryMaxDelay := s3RetryDefaults()
+	fs.IntVar(&downloadMaxAttemptsFlag, "max-attempts", defaultMaxAttempts, "Times to try each S3 request that fails with a transient error. Defaults to value in $GOSECRET_MAX_ATTEMPTS, or 5")
+	fs.DurationVar(&downloadRetryDelayFlag, "retry-delay", defaultRetryDelay, "Wait before retrying a failed S3 request, doubled for each retry after. Defaults to value in $GOSECRET_RETRY_DELAY, or 100ms")
+	fs.DurationVar(&downloadRetryMaxDelayFlag, "retry-max-delay", defaultRetryMaxDelay, "Longest wait between tries of an S3 request. Defaults to value in $GOSECRET_RETRY_MAX_DELAY, or 20s")
+}
+
+// downloadCommandFlagInit initializes the flagset for the download command
+// itself, which can also download an older version of a file or one
+// encrypted at rest with a key of the user's. The other
+// commands sharing the download flags use downloadFlagInit.
+func downloadCommandFlagInit(fs *flag.FlagSet) {
+	downloadFlagInit(fs)
+
+	fs.StringVar(&downloadVersionIDFlag, "version-id", "", "Download this version of the file instead of the latest one")
+
+	defaultSSECustomerKey := os.Getenv("GOSECRET_SSE_CUSTOMER_KEY")
+	fs.StringVar(&downloadSSECustomerKeyFlag, "sse-customer-key", defaultSSECustomerKey, "Base64 encoded 32 byte key the file was uploaded with --sse customer. Defaults to value in $GOSECRET_SSE_CUSTOMER_KEY")
 }
 
 // downloadFlagPostParse sets the downloadable filename from the arguments provided by the flagset
@@ -77,24 +142,58 @@ func downloadFlagPostParse(fs *flag.FlagSet) {
 	}
 }
 
-// download downloads a file from an s3 bucket.
-func download(bucket, sourceFile, destFile string, config *s3util.Config) error {
-	headers := http.Header{}
-	headers.Add("x-amz-acl", "private")
-	s3File, err := s3util.Open(generateS3Url(bucket, sourceFile), config)
+// download downloads a file from an s3 bucket, or the version versionID of
+// it if that is set, and returns its ETag and version. sse holds the
+// server-side encryption headers of a file encrypted at rest with a key of
+// the user's.
+func download(bucket, sourceFile, versionID, destFile string, sse http.Header, config *s3util.Config) (*s3util.ObjectInfo, error) {
+	s3File, info, err := openS3FileVersion(bucket, sourceFile, versionID, sse, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer s3File.Close()
 
 	// open the local file to download to
 	localFile, err := os.Create(destFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer localFile.Close()
 
 	// copy the file
-	_, err = io.Copy(localFile, s3File)
-	return err
+	if _, err := io.Copy(localFile, s3File); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// openS3File requests name from an s3 bucket and returns a reader of its contents.
+func openS3File(bucket, name string, config *s3util.Config) (io.ReadCloser, error) {
+	r, _, err := openS3FileVersion(bucket, name, "", nil, config)
+	return r, err
+}
+
+// openS3FileVersion requests the version versionID of name from an s3
+// bucket, or the latest version if versionID is empty, with the headers h
+// if they aren't nil, and returns a reader of its contents along with its
+// ETag and version.
+func openS3FileVersion(bucket, name, versionID string, h http.Header, config *s3util.Config) (io.ReadCloser, *s3util.ObjectInfo, error) {
+	u := generateS3Url(bucket, name)
+	if versionID != "" {
+		u += "?versionId=" + url.QueryEscape(versionID)
+	}
+	return s3util.OpenWithHeader(u, h, config)
+}
+
+// openS3FileRange requests up to n bytes of name from an s3 bucket, starting
+// at offset, and returns a reader of them along with the size of the whole
+// file.
+func openS3FileRange(bucket, name string, offset, n int64, config *s3util.Config) (io.ReadCloser, int64, error) {
+	return s3util.OpenRange(generateS3Url(bucket, name), offset, n, config)
+}
+
+// openS3Dir returns the directory prefix of an s3 bucket, to list the files
+// in it.
+func openS3Dir(bucket, prefix string, config *s3util.Config) (*s3util.File, error) {
+	return s3util.NewDir(generateS3Url(bucket, ""), prefix, config)
 }
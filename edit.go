@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// flags and args. edit also takes the decrypt flags, using the same key or
+// passphrase to decrypt and re-encrypt, and the encrypt flags for the other
+// keys and recipients to encrypt for.
+var editBucketNameFlag string
+var editAccessKeyFlag string
+var editSecretKeyFlag string
+var editSessionTokenFlag string
+var editRegionFlag string
+var editEndpointFlag string
+var editPathStyleFlag bool
+var editCABundleFlag string
+var editMaxAttemptsFlag int
+var editRetryDelayFlag time.Duration
+var editRetryMaxDelayFlag time.Duration
+var editFilenameArg string
+
+var editDoc = `
+Usage: edit [options] file
+
+Decrypt a file into a temp file only readable by you, open it in $EDITOR and
+encrypt it again once the editor exits. Nothing is saved if the editor exits
+with an error or the contents didn't change, and the temp file is
+overwritten and removed afterwards. /dev/shm is used for the temp file where
+it exists so the plaintext never touches a disk.
+
+The file is decrypted with --key, --keyring, --passphrase or --identity,
+as with decrypt. An existing file is encrypted again for every key,
+recipient and passphrase that could decrypt it, and any added with
+--add-key or --recipient. As the file is written with a new nonce, the
+ones not given to decrypt it have to be given with --add-key or
+--recipient too. age files and OpenPGP messages are written back in their
+format, age files for the same recipients or passphrase and OpenPGP
+messages for the same keys, whose public keys have to be in --pgp-keyring,
+and passphrase. A new file is encrypted with the passphrase if one is
+given, or the key otherwise. With --bucket the file is an object in that S3
+bucket instead of a local file. A local file that doesn't exist yet is created.
+
+If someone else uploads the S3 file while you are editing it, your changes
+aren't uploaded over theirs. They are saved encrypted to a .conflict file
+in the current directory instead. Structured files in a bucket with
+versioning turned on can then be combined with theirs by merge.
+`
+
+func editAction() error {
+	// make sure that we have all of the required data
+	if editFilenameArg == "" {
+		return errors.New("Please provide a valid filename to edit")
+	}
+
+	// the file is encrypted again with what decrypted it
+	encryptKeyFlag, encryptPassphraseFlag = decryptKeyFlag, decryptPassphraseFlag
+	encryptStructuredFlag, encryptFormatFlag = decryptStructuredFlag, decryptFormatFlag
+
+	var format string
+	var err error
+	if encryptStructuredFlag || encryptFormatFlag != "" {
+		if format, err = structuredFormat(editFilenameArg, encryptFormatFlag); err != nil {
+			return err
+		}
+	}
+	c, err := decryptFlagCredentials()
+	if err != nil {
+		return err
+	}
+
+	var config *s3util.Config
+	if editBucketNameFlag != "" {
+		if editAccessKeyFlag == "" {
+			return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+		}
+		if editSecretKeyFlag == "" {
+			return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+		}
+		config = newS3Config(editAccessKeyFlag, editSecretKeyFlag, editSessionTokenFlag, editRegionFlag)
+		if err := setS3Endpoint(config, editEndpointFlag, editPathStyleFlag, editCABundleFlag); err != nil {
+			return err
+		}
+		if err := setS3Retry(config, editMaxAttemptsFlag, editRetryDelayFlag, editRetryMaxDelayFlag); err != nil {
+			return err
+		}
+	}
+
+	ciphertext, info, err := readEditFile(config)
+	if err != nil {
+		return err
+	}
+
+	// get the key for saving up front so a bad one fails before editing. An
+	// existing file keeps its format and the stanzas of its header
+	var plaintext []byte
+	var seal func([]byte) ([]byte, error)
+	if len(ciphertext) > 0 {
+		if plaintext, err = decryptEdit(format, ciphertext, c); err != nil {
+			return err
+		}
+		if seal, err = editSealer(format, ciphertext, c); err != nil {
+			return err
+		}
+	}
+	if seal == nil {
+		h, key, err := encryptFlagHeader()
+		if err != nil {
+			return err
+		}
+		seal = headerSealer(format, h, key)
+	}
+
+	edited, err := runEditor(plaintext, filepath.Ext(strings.TrimSuffix(editFilenameArg, ".enc")))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, plaintext) {
+		fmt.Fprintln(os.Stderr, "No changes made")
+		return nil
+	}
+
+	if ciphertext, err = seal(edited); err != nil {
+		return err
+	}
+	return writeEditFile(config, format, ciphertext, info)
+}
+
+// editFlagInit initializes the flagset for the edit command
+func editFlagInit(fs *flag.FlagSet) {
+	decryptFlagInit(fs)
+	encryptStanzaFlagInit(fs)
+
+	fs.StringVar(&editBucketNameFlag, "bucket", "", "Edit a file in this S3 bucket instead of a local file")
+
+	defaultAccessKey := os.Getenv("GOSECRET_ACCESS_KEY")
+	fs.StringVar(&editAccessKeyFlag, "access-key", defaultAccessKey, "S3 Access Key. Defaults to value in $GOSECRET_ACCESS_KEY")
+
+	defaultSecretKey := os.Getenv("GOSECRET_SECRET_KEY")
+	fs.StringVar(&editSecretKeyFlag, "secret-key", defaultSecretKey, "S3 Secret Key. Defaults to value in $GOSECRET_SECRET_KEY")
+
+	defaultSessionToken := os.Getenv("GOSECRET_SESSION_TOKEN")
+	fs.StringVar(&editSessionTokenFlag, "session-token", defaultSessionToken, "S3 session token for temporary credentials. Defaults to value in $GOSECRET_SESSION_TOKEN")
+
+	defaultRegion := os.Getenv("GOSECRET_REGION")
+	fs.StringVar(&editRegionFlag, "region", defaultRegion, "AWS region of the S3 bucket. Defaults to value in $GOSECRET_REGION, or us-east-1")
+
+	defaultEndpoint := os.Getenv("GOSECRET_ENDPOINT")
+	fs.StringVar(&editEndpointFlag, "endpoint", defaultEndpoint, "URL of an S3-compatible service to use instead of AWS. Defaults to value in $GOSECRET_ENDPOINT")
+
+	defaultPathStyle, _ := strconv.ParseBool(os.Getenv("GOSECRET_PATH_STYLE"))
+	fs.BoolVar(&editPathStyleFlag, "path-style", defaultPathStyle, "Put the bucket in the URL path instead of the host name. Defaults to value in $GOSECRET_PATH_STYLE")
+
+	defaultCABundle := os.Getenv("GOSECRET_CA_BUNDLE")
+	fs.StringVar(&editCABundleFlag, "ca-bundle", defaultCABundle, "PEM file of the certificates to trust for the S3 endpoint. Defaults to value in $GOSECRET_CA_BUNDLE")
+
+	defaultMaxAttempts, defaultRetryDelay, defaultRetryMaxDelay := s3RetryDefaults()
+	fs.IntVar(&editMaxAttemptsFlag, "max-attempts", defaultMaxAttempts, "Times to try each S3 request that fails with a transient error. Defaults to value in $GOSECRET_MAX_ATTEMPTS, or 5")
+	fs.DurationVar(&editRetryDelayFlag, "retry-delay", defaultRetryDelay, "Wait before retrying a failed S3 request, doubled for each retry after. Defaults to value in $GOSECRET_RETRY_DELAY, or 100ms")
+	fs.DurationVar(&editRetryMaxDelayFlag, "retry-max-delay", defaultRetryMaxDelay, "Longest wait between tries of an S3 request. Defaults to value in $GOSECRET_RETRY_MAX_DELAY, or 20s")
+}
+
+// editFlagPostParse sets the filename from the arguments provided by the flagset
+func editFlagPostParse(fs *flag.FlagSet) {
+	if filename := fs.Arg(0); filename != "" {
+		editFilenameArg = filename
+	}
+}
+
+// readEditFile reads the encrypted file from S3 if config is set, along with
+// its ETag and version, or from disk otherwise. A missing local file reads as
+// empty.
+func readEditFile(config *s3util.Config) ([]byte, *s3util.ObjectInfo, error) {
+	if config == nil {
+		contents, err := ioutil.ReadFile(editFilenameArg)
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return contents, nil, err
+	}
+
+	s3File, info, err := openS3FileVersion(editBucketNameFlag, editFilenameArg, "", nil, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s3File.Close()
+	contents, err := ioutil.ReadAll(s3File)
+	return contents, info, err
+}
+
+// writeEditFile writes the encrypted file to S3 if config is set, as long as
+// it is still the version read, or to disk otherwise. format is the
+// structured format of the file, if any.
+func writeEditFile(config *s3util.Config, format string, ciphertext []byte, read *s3util.ObjectInfo) error {
+	if config == nil {
+		// keep the mode of the file, and only let the user read a new one
+		perm := os.FileMode(0600)
+		if fi, err := os.Stat(editFilenameArg); err == nil {
+			perm = fi.Mode().Perm()
+		}
+		return writeFileAtomic(editFilenameArg, bytes.NewReader(ciphertext), perm)
+	}
+
+	state, err := loadS3State()
+	if err != nil {
+		return err
+	}
+	// the conditional headers check against what the state holds
+	state.Files[s3StateKey(editBucketNameFlag, editFilenameArg)] = read
+
+	s3File, err := createS3File(editBucketNameFlag, editFilenameArg, state.conditionalHeaders(editBucketNameFlag, editFilenameArg), config)
+	if err != nil {
+		return err
+	}
+	if _, err := s3File.Write(ciphertext); err != nil {
+		s3File.Abort()
+		return err
+	}
+	err = s3File.Close()
+	if err == s3util.ErrPreconditionFailed {
+		// keep the changes, and what they were made to for merging them
+		conflictFile := filepath.Base(editFilenameArg) + ".conflict"
+		if err := writeFileAtomic(conflictFile, bytes.NewReader(ciphertext), 0600); err != nil {
+			return err
+		}
+		if err := state.record(editBucketNameFlag, editFilenameArg, read); err != nil {
+			return err
+		}
+		msg := fmt.Sprintf("%s was changed in the %s bucket while you were editing it, so your changes were saved to %s instead", editFilenameArg, editBucketNameFlag, conflictFile)
+		// merging needs the values to compare and the version they started from
+		if format != "" && read != nil && read.VersionId != "" {
+			msg += fmt.Sprintf(". Merge them with gosecret merge %s out-file %s", conflictFile, editFilenameArg)
+		}
+		return errors.New(msg)
+	}
+	if err != nil {
+		return err
+	}
+	return state.record(editBucketNameFlag, editFilenameArg, s3File.Info())
+}
+
+// decryptEdit decrypts the file being edited with the credentials c.
+func decryptEdit(format string, ciphertext []byte, c *credentials) ([]byte, error) {
+	if format != "" {
+		return decryptStructured(format, ciphertext, c)
+	}
+
+	r, err := newDecryptReader(bytes.NewReader(ciphertext), c)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// editSealer returns a function that encrypts the edited file the way
+// ciphertext was encrypted. age files and OpenPGP messages stay in their
+// format, and gosecret files keep the stanzas of their header. It returns
+// nil for legacy files, which are encrypted as new files.
+func editSealer(format string, ciphertext []byte, c *credentials) (func([]byte) ([]byte, error), error) {
+	br := bufio.NewReader(bytes.NewReader(ciphertext))
+	if format == "" && peekAgeHeader(br) {
+		h, fileKey, err := editAgeHeader(br, c)
+		if err != nil {
+			return nil, err
+		}
+		return func(plaintext []byte) ([]byte, error) {
+			var b bytes.Buffer
+			w, err := newAgeWriter(&b, h, fileKey)
+			if err != nil {
+				return nil, err
+			}
+			return finishEncrypt(&b, w, plaintext)
+		}, nil
+	}
+	if format == "" && peekPGPMessage(br) {
+		keys, passphrase, err := editPGPKeys(br, c)
+		if err != nil {
+			return nil, err
+		}
+		armored := bytes.HasPrefix(ciphertext, pgpMessageArmor)
+		return func(plaintext []byte) ([]byte, error) {
+			var b bytes.Buffer
+			w, err := newPGPWriter(&b, keys, passphrase)
+			if err != nil {
+				return nil, err
+			}
+			encrypted, err := finishEncrypt(&b, w, plaintext)
+			if err != nil || !armored {
+				return encrypted, err
+			}
+			return encodePGPArmor(encrypted), nil
+		}, nil
+	}
+
+	h, key, err := editHeader(format, ciphertext, c)
+	if err != nil || h == nil {
+		return nil, err
+	}
+	return headerSealer(format, h, key), nil
+}
+
+// headerSealer returns a function that encrypts the edited file with the key
+// for header h, only encrypting its values if it is in a structured format.
+func headerSealer(format string, h *header, key []byte) func([]byte) ([]byte, error) {
+	return func(plaintext []byte) ([]byte, error) {
+		if format != "" {
+			return encryptStructured(format, h, key, plaintext)
+		}
+		var b bytes.Buffer
+		w, err := newStreamWriter(&b, h, key)
+		if err != nil {
+			return nil, err
+		}
+		return finishEncrypt(&b, w, plaintext)
+	}
+}
+
+// editAgeHeader returns the header and file key of the age file being read
+// from r, with stanzas for any recipients given with --recipient added. The
+// payload is written with a new nonce, so the file key can be kept along with
+// everyone it is wrapped for.
+func editAgeHeader(r *bufio.Reader, c *credentials) (*ageHeader, []byte, error) {
+	if len(encryptAddKeyFlag) > 0 {
+		return nil, nil, errors.New("age files can't be encrypted with --add-key, please use --recipient")
+	}
+	recipients, err := parseX25519Recipients(encryptRecipientFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, err := readAgeHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileKey, err := unwrapAgeHeader(h, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(recipients) == 0 {
+		return h, fileKey, nil
+	}
+
+	for _, s := range h.stanzas {
+		if s.kind == ageScryptKind {
+			return nil, nil, errors.New("age files encrypted with a passphrase can't have recipients")
+		}
+	}
+	for _, recipient := range recipients {
+		s, err := newAgeX25519Stanza(recipient, fileKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+	h.mac = h.headerMAC(fileKey)
+	return h, fileKey, nil
+}
+
+// editPGPKeys returns the keys and passphrase to encrypt the edited OpenPGP
+// message being read from r with, which are the keys it is encrypted to and
+// its passphrase if it has one. The public keys are taken from the keyring
+// in the credentials c, and it fails if any of them aren't in it.
+func editPGPKeys(r *bufio.Reader, c *credentials) ([]*pgpKey, []byte, error) {
+	if len(encryptAddKeyFlag) > 0 || len(encryptRecipientFlag) > 0 {
+		return nil, nil, errors.New("OpenPGP messages can't be encrypted with --add-key or --recipient")
+	}
+	pkesks, skesks, _, err := readPGPSessionKeyPackets(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys []*pgpKey
+	var missing []string
+	for _, p := range pkesks {
+		var found *pgpKey
+		for _, key := range c.pgpKeys {
+			if p.keyID != 0 && p.keyID == key.keyID() {
+				found = key
+			}
+		}
+		if found == nil {
+			missing = append(missing, formatPGPKeyID(p.keyID))
+			continue
+		}
+		keys = append(keys, found)
+	}
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("OpenPGP message is also encrypted to keys %s, which aren't in the keyring, so it can't be encrypted to them again. Please add them to the keyring given with --pgp-keyring", strings.Join(missing, ", "))
+	}
+
+	if len(skesks) == 0 {
+		return keys, nil, nil
+	}
+	if len(c.passphrase) == 0 {
+		return nil, nil, errors.New("OpenPGP message can also be decrypted with a passphrase, please provide it with --passphrase to encrypt it with the passphrase again")
+	}
+	for _, s := range skesks {
+		if _, err := s.sessionKey(c.passphrase); err != nil {
+			return nil, nil, errors.New("OpenPGP message can also be decrypted with a passphrase other than the one given, so it can't be encrypted with it again")
+		}
+	}
+	return keys, c.passphrase, nil
+}
+
+// editHeader returns the header and data key to encrypt the edited file
+// with, so that every key, recipient and passphrase that could decrypt it
+// still can, along with any added by the encrypt flags. A structured file
+// keeps its header, since its values are sealed with random nonces. A whole
+// file gets a new nonce, as its chunk nonces can't be used twice with the
+// same key, and so its stanzas are wrapped again with the credentials c. A
+// nil header is returned for files without stanzas.
+func editHeader(format string, ciphertext []byte, c *credentials) (*header, []byte, error) {
+	h, err := encryptedHeader(format, ciphertext)
+	if err != nil || h.version < 4 {
+		return nil, nil, nil
+	}
+	dataKey, err := unlockKey(h, c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	added, err := editAddedKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	if format != "" {
+		rewrapped, err := h.rewrap(dataKey, withoutStanzas(added, h), true)
+		return rewrapped, dataKey, err
+	}
+
+	m, err := rewrapKeys(h, dataKey, c, added)
+	if err != nil {
+		return nil, nil, err
+	}
+	resealed, err := newHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := resealed.addStanzas(dataKey, m); err != nil {
+		return nil, nil, err
+	}
+	if err := resealed.seal(dataKey); err != nil {
+		return nil, nil, err
+	}
+	return resealed, dataKey, nil
+}
+
+// editAddedKeys returns the master keys and recipients given with --add-key
+// and --recipient.
+func editAddedKeys() (*masterKeys, error) {
+	recipients, err := parseX25519Recipients(encryptRecipientFlag)
+	if err != nil {
+		return nil, err
+	}
+	return &masterKeys{keys: encryptAddKeyFlag.bytes(), recipients: recipients}, nil
+}
+
+// withoutStanzas returns the keys and recipients of m that h doesn't already
+// have a stanza for.
+func withoutStanzas(m *masterKeys, h *header) *masterKeys {
+	has := func(kind byte, id []byte) bool {
+		for _, s := range h.stanzas {
+			if s.kind == kind && bytes.Equal(s.keyID, id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	left := &masterKeys{}
+	for _, key := range m.keys {
+		if !has(stanzaKey, keyID(key)) {
+			left.keys = append(left.keys, key)
+		}
+	}
+	for _, recipient := range m.recipients {
+		if !has(stanzaX25519, recipient.id()) {
+			left.recipients = append(left.recipients, recipient)
+		}
+	}
+	return left
+}
+
+// rewrapKeys returns the master keys to wrap dataKey with again for each of
+// the stanzas of h, found among the credentials c and the added keys, with
+// the added keys h doesn't have a stanza for as well. It fails if a stanza
+// can't be wrapped again because what it was made for wasn't given.
+func rewrapKeys(h *header, dataKey []byte, c *credentials, added *masterKeys) (*masterKeys, error) {
+	m := withoutStanzas(added, h)
+	missing := 0
+	for _, s := range h.stanzas {
+		switch s.kind {
+		case stanzaKey:
+			key := c.masterKey(s.keyID)
+			for _, k := range added.keys {
+				if bytes.Equal(keyID(k), s.keyID) {
+					key = k
+				}
+			}
+			if key == nil {
+				missing++
+				continue
+			}
+			m.keys = append(m.keys, key)
+		case stanzaX25519:
+			var recipient *x25519Recipient
+			for _, identity := range c.identities {
+				if bytes.Equal(identity.recipient().id(), s.keyID) {
+					recipient = identity.recipient()
+				}
+			}
+			for _, r := range added.recipients {
+				if bytes.Equal(r.id(), s.keyID) {
+					recipient = r
+				}
+			}
+			if recipient == nil {
+				missing++
+				continue
+			}
+			m.recipients = append(m.recipients, recipient)
+		case stanzaScrypt:
+			// the passphrase has to be the one the stanza was made with
+			if len(c.passphrase) == 0 {
+				missing++
+				continue
+			}
+			derived, err := s.scrypt.deriveKey(c.passphrase)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := unwrapDataKey(h, derived, s.body); err != nil {
+				missing++
+				continue
+			}
+			m.passphrase, m.scrypt = c.passphrase, s.scrypt
+		default:
+			missing++
+		}
+	}
+
+	if missing > 0 {
+		return nil, fmt.Errorf("File can also be decrypted with %d other keys, recipients or passphrases that weren't given, so it can't be encrypted again for them. Please provide them with --add-key, --recipient or --passphrase", missing)
+	}
+	return m, nil
+}
+
+// runEditor writes plaintext to a secure temp file, opens it in $EDITOR and
+// returns the edited contents. The temp file is shredded when the editor
+// exits or gosecret is asked to terminate.
+func runEditor(plaintext []byte, ext string) ([]byte, error) {
+	tmpFile, err := createSecureTempFile("gosecret-edit-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	tmpName := tmpFile.Name()
+	defer shredFile(tmpName)
+
+	_, err = tmpFile.Write(plaintext)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// interrupts go to the editor, which handles them itself. Being told to
+	// terminate means the edit is abandoned.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+	go func() {
+		for sig := range signals {
+			if sig != os.Interrupt {
+				shredFile(tmpName)
+				os.Exit(1)
+			}
+		}
+	}()
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], tmpName)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Editor failed, not saving changes: %s", err)
+	}
+
+	return ioutil.ReadFile(tmpName)
+}
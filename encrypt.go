@@ -1,25 +1,58 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"bytes"
 	"crypto/rand"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"time"
 )
 
 // flags
 var encryptKeyFlag string
+var encryptAddKeyFlag stringsFlag
+var encryptRecipientFlag stringsFlag
+var encryptPassphraseFlag string
+var encryptScryptLogNFlag int
+var encryptScryptRFlag int
+var encryptScryptPFlag int
+var encryptStructuredFlag bool
+var encryptFormatFlag string
+var encryptPGPKeyringFlag string
 var encryptInFilenameArg string
 var encryptOutFilenameArg string
 
 var encryptDoc = `
 Usage: encrypt [options] in-file out-file
 
-Encrypt an input file using a key and write the results to an output file
+Encrypt an input file using a key and write the results to an output file.
+If a passphrase is given it is stretched into a key with scrypt instead.
+
+Each file is encrypted with its own random data key, which is stored in the
+header wrapped by the key or passphrase. Use --add-key to also wrap it with
+other master keys, any of which can then decrypt the file. Use --recipient
+to wrap it for the public key of a recipient from keygen, so only the
+holder of the matching identity can decrypt it. The key is left out when
+it isn't set and recipients are given. The master keys of a file can be
+changed later with rewrap.
+
+With --structured only the values of a YAML, JSON or dotenv file are
+encrypted, leaving keys, comments and ordering readable for code review.
+The format is guessed from the file extension unless --format is given.
+
+With --format age the file is written in the age format instead, so it can
+be decrypted with the age tool. age files are encrypted to recipients,
+either gosecret's or age's own, or with a passphrase but not both, and
+--key is ignored. decrypt reads age files without any extra flags.
+
+With --format pgp the file is written as an OpenPGP message that gpg can
+decrypt. It is encrypted to every key in the keyring given with
+--pgp-keyring, using each key's current encryption subkey, and to the
+passphrase if one is given. --key is ignored.
 `
 
 // encryptAction is the action invoked by comandante
@@ -32,24 +65,185 @@ func encryptAction() error {
 		return errors.New("Please provide a valid output file")
 	}
 
-	// read the input file
+	if encryptStructuredFlag || (encryptFormatFlag != "" && encryptFormatFlag != ageFormat && encryptFormatFlag != pgpFormat) {
+		return encryptStructuredAction()
+	}
+
+	// open the input file
+	inFile, err := os.Open(encryptInFilenameArg)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	// encrypt into the outfile through a pipe. It is only replaced once the
+	// whole input has been encrypted, so a bad key leaves it as it was and it
+	// can be the input file too
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		encrypted, err := encryptFlagWriter(pw)
+		if err == nil {
+			_, err = io.Copy(encrypted, inFile)
+		}
+		if err == nil {
+			err = encrypted.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return writeFileAtomic(encryptOutFilenameArg, pr, 0644)
+}
+
+// encryptStructuredAction encrypts the values of a structured input file
+func encryptStructuredAction() error {
+	format, err := structuredFormat(encryptInFilenameArg, encryptFormatFlag)
+	if err != nil {
+		return err
+	}
+
 	contents, err := ioutil.ReadFile(encryptInFilenameArg)
 	if err != nil {
 		return err
 	}
 
-	// encrypt and write to the outfile
-	encrypted, err := encrypt([]byte(encryptKeyFlag), []byte(contents))
+	h, key, err := encryptFlagHeader()
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := encryptStructured(format, h, key, contents)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(encryptOutFilenameArg, encrypted, 0644)
+	return writeFileAtomic(encryptOutFilenameArg, bytes.NewReader(encrypted), 0644)
 }
 
 // encryptFlagInit initializes the flagset for the encrypt command
 func encryptFlagInit(fs *flag.FlagSet) {
 	defaultKey := os.Getenv("GOSECRET_KEY")
 	fs.StringVar(&encryptKeyFlag, "key", defaultKey, "A 16, 24 or 32 byte key to use for encryption. Defaults to value in $GOSECRET_KEY")
+
+	defaultPassphrase := os.Getenv("GOSECRET_PASSPHRASE")
+	fs.StringVar(&encryptPassphraseFlag, "passphrase", defaultPassphrase, "A passphrase of any length to use instead of a key. Defaults to value in $GOSECRET_PASSPHRASE")
+
+	encryptStanzaFlagInit(fs)
+
+	fs.BoolVar(&encryptStructuredFlag, "structured", false, "Encrypt only the values of a YAML, JSON or dotenv file, keeping the keys readable")
+	fs.StringVar(&encryptFormatFlag, "format", "", "Format of a structured file: yaml, json or dotenv. Implies --structured. Use age or pgp to write an age file or OpenPGP message")
+
+	defaultPGPKeyring := os.Getenv("GOSECRET_PGP_KEYRING")
+	fs.StringVar(&encryptPGPKeyringFlag, "pgp-keyring", defaultPGPKeyring, "An OpenPGP keyring, as exported by gpg, to encrypt to with --format pgp. Defaults to value in $GOSECRET_PGP_KEYRING")
+}
+
+// encryptStanzaFlagInit initializes the flags for the other keys and
+// recipients a file is encrypted for, and the scrypt parameters of its
+// passphrase
+func encryptStanzaFlagInit(fs *flag.FlagSet) {
+	fs.Var(&encryptAddKeyFlag, "add-key", "Another 16, 24 or 32 byte master key that can decrypt the file. Can be repeated")
+
+	fs.Var(&encryptRecipientFlag, "recipient", "A public key from keygen that can decrypt the file. Can be repeated")
+
+	fs.IntVar(&encryptScryptLogNFlag, "scrypt-log-n", defaultScryptLogN, "Scrypt CPU/memory cost as a power of two, used with a passphrase")
+	fs.IntVar(&encryptScryptRFlag, "scrypt-r", defaultScryptR, "Scrypt block size, used with a passphrase")
+	fs.IntVar(&encryptScryptPFlag, "scrypt-p", defaultScryptP, "Scrypt parallelization, used with a passphrase")
+}
+
+// encryptFlagWriter returns an encrypting writer using the passphrase from
+// the flags if one was given, or the key otherwise. It writes an age file
+// with --format age and an OpenPGP message with --format pgp.
+func encryptFlagWriter(w io.Writer) (io.WriteCloser, error) {
+	if encryptFormatFlag == pgpFormat {
+		return encryptFlagPGPWriter(w)
+	}
+	if encryptFormatFlag == ageFormat {
+		h, fileKey, err := encryptFlagAgeHeader()
+		if err != nil {
+			return nil, err
+		}
+		return newAgeWriter(w, h, fileKey)
+	}
+
+	h, key, err := encryptFlagHeader()
+	if err != nil {
+		return nil, err
+	}
+	return newStreamWriter(w, h, key)
+}
+
+// encryptFlagHeader returns the header and data key for a new file. The data
+// key is wrapped by the passphrase from the flags if one was given, or the key
+// otherwise, and by any keys and recipients given with --add-key and
+// --recipient.
+func encryptFlagHeader() (*header, []byte, error) {
+	recipients, err := parseX25519Recipients(encryptRecipientFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &masterKeys{keys: encryptAddKeyFlag.bytes(), recipients: recipients}
+
+	if encryptPassphraseFlag != "" {
+		params, err := newScryptParams(encryptScryptLogNFlag, encryptScryptRFlag, encryptScryptPFlag)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.passphrase, m.scrypt = []byte(encryptPassphraseFlag), params
+	} else if encryptKeyFlag != "" || len(m.keys)+len(m.recipients) == 0 {
+		// an empty key is still used when there's nothing else, so the
+		// error says what's wrong with it
+		m.keys = append([][]byte{[]byte(encryptKeyFlag)}, m.keys...)
+	}
+	return newEnvelopeHeader(m)
+}
+
+// encryptFlagAgeHeader returns the header and file key for a new age file,
+// encrypted to the recipients or with the passphrase from the flags.
+func encryptFlagAgeHeader() (*ageHeader, []byte, error) {
+	if len(encryptAddKeyFlag) > 0 {
+		return nil, nil, errors.New("age files can't be encrypted with --add-key, please use --recipient or --passphrase")
+	}
+
+	recipients, err := parseX25519Recipients(encryptRecipientFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &masterKeys{recipients: recipients}
+
+	if encryptPassphraseFlag != "" {
+		params, err := newScryptParams(encryptScryptLogNFlag, encryptScryptRFlag, encryptScryptPFlag)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.passphrase, m.scrypt = []byte(encryptPassphraseFlag), params
+	}
+	return newAgeHeader(m)
+}
+
+// encryptFlagPGPWriter returns a writer of an OpenPGP message encrypted to
+// the keyring and passphrase from the flags.
+func encryptFlagPGPWriter(w io.Writer) (io.WriteCloser, error) {
+	if len(encryptAddKeyFlag) > 0 || len(encryptRecipientFlag) > 0 {
+		return nil, errors.New("OpenPGP messages can't be encrypted with --add-key or --recipient, please use --pgp-keyring or --passphrase")
+	}
+
+	var keys []*pgpKey
+	if encryptPGPKeyringFlag != "" {
+		contents, err := ioutil.ReadFile(encryptPGPKeyringFlag)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := readPGPKeyring(contents)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range certs {
+			key := cert.encryptionKey(time.Now())
+			if key == nil {
+				return nil, fmt.Errorf("OpenPGP key %s can't be encrypted to, it has expired, been revoked or has no encryption subkey", formatPGPKeyID(cert.primary.keyID()))
+			}
+			keys = append(keys, key)
+		}
+	}
+	return newPGPWriter(w, keys, []byte(encryptPassphraseFlag))
 }
 
 // encryptFlagPostParse sets filenames from the arguments provided by the flagset
@@ -64,24 +258,84 @@ func encryptFlagPostParse(fs *flag.FlagSet) {
 	encryptOutFilenameArg = fs.Arg(1)
 }
 
-// encrypt encryptes a message using a given key
+// encrypt encrypts a message using a given key. The result is a gosecret
+// header holding the wrapped data key, followed by the message sealed in
+// AES-GCM chunks under the data key.
 func encrypt(key, contents []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+	var b bytes.Buffer
+	w, err := newEncryptWriter(&b, key)
 	if err != nil {
 		return []byte{}, err
 	}
+	return finishEncrypt(&b, w, contents)
+}
 
-	ciphertext := make([]byte, aes.BlockSize+len(contents))
+// encryptWithPassphrase encrypts a message using a key derived from a
+// passphrase. The salt and cost parameters are stored in the header.
+func encryptWithPassphrase(passphrase []byte, params *scryptParams, contents []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := newPassphraseEncryptWriter(&b, passphrase, params)
+	if err != nil {
+		return []byte{}, err
+	}
+	return finishEncrypt(&b, w, contents)
+}
 
-	// set the initialization vector
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+// finishEncrypt writes contents to w and returns everything buffered in b.
+func finishEncrypt(b *bytes.Buffer, w io.WriteCloser, contents []byte) ([]byte, error) {
+	if _, err := w.Write(contents); err != nil {
+		return []byte{}, err
+	}
+	if err := w.Close(); err != nil {
 		return []byte{}, err
 	}
+	return b.Bytes(), nil
+}
+
+// newEncryptWriter writes a header to w and returns a writer that encrypts
+// into w with key. Closing it writes the final chunk but leaves w open.
+func newEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	h, key, err := newKeyHeader(key)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamWriter(w, h, key)
+}
+
+// newPassphraseEncryptWriter is like newEncryptWriter but uses a key derived
+// from a passphrase.
+func newPassphraseEncryptWriter(w io.Writer, passphrase []byte, params *scryptParams) (io.WriteCloser, error) {
+	h, key, err := newPassphraseHeader(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamWriter(w, h, key)
+}
 
-	// encrypt it
-	cfb := cipher.NewCFBEncrypter(block, iv)
-	cfb.XORKeyStream(ciphertext[aes.BlockSize:], contents)
+// newKeyHeader returns a header for a new file with its data key wrapped by
+// key, along with the data key.
+func newKeyHeader(key []byte) (*header, []byte, error) {
+	return newEnvelopeHeader(&masterKeys{keys: [][]byte{key}})
+}
+
+// newPassphraseHeader returns a header for a new file with its data key
+// wrapped by a key derived from passphrase, along with the data key.
+func newPassphraseHeader(passphrase []byte, params *scryptParams) (*header, []byte, error) {
+	return newEnvelopeHeader(&masterKeys{passphrase: passphrase, scrypt: params})
+}
 
-	return ciphertext, nil
+// newHeader returns a header for a new file with a random nonce and no
+// stanzas yet.
+func newHeader() (*header, error) {
+	h := &header{
+		version:   formatVersion,
+		algorithm: algAESGCM,
+		chunkSize: defaultChunkSize,
+		nonce:     make([]byte, streamNonceSize),
+		created:   time.Now().Unix(),
+	}
+	if _, err := io.ReadFull(rand.Reader, h.nonce); err != nil {
+		return nil, err
+	}
+	return h, nil
 }
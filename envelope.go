@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Version 4 files are encrypted with a random data key. The data key is
+// wrapped by each master key that should be able to decrypt the file, and
+// the wrapped copies are stored in the header as stanzas. The body is sealed
+// with only the fixed part of the header as additional data, so rewrapping
+// can replace the stanzas without touching the body. The stanzas are instead
+// covered by a MAC keyed with the data key at the end of the header.
+
+// stanza types stored in the header
+const (
+	stanzaKey    = 1
+	stanzaScrypt = 2
+	stanzaX25519 = 3
+)
+
+const (
+	dataKeySize    = 32
+	keyIDSize      = 8
+	wrapNonceSize  = 12
+	wrappedKeySize = wrapNonceSize + dataKeySize + 16
+	headerMACSize  = sha256.Size
+)
+
+// stanza is a copy of the data key wrapped by one master key.
+type stanza struct {
+	kind byte
+
+	// set when kind is stanzaKey, or the recipient ID for stanzaX25519
+	keyID []byte
+	// set when kind is stanzaScrypt
+	scrypt *scryptParams
+
+	// the wrapped data key, or the whole body of a stanza of unknown kind
+	body []byte
+}
+
+// keyID returns the non-secret identifier of a master key.
+func keyID(key []byte) []byte {
+	return hkdfSHA256(key, nil, "gosecret key id")[:keyIDSize]
+}
+
+// formatKeyID returns the printable form of a key ID.
+func formatKeyID(id []byte) string {
+	return hex.EncodeToString(id)
+}
+
+// marshal encodes the stanza as its kind byte and the length of its body,
+// followed by the body.
+func (s *stanza) marshal() []byte {
+	var body []byte
+	switch s.kind {
+	case stanzaKey, stanzaX25519:
+		body = append(append(body, s.keyID...), s.body...)
+	case stanzaScrypt:
+		body = append(append(body, s.scrypt.salt...), s.scrypt.logN, s.scrypt.r, s.scrypt.p)
+		body = append(body, s.body...)
+	default:
+		body = s.body
+	}
+
+	b := []byte{s.kind, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(body)))
+	return append(b, body...)
+}
+
+// readStanza reads and decodes the next stanza from r. Stanzas of unknown
+// kinds are kept as they are so rewrapping doesn't drop them.
+func readStanza(r io.Reader) (*stanza, error) {
+	var fixed [3]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, errBadHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[1:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errBadHeader
+	}
+
+	s := &stanza{kind: fixed[0]}
+	switch s.kind {
+	case stanzaKey:
+		if len(body) != keyIDSize+wrappedKeySize {
+			return nil, errBadHeader
+		}
+		s.keyID, s.body = body[:keyIDSize], body[keyIDSize:]
+	case stanzaX25519:
+		if len(body) != x25519BodySize {
+			return nil, errBadHeader
+		}
+		s.keyID, s.body = body[:keyIDSize], body[keyIDSize:]
+	case stanzaScrypt:
+		if len(body) != scryptSaltSize+3+wrappedKeySize {
+			return nil, errBadHeader
+		}
+		s.scrypt = &scryptParams{
+			salt: body[:scryptSaltSize],
+			logN: body[scryptSaltSize],
+			r:    body[scryptSaltSize+1],
+			p:    body[scryptSaltSize+2],
+		}
+		s.body = body[scryptSaltSize+3:]
+	default:
+		s.body = body
+	}
+	return s, nil
+}
+
+// newWrapAEAD returns the cipher that wraps the data key of a file with
+// header h under a master key.
+func newWrapAEAD(h *header, masterKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdfSHA256(masterKey, h.nonce, "gosecret wrap"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapDataKey seals dataKey under masterKey for a file with header h.
+func wrapDataKey(h *header, masterKey, dataKey []byte) ([]byte, error) {
+	aead, err := newWrapAEAD(h, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, wrapNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, h.fixed()), nil
+}
+
+// unwrapDataKey opens a data key wrapped by wrapDataKey.
+func unwrapDataKey(h *header, masterKey, wrapped []byte) ([]byte, error) {
+	aead, err := newWrapAEAD(h, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := aead.Open(nil, wrapped[:wrapNonceSize], wrapped[wrapNonceSize:], h.fixed())
+	if err != nil {
+		return nil, errAuthFailed
+	}
+	return dataKey, nil
+}
+
+// newKeyStanza wraps dataKey under key.
+func newKeyStanza(h *header, key, dataKey []byte) (*stanza, error) {
+	// master keys are stretched to 256 bits, so check the size here
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := wrapDataKey(h, key, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &stanza{kind: stanzaKey, keyID: keyID(key), body: wrapped}, nil
+}
+
+// newScryptStanza wraps dataKey under a key derived from passphrase.
+func newScryptStanza(h *header, passphrase []byte, params *scryptParams, dataKey []byte) (*stanza, error) {
+	key, err := params.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := wrapDataKey(h, key, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &stanza{kind: stanzaScrypt, scrypt: params, body: wrapped}, nil
+}
+
+// masterKeys are the keys a new data key is wrapped with.
+type masterKeys struct {
+	keys       [][]byte
+	recipients []*x25519Recipient
+
+	// the passphrase is used when scrypt is set
+	passphrase []byte
+	scrypt     *scryptParams
+}
+
+// credentials are the keys decrypt tries to unwrap a data key with.
+type credentials struct {
+	key        []byte
+	passphrase []byte
+	identities []*x25519Identity
+	pgpKeys    []*pgpKey
+	// named keys tried along with key
+	keyring []*namedKey
+}
+
+// masterKey returns the key or the key from the keyring whose ID is id, or
+// nil if neither matches.
+func (c *credentials) masterKey(id []byte) []byte {
+	if len(c.key) > 0 && bytes.Equal(keyID(c.key), id) {
+		return c.key
+	}
+	for _, k := range c.keyring {
+		if bytes.Equal(keyID(k.key), id) {
+			return k.key
+		}
+	}
+	return nil
+}
+
+// addStanzas wraps dataKey under each of the master keys and adds the results
+// to h.
+func (h *header) addStanzas(dataKey []byte, m *masterKeys) error {
+	for _, key := range m.keys {
+		s, err := newKeyStanza(h, key, dataKey)
+		if err != nil {
+			return err
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+
+	for _, recipient := range m.recipients {
+		s, err := newX25519Stanza(h, recipient, dataKey)
+		if err != nil {
+			return err
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+
+	if m.scrypt != nil {
+		s, err := newScryptStanza(h, m.passphrase, m.scrypt, dataKey)
+		if err != nil {
+			return err
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+	return nil
+}
+
+// headerMAC returns the MAC over everything in h before the MAC itself.
+func (h *header) headerMAC(dataKey []byte) []byte {
+	mac := hmac.New(sha256.New, hkdfSHA256(dataKey, h.nonce, "gosecret header"))
+	mac.Write(h.macInput())
+	return mac.Sum(nil)
+}
+
+// seal sets the MAC of h once all of its stanzas are in place.
+func (h *header) seal(dataKey []byte) error {
+	if len(h.stanzas) == 0 {
+		return errors.New("Please provide at least one key or passphrase to encrypt with")
+	}
+	if len(h.stanzas) > 255 {
+		return errors.New("A file can't be encrypted for more than 255 keys")
+	}
+	h.mac = h.headerMAC(dataKey)
+	return nil
+}
+
+// newEnvelopeHeader returns a header for a new file along with the random data
+// key to encrypt it with. The data key is wrapped under each of the master
+// keys.
+func newEnvelopeHeader(m *masterKeys) (*header, []byte, error) {
+	h, err := newHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, err
+	}
+
+	if err := h.addStanzas(dataKey, m); err != nil {
+		return nil, nil, err
+	}
+	if err := h.seal(dataKey); err != nil {
+		return nil, nil, err
+	}
+	return h, dataKey, nil
+}
+
+// unwrapHeader returns the data key of a version 4 file, unwrapped with
+// whichever of the credentials matches one of the stanzas.
+func unwrapHeader(h *header, c *credentials) ([]byte, error) {
+	var hasScrypt, hasX25519 bool
+	var keyIDs [][]byte
+	for _, s := range h.stanzas {
+		if s.kind == stanzaKey {
+			keyIDs = append(keyIDs, s.keyID)
+		}
+		hasScrypt = hasScrypt || s.kind == stanzaScrypt
+		hasX25519 = hasX25519 || s.kind == stanzaX25519
+	}
+	hasKey := len(keyIDs) > 0
+
+	if len(c.key) > 0 {
+		if _, err := aes.NewCipher(c.key); err != nil {
+			return nil, err
+		}
+	}
+
+	keyMatched := false
+	for _, s := range h.stanzas {
+		var dataKey []byte
+		var err error
+		switch {
+		case s.kind == stanzaKey && c.masterKey(s.keyID) != nil:
+			keyMatched = true
+			dataKey, err = unwrapDataKey(h, c.masterKey(s.keyID), s.body)
+		case s.kind == stanzaScrypt && len(c.passphrase) > 0:
+			derived, derr := s.scrypt.deriveKey(c.passphrase)
+			if derr != nil {
+				return nil, derr
+			}
+			dataKey, err = unwrapDataKey(h, derived, s.body)
+		case s.kind == stanzaX25519:
+			err = errAuthFailed
+			for _, identity := range c.identities {
+				if bytes.Equal(s.keyID, identity.recipient().id()) {
+					dataKey, err = unwrapX25519Stanza(h, s, identity)
+					break
+				}
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if !hmac.Equal(h.mac, h.headerMAC(dataKey)) {
+			return nil, errAuthFailed
+		}
+		return dataKey, nil
+	}
+
+	// name what's needed when nothing given applies to this file
+	var needed []string
+	if hasKey {
+		needed = append(needed, "a key with --key, --keyring, $GOSECRET_KEY or $GOSECRET_KEYRING")
+	}
+	if hasScrypt {
+		needed = append(needed, "a passphrase with --passphrase or $GOSECRET_PASSPHRASE")
+	}
+	if hasX25519 {
+		needed = append(needed, "an identity file with --identity or $GOSECRET_IDENTITY")
+	}
+	givenKeys := hasKey && (len(c.key) > 0 || len(c.keyring) > 0)
+	otherApplicable := (hasScrypt && len(c.passphrase) > 0) || (hasX25519 && len(c.identities) > 0)
+
+	switch {
+	case len(needed) == 0:
+		return nil, errors.New("File was encrypted with a kind of key this version of gosecret doesn't support")
+	case givenKeys && !keyMatched && !otherApplicable:
+		// the key IDs tell which keys would have worked
+		return nil, &missingKeyError{ids: keyIDs}
+	case !givenKeys && !otherApplicable:
+		return nil, fmt.Errorf("File can't be decrypted with what was given, please provide %s", strings.Join(needed, " or "))
+	}
+	return nil, errAuthFailed
+}
+
+// rewrap returns a copy of h whose stanzas wrap dataKey under each of the
+// master keys. The existing stanzas are kept when keep is set. The nonce and
+// chunk size are unchanged, so the copy is valid for the same body.
+func (h *header) rewrap(dataKey []byte, m *masterKeys, keep bool) (*header, error) {
+	rewrapped := *h
+	rewrapped.stanzas = nil
+	if keep {
+		rewrapped.stanzas = append(rewrapped.stanzas, h.stanzas...)
+	}
+
+	if err := rewrapped.addStanzas(dataKey, m); err != nil {
+		return nil, err
+	}
+	if err := rewrapped.seal(dataKey); err != nil {
+		return nil, err
+	}
+	return &rewrapped, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// flags and args. exec also takes the decrypt flags for the key, passphrase
+// and format of the secrets file.
+var execFileFlag string
+var execBucketNameFlag string
+var execAccessKeyFlag string
+var execSecretKeyFlag string
+var execSessionTokenFlag string
+var execRegionFlag string
+var execEndpointFlag string
+var execPathStyleFlag bool
+var execCABundleFlag string
+var execMaxAttemptsFlag int
+var execRetryDelayFlag time.Duration
+var execRetryMaxDelayFlag time.Duration
+var execCommandArgs []string
+
+var execDoc = `
+Usage: exec [options] --file secrets -- command [args]
+
+Decrypt a dotenv, YAML or JSON file of secrets and run a command with them
+added to its environment. The plaintext is only ever held in memory.
+
+Files encrypted whole and files encrypted with --structured both work. The
+format is guessed from the file extension, ignoring .enc, unless --format is
+given. Nested keys are joined with underscores, so database: {password: x}
+becomes database_password=x.
+
+With --bucket the secrets file is read from that S3 bucket instead of disk.
+Signals are passed on to the command and gosecret exits with its exit code.
+SIGINT and SIGQUIT aren't, as pressing Ctrl-C or Ctrl-\ sends them to the
+command already.
+`
+
+// exitError is returned by actions that need gosecret to exit with a
+// specific status.
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+func execAction() error {
+	// make sure that we have all of the required data
+	if execFileFlag == "" {
+		return errors.New("Please provide a secrets file with --file")
+	}
+	if len(execCommandArgs) == 0 {
+		return errors.New("Please provide a command to run after --")
+	}
+
+	format, err := structuredFormat(execFileFlag, decryptFormatFlag)
+	if err != nil {
+		return err
+	}
+
+	var config *s3util.Config
+	if execBucketNameFlag != "" {
+		if execAccessKeyFlag == "" {
+			return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+		}
+		if execSecretKeyFlag == "" {
+			return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+		}
+		config = newS3Config(execAccessKeyFlag, execSecretKeyFlag, execSessionTokenFlag, execRegionFlag)
+		if err := setS3Endpoint(config, execEndpointFlag, execPathStyleFlag, execCABundleFlag); err != nil {
+			return err
+		}
+		if err := setS3Retry(config, execMaxAttemptsFlag, execRetryDelayFlag, execRetryMaxDelayFlag); err != nil {
+			return err
+		}
+	}
+
+	contents, err := readExecFile(config)
+	if err != nil {
+		return err
+	}
+
+	c, err := decryptFlagCredentials()
+	if err != nil {
+		return err
+	}
+	env, err := secretsEnv(format, contents, c, decryptStructuredFlag)
+	if err != nil {
+		return err
+	}
+	return runWithEnv(execCommandArgs, append(os.Environ(), env...))
+}
+
+// execFlagInit initializes the flagset for the exec command
+func execFlagInit(fs *flag.FlagSet) {
+	decryptFlagInit(fs)
+
+	fs.StringVar(&execFileFlag, "file", "", "The encrypted file of secrets to add to the environment")
+	fs.StringVar(&execBucketNameFlag, "bucket", "", "Read the secrets file from this S3 bucket instead of a local file")
+
+	defaultAccessKey := os.Getenv("GOSECRET_ACCESS_KEY")
+	fs.StringVar(&execAccessKeyFlag, "access-key", defaultAccessKey, "S3 Access Key. Defaults to value in $GOSECRET_ACCESS_KEY")
+
+	defaultSecretKey := os.Getenv("GOSECRET_SECRET_KEY")
+	fs.StringVar(&execSecretKeyFlag, "secret-key", defaultSecretKey, "S3 Secret Key. Defaults to value in $GOSECRET_SECRET_KEY")
+
+	defaultSessionToken := os.Getenv("GOSECRET_SESSION_TOKEN")
+	fs.StringVar(&execSessionTokenFlag, "session-token", defaultSessionToken, "S3 session token for temporary credentials. Defaults to value in $GOSECRET_SESSION_TOKEN")
+
+	defaultRegion := os.Getenv("GOSECRET_REGION")
+	fs.StringVar(&execRegionFlag, "region", defaultRegion, "AWS region of the S3 bucket. Defaults to value in $GOSECRET_REGION, or us-east-1")
+
+	defaultEndpoint := os.Getenv("GOSECRET_ENDPOINT")
+	fs.StringVar(&execEndpointFlag, "endpoint", defaultEndpoint, "URL of an S3-compatible service to use instead of AWS. Defaults to value in $GOSECRET_ENDPOINT")
+
+	defaultPathStyle, _ := strconv.ParseBool(os.Getenv("GOSECRET_PATH_STYLE"))
+	fs.BoolVar(&execPathStyleFlag, "path-style", defaultPathStyle, "Put the bucket in the URL path instead of the host name. Defaults to value in $GOSECRET_PATH_STYLE")
+
+	defaultCABundle := os.Getenv("GOSECRET_CA_BUNDLE")
+	fs.StringVar(&execCABundleFlag, "ca-bundle", defaultCABundle, "PEM file of the certificates to trust for the S3 endpoint. Defaults to value in $GOSECRET_CA_BUNDLE")
+
+	defaultMaxAttempts, defaultRetryDelay, defaultRetryMaxDelay := s3RetryDefaults()
+	fs.IntVar(&execMaxAttemptsFlag, "max-attempts", defaultMaxAttempts, "Times to try each S3 request that fails with a transient error. Defaults to value in $GOSECRET_MAX_ATTEMPTS, or 5")
+	fs.DurationVar(&execRetryDelayFlag, "retry-delay", defaultRetryDelay, "Wait before retrying a failed S3 request, doubled for each retry after. Defaults to value in $GOSECRET_RETRY_DELAY, or 100ms")
+	fs.DurationVar(&execRetryMaxDelayFlag, "retry-max-delay", defaultRetryMaxDelay, "Longest wait between tries of an S3 request. Defaults to value in $GOSECRET_RETRY_MAX_DELAY, or 20s")
+}
+
+// execFlagPostParse sets the command to run from the arguments provided by the flagset
+func execFlagPostParse(fs *flag.FlagSet) {
+	execCommandArgs = fs.Args()
+}
+
+// readExecFile reads the secrets file from S3 if config is set, or from disk
+// otherwise.
+func readExecFile(config *s3util.Config) ([]byte, error) {
+	if config == nil {
+		return ioutil.ReadFile(execFileFlag)
+	}
+
+	s3File, err := openS3File(execBucketNameFlag, execFileFlag, config)
+	if err != nil {
+		return nil, err
+	}
+	defer s3File.Close()
+	return ioutil.ReadAll(s3File)
+}
+
+// secretsEnv decrypts a secrets file in format and returns its values as
+// NAME=value pairs. Files encrypted with --structured are recognised by their
+// metadata if structured isn't set, everything else is decrypted as a whole.
+func secretsEnv(format string, contents []byte, c *credentials, structured bool) ([]string, error) {
+	if !structured && !hasHeader(contents) {
+		if doc, err := structuredFormats[format](contents); err == nil {
+			_, _, structured = doc.takeMetadata()
+		}
+	}
+
+	var plaintext []byte
+	var err error
+	if structured {
+		plaintext, err = decryptStructured(format, contents, c)
+	} else {
+		var r io.Reader
+		if r, err = newDecryptReader(bytes.NewReader(contents), c); err == nil {
+			plaintext, err = ioutil.ReadAll(r)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := structuredFormats[format](plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	err = doc.eachLeaf(func(path []string, value string) error {
+		name := strings.Join(path, "_")
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("%s can't be used as an environment variable name", name)
+		}
+		env = append(env, name+"="+value)
+		return nil
+	})
+	return env, err
+}
+
+// runWithEnv runs args[0] with env, passing signals other than SIGINT and
+// SIGQUIT on to it until it exits.
+// A non zero exit is returned as an exitError with the same code, or 128 plus
+// the signal number when the command was killed by a signal.
+func runWithEnv(args []string, env []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				// the terminal sends SIGINT and SIGQUIT to the command as
+				// well, so they only need keeping from killing gosecret
+				if sig != os.Interrupt && sig != syscall.SIGQUIT {
+					cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status := exitErr.Sys().(syscall.WaitStatus)
+		if status.Signaled() {
+			return &exitError{code: 128 + int(status.Signal())}
+		}
+		return &exitError{code: status.ExitStatus()}
+	}
+	return err
+}
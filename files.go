@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes everything read from r to filename with the given
+// permissions. The data goes to a temp file in the same directory that is
+// renamed over filename once complete, so a failed read never leaves a
+// partial file behind.
+func writeFileAtomic(filename string, r io.Reader, perm os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	err = func() error {
+		defer tmpFile.Close()
+		if err := tmpFile.Chmod(perm); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tmpFile, r); err != nil {
+			return err
+		}
+		if err := tmpFile.Sync(); err != nil {
+			return err
+		}
+		return tmpFile.Close()
+	}()
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+// createSecureTempFile creates a temp file only readable by the current user.
+// The /dev/shm tmpfs is preferred where it exists so plaintext is never
+// written to a disk.
+func createSecureTempFile(pattern string) (*os.File, error) {
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		if f, err := ioutil.TempFile("/dev/shm", pattern); err == nil {
+			return f, nil
+		}
+	}
+	return ioutil.TempFile("", pattern)
+}
+
+// shredFile overwrites filename with zeros before removing it.
+func shredFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return os.Remove(filename)
+	}
+
+	if fi, err := f.Stat(); err == nil {
+		io.CopyN(f, zeroReader{}, fi.Size())
+		f.Sync()
+	}
+	f.Close()
+	return os.Remove(filename)
+}
+
+// zeroReader is an endless source of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
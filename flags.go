@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+)
+
+// stringsFlag is a flag that can be given more than once, collecting every
+// value in order.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// bytes returns the values as byte slices.
+func (s stringsFlag) bytes() [][]byte {
+	b := make([][]byte, len(s))
+	for i, value := range s {
+		b[i] = []byte(value)
+	}
+	return b
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// formatMagic starts every file written in the gosecret format. Files that
+// don't start with it are treated as legacy AES-CFB ciphertext.
+var formatMagic = []byte("GOSECRET")
+
+// formatVersion is the version of the file format written by encrypt.
+// Version 1 and 2 files hold a single AES-GCM message instead of a stream,
+// and version 3 files are encrypted with the key itself rather than a
+// wrapped data key. Version 4 files don't record when they were encrypted.
+// All of them are still readable.
+const formatVersion = 5
+
+// algorithm identifiers stored in the header
+const (
+	algAESGCM = 1
+)
+
+const (
+	// streamNonceSize is the size of the random value each file's payload key
+	// is derived from.
+	streamNonceSize = 16
+
+	defaultChunkSize = 64 * 1024
+	minChunkSize     = 1024
+	maxChunkSize     = 16 * 1024 * 1024
+)
+
+var errAuthFailed = errors.New("Authentication failed: the key is wrong or the file has been tampered with")
+var errBadHeader = errors.New("File doesn't have a valid gosecret header")
+
+// header is the cleartext header at the start of an encrypted file. It is
+// authenticated along with the body, so changing it breaks decryption.
+type header struct {
+	version   byte
+	algorithm byte
+	kdf       byte
+
+	// set when kdf is kdfScrypt
+	scrypt *scryptParams
+
+	// set for version 3 and later
+	chunkSize uint32
+	nonce     []byte
+
+	// set for version 4 and later, replacing kdf and scrypt
+	stanzas []*stanza
+	mac     []byte
+
+	// set for version 5 and later, the Unix time the file was encrypted
+	created int64
+}
+
+// marshal encodes the header. Up to version 3 it is the magic, version byte,
+// algorithm byte and key derivation byte, followed by the salt and cost
+// parameters for scrypt and finally the chunk size and nonce of the stream.
+// From version 4 it is the magic, version byte, algorithm byte, chunk size
+// and nonce, followed by a count of stanzas, the stanzas and the header MAC.
+// Version 5 adds the creation time after the nonce.
+func (h *header) marshal() []byte {
+	if h.version >= 4 {
+		return append(h.macInput(), h.mac...)
+	}
+
+	b := append([]byte{}, formatMagic...)
+	b = append(b, h.version, h.algorithm)
+	if h.version < 2 {
+		return b
+	}
+
+	b = append(b, h.kdf)
+	if h.kdf == kdfScrypt {
+		b = append(b, h.scrypt.salt...)
+		b = append(b, h.scrypt.logN, h.scrypt.r, h.scrypt.p)
+	}
+	if h.version < 3 {
+		return b
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], h.chunkSize)
+	b = append(b, size[:]...)
+	return append(b, h.nonce...)
+}
+
+// fixed encodes the part of a version 4 header that stays the same when the
+// file is rewrapped.
+func (h *header) fixed() []byte {
+	b := append([]byte{}, formatMagic...)
+	b = append(b, h.version, h.algorithm)
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], h.chunkSize)
+	b = append(b, size[:]...)
+	b = append(b, h.nonce...)
+	if h.version >= 5 {
+		var created [8]byte
+		binary.BigEndian.PutUint64(created[:], uint64(h.created))
+		b = append(b, created[:]...)
+	}
+	return b
+}
+
+// macInput encodes everything in a version 4 header before the MAC.
+func (h *header) macInput() []byte {
+	b := append(h.fixed(), byte(len(h.stanzas)))
+	for _, s := range h.stanzas {
+		b = append(b, s.marshal()...)
+	}
+	return b
+}
+
+// payloadAAD returns the additional data the chunks of the body are sealed
+// with. Older versions use the whole header.
+func (h *header) payloadAAD() []byte {
+	if h.version >= 4 {
+		return h.fixed()
+	}
+	return h.marshal()
+}
+
+// hasHeader reports whether contents start with the gosecret magic string.
+func hasHeader(contents []byte) bool {
+	return bytes.HasPrefix(contents, formatMagic)
+}
+
+// peekHeader reports whether the next bytes in r are the gosecret magic
+// string without consuming them.
+func peekHeader(r *bufio.Reader) bool {
+	b, _ := r.Peek(len(formatMagic))
+	return hasHeader(b)
+}
+
+// parseHeader decodes the header at the start of contents and returns it
+// along with the rest of the file.
+func parseHeader(contents []byte) (*header, []byte, error) {
+	r := bytes.NewReader(contents)
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, contents[len(contents)-r.Len():], nil
+}
+
+// readHeader reads and decodes the header at the start of r, leaving r
+// positioned at the start of the body.
+func readHeader(r io.Reader) (*header, error) {
+	magic := make([]byte, len(formatMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !hasHeader(magic) {
+		return nil, errBadHeader
+	}
+
+	var fixed [2]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, errBadHeader
+	}
+	h := &header{version: fixed[0], algorithm: fixed[1]}
+	if h.version < 1 || h.version > formatVersion {
+		return nil, fmt.Errorf("Unsupported file format version %d", h.version)
+	}
+	if h.algorithm != algAESGCM {
+		return nil, fmt.Errorf("Unsupported encryption algorithm %d", h.algorithm)
+	}
+	if h.version >= 4 {
+		return h, readEnvelope(r, h)
+	}
+	if h.version < 2 {
+		return h, nil
+	}
+
+	if _, err := io.ReadFull(r, fixed[:1]); err != nil {
+		return nil, errBadHeader
+	}
+	h.kdf = fixed[0]
+
+	switch h.kdf {
+	case kdfNone:
+	case kdfScrypt:
+		params := make([]byte, scryptSaltSize+3)
+		if _, err := io.ReadFull(r, params); err != nil {
+			return nil, errBadHeader
+		}
+		h.scrypt = &scryptParams{
+			salt: params[:scryptSaltSize],
+			logN: params[scryptSaltSize],
+			r:    params[scryptSaltSize+1],
+			p:    params[scryptSaltSize+2],
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation function %d", h.kdf)
+	}
+	if h.version < 3 {
+		return h, nil
+	}
+
+	return h, readStream(r, h)
+}
+
+// readStream reads the chunk size and nonce of the stream into h.
+func readStream(r io.Reader, h *header) error {
+	stream := make([]byte, 4+streamNonceSize)
+	if _, err := io.ReadFull(r, stream); err != nil {
+		return errBadHeader
+	}
+	h.chunkSize = binary.BigEndian.Uint32(stream)
+	h.nonce = stream[4:]
+	if h.chunkSize < minChunkSize || h.chunkSize > maxChunkSize {
+		return fmt.Errorf("Chunk size must be between %d and %d bytes, got %d", minChunkSize, maxChunkSize, h.chunkSize)
+	}
+	return nil
+}
+
+// readEnvelope reads the rest of a version 4 or 5 header into h.
+func readEnvelope(r io.Reader, h *header) error {
+	if err := readStream(r, h); err != nil {
+		return err
+	}
+	if h.version >= 5 {
+		var created [8]byte
+		if _, err := io.ReadFull(r, created[:]); err != nil {
+			return errBadHeader
+		}
+		h.created = int64(binary.BigEndian.Uint64(created[:]))
+	}
+
+	var count [1]byte
+	if _, err := io.ReadFull(r, count[:]); err != nil || count[0] == 0 {
+		return errBadHeader
+	}
+	for i := 0; i < int(count[0]); i++ {
+		s, err := readStanza(r)
+		if err != nil {
+			return err
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+
+	h.mac = make([]byte, headerMACSize)
+	if _, err := io.ReadFull(r, h.mac); err != nil {
+		return errBadHeader
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// args. history takes the download flags for the bucket and AWS keys, so it
+// shares their variables.
+var historyFilenameArg string
+
+var historyDoc = `
+Usage: history [options] file
+
+List the versions of a file in the --bucket, newest first, with when each
+was uploaded and by whom. The bucket needs versioning turned on to keep
+older versions.
+
+A version can be downloaded with download --version-id, or made the latest
+version again with rollback.
+`
+
+func historyAction() error {
+	// make sure that we have all of the required data
+	if historyFilenameArg == "" {
+		return errors.New("Please provide a valid filename to list the versions of")
+	}
+	if downloadBucketNameFlag == "" {
+		return errors.New("Please provide an S3 bucket name with --bucket or $GOSECRET_BUCKET")
+	}
+	if downloadAccessKeyFlag == "" {
+		return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+	}
+	if downloadSecretKeyFlag == "" {
+		return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+	}
+
+	config := newS3Config(downloadAccessKeyFlag, downloadSecretKeyFlag, downloadSessionTokenFlag, downloadRegionFlag)
+	if err := setS3Endpoint(config, downloadEndpointFlag, downloadPathStyleFlag, downloadCABundleFlag); err != nil {
+		return err
+	}
+	if err := setS3Retry(config, downloadMaxAttemptsFlag, downloadRetryDelayFlag, downloadRetryMaxDelayFlag); err != nil {
+		return err
+	}
+
+	versions, err := s3History(downloadBucketNameFlag, historyFilenameArg, config)
+	if err != nil {
+		return err
+	}
+	return writeHistory(os.Stdout, versions)
+}
+
+// historyFlagInit initializes the flagset for the history command
+func historyFlagInit(fs *flag.FlagSet) {
+	downloadFlagInit(fs)
+}
+
+// historyFlagPostParse sets the filename from the arguments provided by the flagset
+func historyFlagPostParse(fs *flag.FlagSet) {
+	historyFilenameArg = fs.Arg(0)
+}
+
+// s3History returns the versions and delete markers of name in an s3
+// bucket, newest first.
+func s3History(bucket, name string, config *s3util.Config) ([]s3util.Version, error) {
+	all, err := s3util.ListVersions(generateS3Url(bucket, ""), name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the listing is by prefix, so other files can start with name
+	var versions []s3util.Version
+	for _, v := range all {
+		if v.Key == name {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("No versions of %s were found", name)
+	}
+	return versions, nil
+}
+
+// writeHistory writes a line to w for each version with its ID, when it was
+// uploaded, its size and owner, and whether it is the latest version or a
+// delete marker.
+func writeHistory(w io.Writer, versions []s3util.Version) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, v := range versions {
+		modified := v.LastModified
+		if t, err := time.Parse(time.RFC3339Nano, v.LastModified); err == nil {
+			modified = t.UTC().Format(time.RFC3339)
+		}
+		owner := v.OwnerName
+		if owner == "" {
+			owner = v.OwnerID
+		}
+		if owner == "" {
+			owner = "-"
+		}
+
+		size := v.Size
+		var notes []string
+		if v.IsLatest {
+			notes = append(notes, "latest")
+		}
+		if v.IsDeleteMarker() {
+			size = "-"
+			notes = append(notes, "delete marker")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s", v.VersionId, modified, size, owner)
+		if len(notes) > 0 {
+			fmt.Fprintf(tw, "\t%s", strings.Join(notes, ", "))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
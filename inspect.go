@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// flags and args. inspect takes the download flags for the bucket and AWS
+// keys when --s3 is given, so it shares their variables.
+var inspectJSONFlag bool
+var inspectS3Flag bool
+var inspectFilenameArg string
+
+var inspectDoc = `
+Usage: inspect [options] file
+
+Print what the header of an encrypted file says without decrypting it: the
+format and its version, the algorithm, the IDs of the keys and recipients
+it was encrypted for, the key derivation parameters of passphrases, the
+chunk size, an estimate of the plaintext length and when it was encrypted.
+No keys are needed.
+
+Files encrypted before version 5 of the format don't record when they were
+encrypted, and files without a header are reported as legacy AES-CFB files,
+which aren't authenticated.
+
+With --s3 the file is an object in the --bucket, and only its header is
+downloaded. Use --json for output meant for scripts.
+`
+
+// inspectHeaderSize is how much of a file is read to inspect its header.
+// Larger headers, armored OpenPGP messages and structured files are read in
+// full.
+const inspectHeaderSize = 64 * 1024
+
+func inspectAction() error {
+	// make sure that we have all of the required data
+	if inspectFilenameArg == "" {
+		return errors.New("Please provide a valid filename to inspect")
+	}
+
+	readPrefix := func(n int64) ([]byte, int64, error) {
+		return readFilePrefix(inspectFilenameArg, n)
+	}
+	if inspectS3Flag {
+		if downloadBucketNameFlag == "" {
+			return errors.New("Please provide an S3 bucket name with --bucket or $GOSECRET_BUCKET")
+		}
+		if downloadAccessKeyFlag == "" {
+			return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+		}
+		if downloadSecretKeyFlag == "" {
+			return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+		}
+		config := newS3Config(downloadAccessKeyFlag, downloadSecretKeyFlag, downloadSessionTokenFlag, downloadRegionFlag)
+		if err := setS3Endpoint(config, downloadEndpointFlag, downloadPathStyleFlag, downloadCABundleFlag); err != nil {
+			return err
+		}
+		if err := setS3Retry(config, downloadMaxAttemptsFlag, downloadRetryDelayFlag, downloadRetryMaxDelayFlag); err != nil {
+			return err
+		}
+		readPrefix = func(n int64) ([]byte, int64, error) {
+			return readS3Prefix(downloadBucketNameFlag, inspectFilenameArg, n, config)
+		}
+	}
+
+	info, err := inspectFile(inspectFilenameArg, readPrefix)
+	if err != nil {
+		return err
+	}
+
+	if inspectJSONFlag {
+		b, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("%s\n", b)
+		return err
+	}
+	_, err = io.WriteString(os.Stdout, info.String())
+	return err
+}
+
+// inspectFlagInit initializes the flagset for the inspect command
+func inspectFlagInit(fs *flag.FlagSet) {
+	downloadFlagInit(fs)
+
+	fs.BoolVar(&inspectJSONFlag, "json", false, "Print the metadata as JSON")
+	fs.BoolVar(&inspectS3Flag, "s3", false, "Inspect an object in the S3 bucket instead of a local file")
+}
+
+// inspectFlagPostParse sets the filename from the arguments provided by the flagset
+func inspectFlagPostParse(fs *flag.FlagSet) {
+	inspectFilenameArg = fs.Arg(0)
+}
+
+// readFilePrefix returns up to n bytes from the start of a local file, or all
+// of it when n is negative, along with its size.
+func readFilePrefix(name string, n int64) ([]byte, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if n < 0 {
+		n = fi.Size()
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(f, n))
+	return contents, fi.Size(), err
+}
+
+// readS3Prefix returns up to n bytes from the start of an object in an s3
+// bucket, or all of it when n is negative, along with its size. Only the
+// bytes asked for are downloaded.
+func readS3Prefix(bucket, name string, n int64, config *s3util.Config) ([]byte, int64, error) {
+	if n < 0 {
+		s3File, err := openS3File(bucket, name, config)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer s3File.Close()
+		contents, err := ioutil.ReadAll(s3File)
+		return contents, int64(len(contents)), err
+	}
+
+	s3File, size, err := openS3FileRange(bucket, name, 0, n, config)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer s3File.Close()
+	contents, err := ioutil.ReadAll(io.LimitReader(s3File, n))
+	return contents, size, err
+}
+
+// inspectFile inspects the file called name, reading as little of it as it
+// can with readPrefix.
+func inspectFile(name string, readPrefix func(n int64) ([]byte, int64, error)) (*inspectInfo, error) {
+	n := int64(inspectHeaderSize)
+	if _, err := structuredFormat(name, ""); err == nil {
+		// the metadata of a structured file can be anywhere in it
+		n = -1
+	}
+	contents, size, err := readPrefix(n)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := inspect(name, contents, size)
+	if err != nil && int64(len(contents)) < size {
+		// the header didn't fit, or the message is armored
+		if contents, size, err = readPrefix(-1); err != nil {
+			return nil, err
+		}
+		info, err = inspect(name, contents, size)
+	}
+	return info, err
+}
+
+// inspectInfo is what the header of an encrypted file says about it.
+type inspectInfo struct {
+	// gosecret, age, openpgp or legacy
+	Format        string `json:"format"`
+	Version       int    `json:"version,omitempty"`
+	Algorithm     string `json:"algorithm"`
+	Authenticated bool   `json:"authenticated"`
+	// the format of a file encrypted with --structured
+	Structured string        `json:"structured,omitempty"`
+	Keys       []*inspectKey `json:"keys"`
+	ChunkSize  int           `json:"chunk_size,omitempty"`
+	Size       int64         `json:"size"`
+	Plaintext  *int64        `json:"plaintext_size,omitempty"`
+	Created    string        `json:"created,omitempty"`
+}
+
+// inspectKey is one of the ways to unlock a file.
+type inspectKey struct {
+	// key, passphrase, x25519 or an OpenPGP public key algorithm
+	Type string      `json:"type"`
+	ID   string      `json:"id,omitempty"`
+	KDF  *inspectKDF `json:"kdf,omitempty"`
+}
+
+// inspectKDF are the parameters a passphrase is turned into a key with.
+type inspectKDF struct {
+	Name       string `json:"name"`
+	LogN       int    `json:"log_n,omitempty"`
+	R          int    `json:"r,omitempty"`
+	P          int    `json:"p,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+}
+
+func (k *inspectKDF) String() string {
+	if k.Name == "scrypt" {
+		return fmt.Sprintf("scrypt logN=%d r=%d p=%d", k.LogN, k.R, k.P)
+	}
+	s := k.Name
+	if k.Hash != "" {
+		s += " " + k.Hash
+	}
+	if k.Iterations > 0 {
+		s += fmt.Sprintf(" iterations=%d", k.Iterations)
+	}
+	return s
+}
+
+// String formats the metadata for people to read.
+func (info *inspectInfo) String() string {
+	var b bytes.Buffer
+	line := func(name, format string, args ...interface{}) {
+		fmt.Fprintf(&b, "%-16s%s\n", name+":", fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case info.Format == "legacy":
+		line("format", "legacy AES-CFB, unauthenticated")
+	case info.Version > 0:
+		line("format", "%s version %d", info.Format, info.Version)
+	default:
+		line("format", "%s", info.Format)
+	}
+	if info.Format != "legacy" {
+		line("algorithm", "%s", info.Algorithm)
+		if !info.Authenticated {
+			line("authenticated", "no")
+		}
+	}
+	if info.Structured != "" {
+		line("structured", "%s", info.Structured)
+	}
+	for _, k := range info.Keys {
+		switch {
+		case k.Type == "key" && k.ID == "":
+			line("key", "not recorded")
+		case k.Type == "key":
+			line("key", "%s", k.ID)
+		case k.Type == "passphrase":
+			line("passphrase", "%s", k.KDF)
+		default:
+			line("recipient", "%s", strings.TrimSpace(k.Type+" "+k.ID))
+		}
+	}
+	if info.ChunkSize > 0 {
+		line("chunk size", "%d bytes", info.ChunkSize)
+	}
+	line("size", "%d bytes", info.Size)
+	if info.Plaintext != nil {
+		line("plaintext size", "about %d bytes", *info.Plaintext)
+	}
+	switch {
+	case info.Created != "":
+		line("created", "%s", info.Created)
+	case info.Format == "gosecret":
+		line("created", "not recorded")
+	}
+	return b.String()
+}
+
+// setPlaintext records the plaintext size, which can't be negative.
+func (info *inspectInfo) setPlaintext(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	info.Plaintext = &n
+}
+
+// inspect reads the metadata of a file called name from its first bytes.
+// size is the size of the whole file.
+func inspect(name string, contents []byte, size int64) (*inspectInfo, error) {
+	if format := detectStructuredFormat(name, contents); format != "" {
+		doc, err := structuredFormats[format](contents)
+		if err != nil {
+			return nil, err
+		}
+		h, _, _, err := takeStructuredHeader(doc)
+		if err != nil {
+			return nil, err
+		}
+		info := inspectHeader(h, size, -1)
+		info.Structured = format
+		return info, nil
+	}
+
+	r := bytes.NewReader(contents)
+	br := bufio.NewReader(r)
+	if peekAgeHeader(br) {
+		h, err := readAgeHeader(br)
+		if err != nil {
+			return nil, err
+		}
+		read := int64(len(contents) - r.Len() - br.Buffered())
+		return inspectAgeHeader(h, size, size-read), nil
+	}
+	if peekPGPMessage(br) {
+		return inspectPGPMessage(contents, size)
+	}
+	if !hasHeader(contents) {
+		info := &inspectInfo{Format: "legacy", Algorithm: "AES-CFB", Keys: []*inspectKey{{Type: "key"}}, Size: size}
+		// the body is the IV followed by the ciphertext
+		info.setPlaintext(size - 16)
+		return info, nil
+	}
+
+	h, rest, err := parseHeader(contents)
+	if err != nil {
+		return nil, err
+	}
+	return inspectHeader(h, size, size-int64(len(contents)-len(rest))), nil
+}
+
+// inspectHeader describes a gosecret header. The plaintext size is estimated
+// from the size of the body, unless it is negative.
+func inspectHeader(h *header, size, body int64) *inspectInfo {
+	info := &inspectInfo{Format: "gosecret", Version: int(h.version), Algorithm: "AES-GCM", Authenticated: true, Keys: []*inspectKey{}, Size: size}
+	if h.version >= 4 {
+		// the data key is always 32 bytes
+		info.Algorithm = "AES-256-GCM"
+	}
+	if h.version >= 3 {
+		info.ChunkSize = int(h.chunkSize)
+	}
+	if h.version >= 5 {
+		info.Created = time.Unix(h.created, 0).UTC().Format(time.RFC3339)
+	}
+
+	switch {
+	case h.version >= 4:
+		for _, s := range h.stanzas {
+			switch s.kind {
+			case stanzaKey:
+				info.Keys = append(info.Keys, &inspectKey{Type: "key", ID: formatKeyID(s.keyID)})
+			case stanzaScrypt:
+				info.Keys = append(info.Keys, &inspectKey{Type: "passphrase", KDF: inspectScrypt(s.scrypt)})
+			case stanzaX25519:
+				info.Keys = append(info.Keys, &inspectKey{Type: "x25519", ID: formatKeyID(s.keyID)})
+			default:
+				info.Keys = append(info.Keys, &inspectKey{Type: fmt.Sprintf("unknown stanza %d", s.kind)})
+			}
+		}
+	case h.kdf == kdfScrypt:
+		info.Keys = append(info.Keys, &inspectKey{Type: "passphrase", KDF: inspectScrypt(h.scrypt)})
+	default:
+		// older files don't record which key they were encrypted with
+		info.Keys = append(info.Keys, &inspectKey{Type: "key"})
+	}
+
+	switch {
+	case body < 0:
+	case h.version < 3:
+		// a single message with a nonce and a tag
+		info.setPlaintext(body - 12 - 16)
+	default:
+		// a full chunk is never the last one, so there is always one more
+		chunk := int64(h.chunkSize) + 16
+		info.setPlaintext(body - (body/chunk+1)*16)
+	}
+	return info
+}
+
+func inspectScrypt(params *scryptParams) *inspectKDF {
+	return &inspectKDF{Name: "scrypt", LogN: int(params.logN), R: int(params.r), P: int(params.p)}
+}
+
+// inspectAgeHeader describes an age header. X25519 stanzas don't say which
+// recipient they are for.
+func inspectAgeHeader(h *ageHeader, size, payload int64) *inspectInfo {
+	info := &inspectInfo{Format: "age", Version: 1, Algorithm: "ChaCha20-Poly1305", Authenticated: true, Keys: []*inspectKey{}, ChunkSize: ageChunkSize, Size: size}
+	for _, s := range h.stanzas {
+		switch s.kind {
+		case ageScryptKind:
+			logN, _ := strconv.Atoi(s.args[len(s.args)-1])
+			info.Keys = append(info.Keys, &inspectKey{Type: "passphrase", KDF: &inspectKDF{Name: "scrypt", LogN: logN, R: ageScryptR, P: ageScryptP}})
+		default:
+			info.Keys = append(info.Keys, &inspectKey{Type: strings.ToLower(s.kind)})
+		}
+	}
+
+	// unlike gosecret's stream the last chunk can be full
+	body := payload - ageNonceSize
+	chunk := int64(ageChunkSize) + 16
+	chunks := (body + chunk - 1) / chunk
+	if chunks == 0 {
+		chunks = 1
+	}
+	info.setPlaintext(body - chunks*16)
+	return info
+}
+
+// names of the OpenPGP algorithms gosecret knows about
+var pgpAlgorithmNames = map[byte]string{
+	pgpRSA:        "rsa",
+	pgpRSAEncrypt: "rsa",
+	pgpElGamal:    "elgamal",
+	pgpECDH:       "ecdh",
+}
+
+var pgpCipherNames = map[byte]string{
+	pgpCipher3DES:   "3DES",
+	pgpCipherCAST5:  "CAST5",
+	pgpCipherAES128: "AES-128",
+	pgpCipherAES192: "AES-192",
+	pgpCipherAES256: "AES-256",
+}
+
+var pgpHashNames = map[byte]string{
+	pgpMD5:    "MD5",
+	pgpSHA1:   "SHA-1",
+	pgpSHA256: "SHA-256",
+	pgpSHA384: "SHA-384",
+	pgpSHA512: "SHA-512",
+	pgpSHA224: "SHA-224",
+}
+
+// inspectPGPMessage describes the session key packets of an OpenPGP message.
+// The plaintext size isn't estimated since the data is usually compressed.
+func inspectPGPMessage(contents []byte, size int64) (*inspectInfo, error) {
+	if bytes.HasPrefix(contents, pgpMessageArmor) {
+		decoded, err := decodePGPArmor(contents)
+		if err != nil {
+			return nil, err
+		}
+		contents = decoded
+	}
+
+	info := &inspectInfo{Format: "openpgp", Keys: []*inspectKey{}, Size: size}
+	r := bytes.NewReader(contents)
+	for {
+		tag, body, err := readPGPPacket(r)
+		if err == io.EOF {
+			return nil, errBadPGP
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case pgpTagPKESK:
+			b, err := readPGPBody(body)
+			if err != nil {
+				return nil, err
+			}
+			p, err := parsePGPPKESK(b)
+			if err != nil {
+				return nil, err
+			}
+			algorithm, ok := pgpAlgorithmNames[p.algorithm]
+			if !ok {
+				algorithm = fmt.Sprintf("algorithm %d", p.algorithm)
+			}
+			info.Keys = append(info.Keys, &inspectKey{Type: algorithm, ID: fmt.Sprintf("%016X", p.keyID)})
+		case pgpTagSKESK:
+			b, err := readPGPBody(body)
+			if err != nil {
+				return nil, err
+			}
+			s, err := parsePGPSKESK(b)
+			if err != nil {
+				return nil, err
+			}
+			kdf := &inspectKDF{Name: "s2k simple", Hash: pgpHashNames[s.s2k.hash]}
+			switch s.s2k.mode {
+			case pgpS2KSalted:
+				kdf.Name = "s2k salted"
+			case pgpS2KIterated:
+				kdf.Name = "s2k iterated"
+				kdf.Iterations = s.s2k.count
+			}
+			info.Keys = append(info.Keys, &inspectKey{Type: "passphrase", KDF: kdf})
+			if len(s.encrypted) == 0 {
+				// the passphrase gives the session key directly
+				info.Algorithm = pgpCipherNames[s.cipher]
+			}
+		case pgpTagMarker:
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, err
+			}
+		case pgpTagSEIPD:
+			// the cipher is only known when it isn't in an encrypted session key
+			info.Algorithm = strings.TrimSpace(info.Algorithm + " SEIPD")
+			info.Authenticated = true
+			return info, nil
+		case pgpTagSED:
+			info.Algorithm = strings.TrimSpace(info.Algorithm + " SED")
+			return info, nil
+		case pgpTagAEAD:
+			info.Algorithm = "AEAD"
+			info.Authenticated = true
+			return info, nil
+		default:
+			return nil, errBadPGP
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/golang.org/x/crypto/scrypt"
+	"io"
+)
+
+// key derivation function identifiers stored in the header
+const (
+	kdfNone   = 0
+	kdfScrypt = 1
+)
+
+const (
+	scryptSaltSize = 16
+	scryptKeySize  = 32
+
+	// defaults used when encrypting with a passphrase
+	defaultScryptLogN = 17
+	defaultScryptR    = 8
+	defaultScryptP    = 1
+
+	// cost parameters read from a file are rejected if they fall outside of
+	// these bounds, so a tampered header can't weaken the key derivation or
+	// make decrypt use an absurd amount of memory.
+	minScryptLogN   = 14
+	maxScryptLogN   = 22
+	minScryptR      = 8
+	minScryptP      = 1
+	maxScryptMemory = 1 << 30
+)
+
+// scryptParams are the salt and cost parameters needed to derive a key from
+// a passphrase. They are stored in the header of passphrase encrypted files.
+type scryptParams struct {
+	salt []byte
+	logN byte
+	r    byte
+	p    byte
+}
+
+// newScryptParams returns parameters with a random salt and the given costs.
+func newScryptParams(logN, r, p int) (*scryptParams, error) {
+	params := &scryptParams{logN: byte(logN), r: byte(r), p: byte(p)}
+	if logN != int(params.logN) || r != int(params.r) || p != int(params.p) {
+		return nil, errors.New("Scrypt cost parameters must be between 0 and 255")
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	params.salt = make([]byte, scryptSaltSize)
+	if _, err := io.ReadFull(rand.Reader, params.salt); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// validate makes sure the cost parameters are within sane bounds.
+func (s *scryptParams) validate() error {
+	if s.logN < minScryptLogN || s.logN > maxScryptLogN {
+		return fmt.Errorf("Scrypt log N must be between %d and %d, got %d", minScryptLogN, maxScryptLogN, s.logN)
+	}
+	if s.r < minScryptR {
+		return fmt.Errorf("Scrypt r must be at least %d, got %d", minScryptR, s.r)
+	}
+	if s.p < minScryptP {
+		return fmt.Errorf("Scrypt p must be at least %d, got %d", minScryptP, s.p)
+	}
+	if 128*int64(s.r)<<s.logN > maxScryptMemory {
+		return fmt.Errorf("Scrypt parameters need more than %d bytes of memory", maxScryptMemory)
+	}
+	return nil
+}
+
+// deriveKey stretches a passphrase into a 32 byte key.
+func (s *scryptParams) deriveKey(passphrase []byte) ([]byte, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return scrypt.Key(passphrase, s.salt, 1<<s.logN, int(s.r), int(s.p), scryptKeySize)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// args
+var keygenOutFilenameArg string
+
+var keygenDoc = `
+Usage: keygen [out-file]
+
+Generate a new X25519 identity and write it to an output file only readable
+by you, or to stdout if no file is given. The matching recipient is printed
+so it can be shared with anyone who needs to encrypt files for you with
+encrypt --recipient. Decrypt them with decrypt --identity out-file.
+
+Identity files are plain text. Lines starting with # are comments, every
+other line is an identity starting with GOSECRET-IDENTITY-1. Recipients
+start with gosecret1. Both end in the key and a checksum encoded in base32.
+`
+
+func keygenAction() error {
+	identity, err := newX25519Identity()
+	if err != nil {
+		return err
+	}
+
+	contents := fmt.Sprintf("# created: %s\n# recipient: %s\n%s\n", time.Now().Format(time.RFC3339), identity.recipient(), identity)
+	if keygenOutFilenameArg == "" {
+		_, err := os.Stdout.WriteString(contents)
+		return err
+	}
+
+	// never overwrite an existing identity
+	f, err := os.OpenFile(keygenOutFilenameArg, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Recipient: %s\n", identity.recipient())
+	return nil
+}
+
+// keygenFlagInit initializes the flagset for the keygen command. There are no
+// flags, but comandante only parses the arguments of commands with a flagset.
+func keygenFlagInit(fs *flag.FlagSet) {}
+
+// keygenFlagPostParse sets the output filename from the arguments provided by the flagset
+func keygenFlagPostParse(fs *flag.FlagSet) {
+	keygenOutFilenameArg = fs.Arg(0)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A keyring file holds named master keys, one per line as name=key, so
+// decrypt can pick whichever key a file was encrypted with by its key ID.
+// Lines starting with # are comments, and space around names and keys is
+// ignored.
+
+// namedKey is a master key from a keyring.
+type namedKey struct {
+	name string
+	key  []byte
+}
+
+// parseKeyring decodes the keys in a keyring file.
+func parseKeyring(contents []byte) ([]*namedKey, error) {
+	var keys []*namedKey
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i < 1 {
+			return nil, fmt.Errorf("Line %d of the keyring isn't a name=key pair", n)
+		}
+		k := &namedKey{name: strings.TrimSpace(line[:i]), key: []byte(strings.TrimSpace(line[i+1:]))}
+		if names[k.name] {
+			return nil, fmt.Errorf("Line %d of the keyring repeats the name %s", n, k.name)
+		}
+		if _, err := aes.NewCipher(k.key); err != nil {
+			return nil, fmt.Errorf("Key %s in the keyring isn't 16, 24 or 32 bytes", k.name)
+		}
+		names[k.name] = true
+		keys = append(keys, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("The keyring doesn't contain any keys")
+	}
+	return keys, nil
+}
+
+// missingKeyError is returned when none of the keys given are ones a file was
+// encrypted with. It names the IDs of the keys that would work.
+type missingKeyError struct {
+	ids [][]byte
+}
+
+func (e *missingKeyError) Error() string {
+	ids := make([]string, len(e.ids))
+	for i, id := range e.ids {
+		ids[i] = formatKeyID(id)
+	}
+	if len(ids) == 1 {
+		return fmt.Sprintf("File was encrypted with key %s, which wasn't given, please provide it with --key or --keyring", ids[0])
+	}
+	return fmt.Sprintf("File was encrypted with keys %s, none of which were given, please provide one with --key or --keyring", strings.Join(ids, ", "))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// flags and args. list takes the download flags for the bucket and AWS keys,
+// so it shares their variables.
+var listRecursiveFlag bool
+var listLongFlag bool
+var listJSONFlag bool
+var listPrefixArg string
+
+var listDoc = `
+Usage: list [options] [prefix]
+
+List the files in the --bucket, or only those under a prefix. Directories
+are shown with a trailing slash, and --recursive lists the files in them
+instead.
+
+Use --long to also show the size, last modified time and ETag of each file,
+or --json for output meant for scripts.
+`
+
+func listAction() error {
+	// make sure that we have all of the required data
+	if downloadBucketNameFlag == "" {
+		return errors.New("Please provide an S3 bucket name with --bucket or $GOSECRET_BUCKET")
+	}
+	if downloadAccessKeyFlag == "" {
+		return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+	}
+	if downloadSecretKeyFlag == "" {
+		return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+	}
+
+	config := newS3Config(downloadAccessKeyFlag, downloadSecretKeyFlag, downloadSessionTokenFlag, downloadRegionFlag)
+	if err := setS3Endpoint(config, downloadEndpointFlag, downloadPathStyleFlag, downloadCABundleFlag); err != nil {
+		return err
+	}
+	if err := setS3Retry(config, downloadMaxAttemptsFlag, downloadRetryDelayFlag, downloadRetryMaxDelayFlag); err != nil {
+		return err
+	}
+
+	entries, err := listS3(downloadBucketNameFlag, listPrefixArg, listRecursiveFlag, config)
+	if err != nil {
+		return err
+	}
+	return writeList(os.Stdout, entries, listLongFlag, listJSONFlag)
+}
+
+// listFlagInit initializes the flagset for the list command
+func listFlagInit(fs *flag.FlagSet) {
+	downloadFlagInit(fs)
+
+	fs.BoolVar(&listRecursiveFlag, "recursive", false, "List the files in every directory under the prefix")
+	fs.BoolVar(&listLongFlag, "long", false, "Show the size, last modified time and ETag of each file")
+	fs.BoolVar(&listJSONFlag, "json", false, "Print the list as JSON")
+}
+
+// listFlagPostParse sets the prefix from the arguments provided by the flagset
+func listFlagPostParse(fs *flag.FlagSet) {
+	listPrefixArg = fs.Arg(0)
+}
+
+// s3Entry is a file or directory in an s3 bucket.
+type s3Entry struct {
+	Key          string `json:"key"`
+	Dir          bool   `json:"dir,omitempty"`
+	Size         int64  `json:"size"`
+	LastModified string `json:"last_modified,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+}
+
+// listS3 returns the files and directories directly under prefix in an s3
+// bucket, or every file under it if recursive is set. Directory keys end in
+// a slash.
+func listS3(bucket, prefix string, recursive bool, config *s3util.Config) ([]*s3Entry, error) {
+	var entries []*s3Entry
+	visited := map[string]bool{}
+
+	var listDir func(prefix string) error
+	listDir = func(prefix string) error {
+		if visited[prefix] {
+			return nil
+		}
+		visited[prefix] = true
+
+		dir, err := openS3Dir(bucket, prefix, config)
+		if err != nil {
+			return err
+		}
+		for {
+			infos, err := dir.Readdir(0)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, fi := range infos {
+				if fi.IsDir() && recursive {
+					if err := listDir(fi.Name()); err != nil {
+						return err
+					}
+					continue
+				}
+				entries = append(entries, newS3Entry(fi))
+			}
+		}
+	}
+
+	return entries, listDir(strings.Trim(prefix, "/"))
+}
+
+func newS3Entry(fi os.FileInfo) *s3Entry {
+	if fi.IsDir() {
+		return &s3Entry{Key: fi.Name() + "/", Dir: true}
+	}
+
+	e := &s3Entry{Key: fi.Name(), Size: fi.Size()}
+	if t := fi.ModTime(); !t.IsZero() {
+		e.LastModified = t.UTC().Format(time.RFC3339)
+	}
+	if stat, ok := fi.Sys().(*s3util.Stat); ok && stat != nil {
+		e.ETag = stat.ETag
+	}
+	return e
+}
+
+// writeList writes the entries to w, one key per line unless long or
+// asJSON are set.
+func writeList(w io.Writer, entries []*s3Entry, long, asJSON bool) error {
+	if asJSON {
+		if entries == nil {
+			entries = []*s3Entry{}
+		}
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+
+	if !long {
+		for _, e := range entries {
+			if _, err := fmt.Fprintln(w, e.Key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, e := range entries {
+		if e.Dir {
+			fmt.Fprintf(tw, "-\t-\t-\t%s\n", e.Key)
+		} else {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", e.Size, e.LastModified, e.ETag, e.Key)
+		}
+	}
+	return tw.Flush()
+}
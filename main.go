@@ -17,6 +17,20 @@ func main() {
 	decryptCmd.FlagPostParse = decryptFlagPostParse
 	bin.RegisterCommand(decryptCmd)
 
+	// delete
+	deleteCmd := comandante.NewCommand("delete", "Delete files from a bucket", deleteAction)
+	deleteCmd.Documentation = deleteDoc
+	deleteCmd.FlagInit = deleteFlagInit
+	deleteCmd.FlagPostParse = deleteFlagPostParse
+	bin.RegisterCommand(deleteCmd)
+
+	// edit
+	editCmd := comandante.NewCommand("edit", "Edit an encrypted file", editAction)
+	editCmd.Documentation = editDoc
+	editCmd.FlagInit = editFlagInit
+	editCmd.FlagPostParse = editFlagPostParse
+	bin.RegisterCommand(editCmd)
+
 	// encrypt
 	encryptCmd := comandante.NewCommand("encrypt", "Encrypt a file", encryptAction)
 	encryptCmd.Documentation = encryptDoc
@@ -24,21 +38,102 @@ func main() {
 	encryptCmd.FlagPostParse = encryptFlagPostParse
 	bin.RegisterCommand(encryptCmd)
 
+	// exec
+	execCmd := comandante.NewCommand("exec", "Run a command with decrypted secrets in its environment", execAction)
+	execCmd.Documentation = execDoc
+	execCmd.FlagInit = execFlagInit
+	execCmd.FlagPostParse = execFlagPostParse
+	bin.RegisterCommand(execCmd)
+
+	// history
+	historyCmd := comandante.NewCommand("history", "List the versions of a file in a bucket", historyAction)
+	historyCmd.Documentation = historyDoc
+	historyCmd.FlagInit = historyFlagInit
+	historyCmd.FlagPostParse = historyFlagPostParse
+	bin.RegisterCommand(historyCmd)
+
+	// inspect
+	inspectCmd := comandante.NewCommand("inspect", "Print the metadata of an encrypted file", inspectAction)
+	inspectCmd.Documentation = inspectDoc
+	inspectCmd.FlagInit = inspectFlagInit
+	inspectCmd.FlagPostParse = inspectFlagPostParse
+	bin.RegisterCommand(inspectCmd)
+
+	// keygen
+	keygenCmd := comandante.NewCommand("keygen", "Generate an identity and recipient", keygenAction)
+	keygenCmd.Documentation = keygenDoc
+	keygenCmd.FlagInit = keygenFlagInit
+	keygenCmd.FlagPostParse = keygenFlagPostParse
+	bin.RegisterCommand(keygenCmd)
+
+	// list
+	listCmd := comandante.NewCommand("list", "List the files in a bucket", listAction)
+	listCmd.Documentation = listDoc
+	listCmd.FlagInit = listFlagInit
+	listCmd.FlagPostParse = listFlagPostParse
+	bin.RegisterCommand(listCmd)
+
+	// merge
+	mergeCmd := comandante.NewCommand("merge", "Merge your changes to a file with someone else's", mergeAction)
+	mergeCmd.Documentation = mergeDoc
+	mergeCmd.FlagInit = mergeFlagInit
+	mergeCmd.FlagPostParse = mergeFlagPostParse
+	bin.RegisterCommand(mergeCmd)
+
+	// rewrap
+	rewrapCmd := comandante.NewCommand("rewrap", "Change the master keys of an encrypted file", rewrapAction)
+	rewrapCmd.Documentation = rewrapDoc
+	rewrapCmd.FlagInit = rewrapFlagInit
+	rewrapCmd.FlagPostParse = rewrapFlagPostParse
+	bin.RegisterCommand(rewrapCmd)
+
+	// rollback
+	rollbackCmd := comandante.NewCommand("rollback", "Make an older version of a file the latest one", rollbackAction)
+	rollbackCmd.Documentation = rollbackDoc
+	rollbackCmd.FlagInit = rollbackFlagInit
+	rollbackCmd.FlagPostParse = rollbackFlagPostParse
+	bin.RegisterCommand(rollbackCmd)
+
+	// rotate
+	rotateCmd := comandante.NewCommand("rotate", "Re-encrypt files under a new key", rotateAction)
+	rotateCmd.Documentation = rotateDoc
+	rotateCmd.FlagInit = rotateFlagInit
+	rotateCmd.FlagPostParse = rotateFlagPostParse
+	bin.RegisterCommand(rotateCmd)
+
 	// download
 	downloadCmd := comandante.NewCommand("download", "Download a file", downloadAction)
 	downloadCmd.Documentation = downloadDoc
-	downloadCmd.FlagInit = downloadFlagInit
+	downloadCmd.FlagInit = downloadCommandFlagInit
 	downloadCmd.FlagPostParse = downloadFlagPostParse
 	bin.RegisterCommand(downloadCmd)
 
 	// upload
 	uploadCmd := comandante.NewCommand("upload", "Upload a file", uploadAction)
 	uploadCmd.Documentation = uploadDoc
-	uploadCmd.FlagInit = uploadFlagInit
+	uploadCmd.FlagInit = uploadCommandFlagInit
 	uploadCmd.FlagPostParse = uploadFlagPostParse
 	bin.RegisterCommand(uploadCmd)
 
+	// push
+	pushCmd := comandante.NewCommand("push", "Encrypt and upload a file", pushAction)
+	pushCmd.Documentation = pushDoc
+	pushCmd.FlagInit = pushFlagInit
+	pushCmd.FlagPostParse = pushFlagPostParse
+	bin.RegisterCommand(pushCmd)
+
+	// pull
+	pullCmd := comandante.NewCommand("pull", "Download and decrypt a file", pullAction)
+	pullCmd.Documentation = pullDoc
+	pullCmd.FlagInit = pullFlagInit
+	pullCmd.FlagPostParse = pullFlagPostParse
+	bin.RegisterCommand(pullCmd)
+
 	if err := bin.Run(); err != nil {
+		// exec exits with the status of the command it ran
+		if exitErr, ok := err.(*exitError); ok {
+			os.Exit(exitErr.code)
+		}
 		fmt.Fprintln(os.Stderr, err)
 	}
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// args. merge takes the union of the decrypt and download flags, so it
+// shares their variables.
+var mergeFilenameArg string
+var mergeDestinationFilenameArg string
+var mergeRemoteNameArg string
+
+var mergeDoc = `
+Usage: merge [options] file out-file [remote name]
+
+Merge your changes to a structured file with the ones someone else uploaded
+since you last downloaded or uploaded it. The file is your copy, either
+encrypted with --structured or already decrypted, and the merged plaintext
+is written to out-file, only readable by the current user, ready to be
+encrypted and uploaded again.
+If a remote name isn't specified the file in the bucket has the file's base
+name.
+
+Each value is compared with the version you started from. Values changed
+only by you or only by them are taken from whoever changed them, and values
+changed by both are reported as conflicts with yours kept. The bucket needs
+versioning turned on to keep the version you started from.
+`
+
+func mergeAction() error {
+	// make sure that we have all of the required data
+	if mergeFilenameArg == "" {
+		return errors.New("Please provide a valid filename to merge")
+	}
+	if mergeDestinationFilenameArg == "" {
+		return errors.New("Please provide a file to write the merged plaintext to")
+	}
+	if mergeRemoteNameArg == "" {
+		mergeRemoteNameArg = filepath.Base(mergeFilenameArg)
+	}
+	if downloadBucketNameFlag == "" {
+		return errors.New("Please provide an S3 bucket name with --bucket or $GOSECRET_BUCKET")
+	}
+	if downloadAccessKeyFlag == "" {
+		return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+	}
+	if downloadSecretKeyFlag == "" {
+		return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+	}
+
+	format, err := structuredFormat(mergeRemoteNameArg, decryptFormatFlag)
+	if err != nil {
+		return err
+	}
+	c, err := decryptFlagCredentials()
+	if err != nil {
+		return err
+	}
+
+	config := newS3Config(downloadAccessKeyFlag, downloadSecretKeyFlag, downloadSessionTokenFlag, downloadRegionFlag)
+	if err := setS3Endpoint(config, downloadEndpointFlag, downloadPathStyleFlag, downloadCABundleFlag); err != nil {
+		return err
+	}
+	if err := setS3Retry(config, downloadMaxAttemptsFlag, downloadRetryDelayFlag, downloadRetryMaxDelayFlag); err != nil {
+		return err
+	}
+	state, err := loadS3State()
+	if err != nil {
+		return err
+	}
+	base := state.get(downloadBucketNameFlag, mergeRemoteNameArg)
+	if base == nil || base.VersionId == "" {
+		return fmt.Errorf("The version of %s you started from isn't known. Merging needs versioning turned on for the bucket, and the file downloaded or uploaded since", mergeRemoteNameArg)
+	}
+
+	ours, err := ioutil.ReadFile(mergeFilenameArg)
+	if err != nil {
+		return err
+	}
+	merged, conflicts, info, err := merge(downloadBucketNameFlag, mergeRemoteNameArg, format, base.VersionId, ours, c, config)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(mergeDestinationFilenameArg, bytes.NewReader(merged), 0600); err != nil {
+		return err
+	}
+	// the merge includes their changes, so uploading it can replace them
+	if err := state.record(downloadBucketNameFlag, mergeRemoteNameArg, info); err != nil {
+		return err
+	}
+
+	for _, path := range conflicts {
+		fmt.Printf("Conflict at %s, your value was kept\n", path)
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%d values were changed by both you and them, please check them in %s", len(conflicts), mergeDestinationFilenameArg)
+	}
+	return nil
+}
+
+// mergeFlagInit initializes the flagset for the merge command
+func mergeFlagInit(fs *flag.FlagSet) {
+	decryptFlagInit(fs)
+	downloadFlagInit(fs)
+}
+
+// mergeFlagPostParse sets the filenames from the arguments provided by the flagset
+func mergeFlagPostParse(fs *flag.FlagSet) {
+	mergeFilenameArg = fs.Arg(0)
+	mergeDestinationFilenameArg = fs.Arg(1)
+	mergeRemoteNameArg = fs.Arg(2)
+}
+
+// merge merges ours with the latest version of remoteName in an s3 bucket,
+// using the version baseVersionID as the one both started from. It returns
+// the merged plaintext, the paths of the values both sides changed and the
+// ETag and version of the latest version.
+func merge(bucket, remoteName, format, baseVersionID string, ours []byte, c *credentials, config *s3util.Config) ([]byte, []string, *s3util.ObjectInfo, error) {
+	base, _, err := readS3Plaintext(bucket, remoteName, format, baseVersionID, c, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	theirs, info, err := readS3Plaintext(bucket, remoteName, format, "", c, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ours, err = structuredPlaintext(format, ours, c); err != nil {
+		return nil, nil, nil, err
+	}
+
+	merged, conflicts, err := mergeStructured(format, base, ours, theirs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return merged, conflicts, info, nil
+}
+
+// readS3Plaintext downloads the version versionID of name from an s3 bucket,
+// or the latest version if it's empty, and decrypts it.
+func readS3Plaintext(bucket, name, format, versionID string, c *credentials, config *s3util.Config) ([]byte, *s3util.ObjectInfo, error) {
+	s3File, info, err := openS3FileVersion(bucket, name, versionID, nil, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s3File.Close()
+
+	contents, err := ioutil.ReadAll(s3File)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := structuredPlaintext(format, contents, c)
+	return plaintext, info, err
+}
+
+// structuredPlaintext decrypts contents if it was encrypted with
+// --structured, and returns it unchanged if it's plaintext already.
+func structuredPlaintext(format string, contents []byte, c *credentials) ([]byte, error) {
+	doc, err := structuredFormats[format](contents)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, ok := doc.takeMetadata(); !ok {
+		return contents, nil
+	}
+	return decryptStructured(format, contents, c)
+}
+
+// mergeStructured merges the changes from base to ours and from base to
+// theirs, three plaintext documents in format. Comments and ordering are
+// kept from ours. Values both sides changed differently keep the value from
+// ours, and their paths are returned.
+func mergeStructured(format string, base, ours, theirs []byte) ([]byte, []string, error) {
+	docs := make([]structuredDoc, 3)
+	leaves := make([]map[string][]byte, 3)
+	var paths [][]string
+	seen := map[string]bool{}
+
+	// visit the paths of ours first, then any only theirs or base have
+	for i, contents := range [][]byte{ours, theirs, base} {
+		doc, err := structuredFormats[format](contents)
+		if err != nil {
+			return nil, nil, err
+		}
+		docs[i], leaves[i] = doc, map[string][]byte{}
+		err = doc.eachRawLeaf(func(path []string, raw []byte) error {
+			key := string(encodePath(path))
+			leaves[i][key] = raw
+			if !seen[key] {
+				seen[key] = true
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	merged := docs[0]
+	var conflicts []string
+	for _, path := range paths {
+		key := string(encodePath(path))
+		o, inOurs := leaves[0][key]
+		t, inTheirs := leaves[1][key]
+		b, inBase := leaves[2][key]
+
+		switch {
+		case sameLeaf(o, inOurs, t, inTheirs), sameLeaf(t, inTheirs, b, inBase):
+			// nothing to take from theirs
+		case sameLeaf(o, inOurs, b, inBase):
+			var ok bool
+			if inTheirs {
+				ok = merged.setLeaf(path, t)
+			} else {
+				ok = merged.removeLeaf(path)
+			}
+			if !ok {
+				conflicts = append(conflicts, strings.Join(path, "."))
+			}
+		default:
+			conflicts = append(conflicts, strings.Join(path, "."))
+		}
+	}
+
+	contents, err := merged.encode()
+	if err != nil {
+		return nil, nil, err
+	}
+	return contents, conflicts, nil
+}
+
+// sameLeaf reports whether two leaves, either of which may be missing, are
+// the same.
+func sameLeaf(a []byte, inA bool, b []byte, inB bool) bool {
+	return inA == inB && bytes.Equal(a, b)
+}
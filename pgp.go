@@ -0,0 +1,917 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/zlib"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// OpenPGP messages (RFC 4880) can be read and written as well, so files
+// encrypted with gpg can be moved over gradually. A message starts with a
+// session key packet for each key or passphrase that can decrypt it,
+// followed by the session key encrypted data:
+//
+//	PKESK  session key encrypted to a public key
+//	SKESK  session key derived from or encrypted with a passphrase
+//	SEIPD  literal data, possibly compressed, encrypted in CFB mode and
+//	       followed by an SHA-1 modification detection code
+//
+// Only messages with the modification detection code are read, since
+// anything else can be tampered with unnoticed. Signatures in a message are
+// skipped rather than checked. Messages are written without compression,
+// encrypted with AES-256 to each key in a keyring and optionally a
+// passphrase.
+
+// pgpFormat is the --format that writes OpenPGP messages.
+const pgpFormat = "pgp"
+
+// packet tags
+const (
+	pgpTagPKESK         = 1
+	pgpTagSignature     = 2
+	pgpTagSKESK         = 3
+	pgpTagOnePassSig    = 4
+	pgpTagSecretKey     = 5
+	pgpTagPublicKey     = 6
+	pgpTagSecretSubkey  = 7
+	pgpTagCompressed    = 8
+	pgpTagSED           = 9
+	pgpTagMarker        = 10
+	pgpTagLiteral       = 11
+	pgpTagUserID        = 13
+	pgpTagPublicSubkey  = 14
+	pgpTagUserAttribute = 17
+	pgpTagSEIPD         = 18
+	pgpTagAEAD          = 20
+)
+
+const (
+	// each part of a packet written with partial body lengths is
+	// pgpPartialSize bytes, which has to be a power of two
+	pgpPartialBits = 16
+	pgpPartialSize = 1 << pgpPartialBits
+
+	// the largest packet other than the encrypted data read into memory
+	pgpMaxPacketSize = 1 << 20
+
+	pgpMDCSize = 2 + sha1.Size
+
+	// the cipher messages are written with
+	pgpDefaultCipher = pgpCipherAES256
+)
+
+var pgpMessageArmor = []byte("-----BEGIN PGP MESSAGE-----")
+
+var errBadPGP = errors.New("File isn't a valid OpenPGP message")
+
+// readPGPPacket reads the header of the next packet in r and returns its tag
+// and a reader of its body. io.EOF is returned when there are no packets
+// left.
+func readPGPPacket(r io.Reader) (byte, io.Reader, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, errBadPGP
+	}
+	if b[0]&0x80 == 0 {
+		return 0, nil, errBadPGP
+	}
+
+	// old format packets have the tag and length type in the first byte
+	if b[0]&0x40 == 0 {
+		tag, lengthType := b[0]>>2&0x0f, b[0]&3
+		if lengthType == 3 {
+			return tag, r, nil
+		}
+		size := 1 << lengthType
+		if _, err := io.ReadFull(r, b[:size]); err != nil {
+			return 0, nil, errBadPGP
+		}
+		var length int64
+		for _, c := range b[:size] {
+			length = length<<8 | int64(c)
+		}
+		return tag, &pgpBodyReader{r: r, n: length}, nil
+	}
+
+	length, partial, err := readPGPLength(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return b[0] & 0x3f, &pgpBodyReader{r: r, n: length, partial: partial}, nil
+}
+
+// readPGPLength reads a new format body length. partial is set when more of
+// the body follows this part.
+func readPGPLength(r io.Reader) (int64, bool, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return 0, false, errBadPGP
+	}
+	switch first := int64(b[0]); {
+	case first < 192:
+		return first, false, nil
+	case first < 224:
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return 0, false, errBadPGP
+		}
+		return (first-192)<<8 + int64(b[0]) + 192, false, nil
+	case first < 255:
+		return 1 << uint(first&0x1f), true, nil
+	}
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, false, errBadPGP
+	}
+	return int64(binary.BigEndian.Uint32(b[:])), false, nil
+}
+
+// pgpBodyReader reads the body of a packet, following partial body lengths.
+type pgpBodyReader struct {
+	r       io.Reader
+	n       int64
+	partial bool
+}
+
+func (p *pgpBodyReader) Read(b []byte) (int, error) {
+	for p.n == 0 {
+		if !p.partial {
+			return 0, io.EOF
+		}
+		var err error
+		if p.n, p.partial, err = readPGPLength(p.r); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > p.n {
+		b = b[:p.n]
+	}
+	n, err := p.r.Read(b)
+	p.n -= int64(n)
+	if err == io.EOF {
+		if p.n > 0 || p.partial {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// readPGPBody reads the whole body of a packet that isn't expected to be
+// large.
+func readPGPBody(body io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, pgpMaxPacketSize+1))
+	if err != nil || len(b) > pgpMaxPacketSize {
+		return nil, errBadPGP
+	}
+	return b, nil
+}
+
+// pgpLength encodes a new format body length.
+func pgpLength(length int) []byte {
+	switch {
+	case length < 192:
+		return []byte{byte(length)}
+	case length < 8384:
+		length -= 192
+		return []byte{byte(length>>8) + 192, byte(length)}
+	}
+	b := []byte{255, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(length))
+	return b
+}
+
+// pgpPacket encodes a packet with a new format header.
+func pgpPacket(tag byte, body []byte) []byte {
+	b := append([]byte{0xc0 | tag}, pgpLength(len(body))...)
+	return append(b, body...)
+}
+
+// pgpPartialWriter writes a packet whose length isn't known up front using
+// partial body lengths. Close must be called to write the last part.
+type pgpPartialWriter struct {
+	w       io.Writer
+	tag     byte
+	buf     []byte
+	started bool
+}
+
+func newPGPPartialWriter(w io.Writer, tag byte) *pgpPartialWriter {
+	return &pgpPartialWriter{w: w, tag: tag, buf: make([]byte, 0, pgpPartialSize)}
+}
+
+func (p *pgpPartialWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		// a full part is held back until more arrives, since the last part
+		// needs a regular length
+		if len(p.buf) == pgpPartialSize {
+			if err := p.flush(append(p.header(), 0xe0|pgpPartialBits)); err != nil {
+				return n, err
+			}
+		}
+
+		r := copy(p.buf[len(p.buf):pgpPartialSize], b)
+		p.buf = p.buf[:len(p.buf)+r]
+		b = b[r:]
+		n += r
+	}
+	return n, nil
+}
+
+// header returns the tag byte if it hasn't been written yet.
+func (p *pgpPartialWriter) header() []byte {
+	if p.started {
+		return nil
+	}
+	p.started = true
+	return []byte{0xc0 | p.tag}
+}
+
+// flush writes length followed by the buffered part of the body.
+func (p *pgpPartialWriter) flush(length []byte) error {
+	if _, err := p.w.Write(length); err != nil {
+		return err
+	}
+	_, err := p.w.Write(p.buf)
+	p.buf = p.buf[:0]
+	return err
+}
+
+// Close writes the last part of the body. It doesn't close the underlying
+// writer.
+func (p *pgpPartialWriter) Close() error {
+	return p.flush(append(p.header(), pgpLength(len(p.buf))...))
+}
+
+// decodePGPArmor decodes each ASCII armored block in contents and returns
+// them joined together. Contents without armor are returned as they are.
+func decodePGPArmor(contents []byte) ([]byte, error) {
+	if !bytes.Contains(contents, []byte("-----BEGIN PGP ")) {
+		return contents, nil
+	}
+
+	var decoded []byte
+	lines := strings.Split(string(contents), "\n")
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(strings.TrimSpace(lines[i]), "-----BEGIN PGP ") {
+			continue
+		}
+
+		// armor headers end with a blank line
+		for i++; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+		}
+
+		var body strings.Builder
+		var checksum string
+		ended := false
+		for i++; i < len(lines); i++ {
+			line := strings.TrimSpace(lines[i])
+			if strings.HasPrefix(line, "-----END PGP ") {
+				ended = true
+				break
+			}
+			if strings.HasPrefix(line, "=") {
+				checksum = line[1:]
+				continue
+			}
+			body.WriteString(line)
+		}
+		if !ended {
+			return nil, errors.New("Armored OpenPGP data is missing its END line")
+		}
+
+		b, err := base64.StdEncoding.DecodeString(body.String())
+		if err != nil {
+			return nil, errors.New("Armored OpenPGP data isn't valid base64")
+		}
+		if checksum != "" {
+			sum, err := base64.StdEncoding.DecodeString(checksum)
+			if err != nil || len(sum) != 3 || uint32(sum[0])<<16|uint32(sum[1])<<8|uint32(sum[2]) != pgpCRC24(b) {
+				return nil, errors.New("Armored OpenPGP data has a bad checksum")
+			}
+		}
+		decoded = append(decoded, b...)
+	}
+	return decoded, nil
+}
+
+// encodePGPArmor returns the OpenPGP message b ASCII armored.
+func encodePGPArmor(b []byte) []byte {
+	var armored bytes.Buffer
+	armored.WriteString("-----BEGIN PGP MESSAGE-----\n\n")
+	encoded := base64.StdEncoding.EncodeToString(b)
+	for len(encoded) > 64 {
+		armored.WriteString(encoded[:64] + "\n")
+		encoded = encoded[64:]
+	}
+	if encoded != "" {
+		armored.WriteString(encoded + "\n")
+	}
+	crc := pgpCRC24(b)
+	armored.WriteString("=" + base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) + "\n")
+	armored.WriteString("-----END PGP MESSAGE-----\n")
+	return armored.Bytes()
+}
+
+// pgpCRC24 is the checksum at the end of armored data.
+func pgpCRC24(b []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, c := range b {
+		crc ^= uint32(c) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+// peekPGPMessage reports whether the next bytes in r start an OpenPGP
+// message without consuming them. Binary messages have no magic string, so
+// the first packet has to look like a session key packet gosecret can read.
+// That is unlikely enough for the random IV of a legacy file, which would
+// otherwise be decrypted with the key.
+func peekPGPMessage(r *bufio.Reader) bool {
+	if b, _ := r.Peek(len(pgpMessageArmor)); bytes.Equal(b, pgpMessageArmor) {
+		return true
+	}
+
+	b, _ := r.Peek(16)
+	if len(b) < 2 || b[0]&0x80 == 0 {
+		return false
+	}
+	var tag byte
+	var body []byte
+	if b[0]&0x40 == 0 {
+		tag = b[0] >> 2 & 0x0f
+		switch b[0] & 3 {
+		case 0:
+			body = b[2:]
+		case 1:
+			body = b[3:]
+		default:
+			return false
+		}
+	} else {
+		tag = b[0] & 0x3f
+		switch {
+		case b[1] < 192:
+			body = b[2:]
+		case b[1] < 224:
+			body = b[3:]
+		default:
+			return false
+		}
+	}
+
+	switch tag {
+	case pgpTagPKESK:
+		return len(body) >= 10 && body[0] == 3 && pgpEncryptionAlgorithm(body[9])
+	case pgpTagSKESK:
+		if len(body) < 3 || body[0] != 4 {
+			return false
+		}
+		_, ok := pgpCiphers[body[1]]
+		return ok && (body[2] == pgpS2KSimple || body[2] == pgpS2KSalted || body[2] == pgpS2KIterated)
+	}
+	return false
+}
+
+// pgpPKESK is a session key encrypted to a public key.
+type pgpPKESK struct {
+	keyID     uint64
+	algorithm byte
+	// the encrypted session key, which depends on the algorithm
+	body []byte
+}
+
+// pgpSKESK is a session key derived from a passphrase, or encrypted with a
+// key derived from one.
+type pgpSKESK struct {
+	cipher byte
+	s2k    *pgpS2K
+	// the encrypted session key, if any
+	encrypted []byte
+}
+
+// pgpSessionKey is the key and cipher the data of a message is encrypted
+// with.
+type pgpSessionKey struct {
+	cipher byte
+	key    []byte
+}
+
+func parsePGPPKESK(body []byte) (*pgpPKESK, error) {
+	if len(body) < 10 || body[0] != 3 {
+		return nil, errBadPGP
+	}
+	return &pgpPKESK{keyID: binary.BigEndian.Uint64(body[1:9]), algorithm: body[9], body: body[10:]}, nil
+}
+
+func parsePGPSKESK(body []byte) (*pgpSKESK, error) {
+	if len(body) < 2 || body[0] != 4 {
+		return nil, errors.New("Unsupported OpenPGP passphrase packet")
+	}
+	r := bytes.NewReader(body[2:])
+	s2k, err := readPGPS2K(r)
+	if err != nil {
+		return nil, err
+	}
+	return &pgpSKESK{cipher: body[1], s2k: s2k, encrypted: body[len(body)-r.Len():]}, nil
+}
+
+// sessionKey returns the session key for passphrase.
+func (s *pgpSKESK) sessionKey(passphrase []byte) (*pgpSessionKey, error) {
+	c, ok := pgpCiphers[s.cipher]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported OpenPGP cipher %d", s.cipher)
+	}
+	key, err := s.s2k.deriveKey(passphrase, c.keySize)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.encrypted) == 0 {
+		return &pgpSessionKey{cipher: s.cipher, key: key}, nil
+	}
+
+	block, err := c.newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]byte, len(s.encrypted))
+	cipher.NewCFBDecrypter(block, make([]byte, block.BlockSize())).XORKeyStream(decrypted, s.encrypted)
+
+	// a wrong passphrase gives a random cipher or a key of the wrong size
+	if inner, ok := pgpCiphers[decrypted[0]]; !ok || inner.keySize != len(decrypted)-1 {
+		return nil, errAuthFailed
+	}
+	return &pgpSessionKey{cipher: decrypted[0], key: decrypted[1:]}, nil
+}
+
+// newPGPDecryptReader reads the session key packets of an OpenPGP message
+// from r and returns a reader of the literal data in it. Armored messages are
+// read into memory first.
+func newPGPDecryptReader(r *bufio.Reader, c *credentials) (io.Reader, error) {
+	pkesks, skesks, body, err := readPGPSessionKeyPackets(r)
+	if err != nil {
+		return nil, err
+	}
+	sessionKeys, err := pgpSessionKeys(pkesks, skesks, c)
+	if err != nil {
+		return nil, err
+	}
+	return openPGPData(body, sessionKeys)
+}
+
+// readPGPSessionKeyPackets reads the session key packets of an OpenPGP
+// message from r, and returns them along with a reader of the body of the
+// encrypted data packet that follows them.
+func readPGPSessionKeyPackets(r *bufio.Reader) ([]*pgpPKESK, []*pgpSKESK, io.Reader, error) {
+	var in io.Reader = r
+	if b, _ := r.Peek(len(pgpMessageArmor)); bytes.Equal(b, pgpMessageArmor) {
+		armored, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		decoded, err := decodePGPArmor(armored)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		in = bytes.NewReader(decoded)
+	}
+
+	var pkesks []*pgpPKESK
+	var skesks []*pgpSKESK
+	for {
+		tag, body, err := readPGPPacket(in)
+		if err == io.EOF {
+			return nil, nil, nil, errBadPGP
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		switch tag {
+		case pgpTagPKESK, pgpTagSKESK:
+			b, err := readPGPBody(body)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if tag == pgpTagPKESK {
+				p, err := parsePGPPKESK(b)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				pkesks = append(pkesks, p)
+			} else {
+				s, err := parsePGPSKESK(b)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				skesks = append(skesks, s)
+			}
+		case pgpTagMarker:
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, nil, nil, err
+			}
+		case pgpTagSEIPD:
+			return pkesks, skesks, body, nil
+		case pgpTagSED:
+			return nil, nil, nil, errors.New("OpenPGP messages without a modification detection code aren't supported")
+		case pgpTagAEAD:
+			return nil, nil, nil, errors.New("OpenPGP messages encrypted with AEAD aren't supported")
+		default:
+			return nil, nil, nil, errBadPGP
+		}
+	}
+}
+
+// pgpSessionKeys returns the possible session keys of a message, unlocked
+// with the secret keys or passphrase in the credentials.
+func pgpSessionKeys(pkesks []*pgpPKESK, skesks []*pgpSKESK, c *credentials) ([]*pgpSessionKey, error) {
+	var missing []string
+	var keyErr error
+	for _, p := range pkesks {
+		found := false
+		for _, key := range c.pgpKeys {
+			// a key ID of zero hides the recipient, so every key is tried
+			if key.secret == nil || (p.keyID != 0 && p.keyID != key.keyID()) {
+				continue
+			}
+			found = true
+
+			if err := key.unlock(c.passphrase); err != nil {
+				keyErr = err
+				continue
+			}
+			sessionKey, err := key.decryptSessionKey(p)
+			if err != nil {
+				keyErr = err
+				continue
+			}
+			return []*pgpSessionKey{sessionKey}, nil
+		}
+		if !found {
+			missing = append(missing, formatPGPKeyID(p.keyID))
+		}
+	}
+
+	var sessionKeys []*pgpSessionKey
+	if len(c.passphrase) > 0 {
+		for _, s := range skesks {
+			sessionKey, err := s.sessionKey(c.passphrase)
+			if err == errAuthFailed {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			sessionKeys = append(sessionKeys, sessionKey)
+		}
+	}
+	if len(sessionKeys) > 0 {
+		return sessionKeys, nil
+	}
+
+	switch {
+	case keyErr != nil:
+		return nil, keyErr
+	case len(skesks) > 0 && len(c.passphrase) > 0:
+		return nil, errAuthFailed
+	case len(pkesks) > 0 && len(c.pgpKeys) > 0:
+		return nil, fmt.Errorf("OpenPGP message was encrypted to keys %s, none of which are in the keyring", strings.Join(missing, ", "))
+	}
+
+	// name what's needed when nothing given applies to this message
+	var needed []string
+	if len(pkesks) > 0 {
+		needed = append(needed, "a secret keyring with --pgp-keyring or $GOSECRET_PGP_KEYRING")
+	}
+	if len(skesks) > 0 {
+		needed = append(needed, "a passphrase with --passphrase or $GOSECRET_PASSPHRASE")
+	}
+	if len(needed) == 0 {
+		return nil, errBadPGP
+	}
+	return nil, fmt.Errorf("OpenPGP message can't be decrypted with what was given, please provide %s", strings.Join(needed, " or "))
+}
+
+// openPGPData returns a reader of the literal data in the encrypted data
+// packet body, decrypted with whichever of the session keys passes the quick
+// check at the start of it.
+func openPGPData(body io.Reader, sessionKeys []*pgpSessionKey) (io.Reader, error) {
+	var version [1]byte
+	if _, err := io.ReadFull(body, version[:]); err != nil {
+		return nil, errBadPGP
+	}
+	if version[0] != 1 {
+		return nil, fmt.Errorf("Unsupported OpenPGP encrypted data version %d", version[0])
+	}
+
+	// the data starts with a block of random bytes and a repeat of the
+	// last two, enough to tell whether the session key is right
+	head := make([]byte, 16+2)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errBadPGP
+	}
+	head = head[:n]
+
+	for _, sessionKey := range sessionKeys {
+		c, ok := pgpCiphers[sessionKey.cipher]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported OpenPGP cipher %d", sessionKey.cipher)
+		}
+		block, err := c.newCipher(sessionKey.key)
+		if err != nil {
+			return nil, err
+		}
+		size := block.BlockSize()
+		if len(head) < size+2 {
+			return nil, errBadPGP
+		}
+
+		stream := cipher.NewCFBDecrypter(block, make([]byte, size))
+		prefix := make([]byte, size+2)
+		stream.XORKeyStream(prefix, head[:size+2])
+		if prefix[size-2] != prefix[size] || prefix[size-1] != prefix[size+1] {
+			continue
+		}
+
+		mdc := &pgpMDCReader{
+			r:    &cipher.StreamReader{S: stream, R: io.MultiReader(bytes.NewReader(head[size+2:]), body)},
+			hash: sha1.New(),
+		}
+		mdc.hash.Write(prefix)
+		return readPGPLiteral(mdc, mdc, true)
+	}
+	return nil, errAuthFailed
+}
+
+// readPGPLiteral finds the literal data packet in r, which holds the
+// decrypted packets of a message, and returns a reader of its contents.
+// Once the contents are read, the rest of mdc is read to check the
+// modification detection code.
+func readPGPLiteral(r io.Reader, mdc *pgpMDCReader, decompress bool) (io.Reader, error) {
+	for {
+		tag, body, err := readPGPPacket(r)
+		if err == io.EOF {
+			return nil, errBadPGP
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case pgpTagCompressed:
+			if !decompress {
+				return nil, errBadPGP
+			}
+			var algorithm [1]byte
+			if _, err := io.ReadFull(body, algorithm[:]); err != nil {
+				return nil, errBadPGP
+			}
+			var decompressed io.Reader
+			switch algorithm[0] {
+			case 0:
+				decompressed = body
+			case 1:
+				decompressed = flate.NewReader(body)
+			case 2:
+				if decompressed, err = zlib.NewReader(body); err != nil {
+					return nil, errAuthFailed
+				}
+			case 3:
+				decompressed = bzip2.NewReader(body)
+			default:
+				return nil, fmt.Errorf("Unsupported OpenPGP compression algorithm %d", algorithm[0])
+			}
+			return readPGPLiteral(decompressed, mdc, false)
+		case pgpTagLiteral:
+			// the format, file name and date aren't needed
+			var header [2]byte
+			if _, err := io.ReadFull(body, header[:]); err != nil {
+				return nil, errBadPGP
+			}
+			if _, err := io.ReadFull(body, make([]byte, int(header[1])+4)); err != nil {
+				return nil, errBadPGP
+			}
+			return &pgpLiteralReader{r: body, mdc: mdc}, nil
+		case pgpTagOnePassSig, pgpTagSignature, pgpTagMarker:
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errBadPGP
+		}
+	}
+}
+
+// pgpLiteralReader reads the contents of a literal data packet, then checks
+// the modification detection code of the message it is in.
+type pgpLiteralReader struct {
+	r   io.Reader
+	mdc *pgpMDCReader
+}
+
+func (p *pgpLiteralReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err == io.EOF {
+		if _, err := io.Copy(ioutil.Discard, p.mdc); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// pgpMDCReader passes on the decrypted data of a message, holding back the
+// modification detection code packet at the end. It is checked against the
+// SHA-1 of everything before it once the data runs out.
+type pgpMDCReader struct {
+	r       io.Reader
+	hash    hash.Hash
+	buf     []byte
+	scratch [4096]byte
+	eof     bool
+	err     error
+}
+
+func (m *pgpMDCReader) Read(p []byte) (int, error) {
+	for {
+		if m.err != nil {
+			return 0, m.err
+		}
+
+		// everything but what could be the MDC packet can be passed on
+		if len(m.buf) > pgpMDCSize {
+			n := copy(p, m.buf[:len(m.buf)-pgpMDCSize])
+			m.hash.Write(m.buf[:n])
+			m.buf = m.buf[n:]
+			return n, nil
+		}
+		if m.eof {
+			m.err = m.check()
+			continue
+		}
+
+		n, err := m.r.Read(m.scratch[:])
+		m.buf = append(m.buf, m.scratch[:n]...)
+		if err == io.EOF {
+			m.eof = true
+		} else if err != nil {
+			m.err = err
+		}
+	}
+}
+
+// check returns io.EOF if the MDC packet is intact.
+func (m *pgpMDCReader) check() error {
+	if len(m.buf) != pgpMDCSize || m.buf[0] != 0xd3 || m.buf[1] != sha1.Size {
+		return errAuthFailed
+	}
+	m.hash.Write(m.buf[:2])
+	if !hmac.Equal(m.hash.Sum(nil), m.buf[2:]) {
+		return errAuthFailed
+	}
+	return io.EOF
+}
+
+// pgpWriter encrypts everything written to it as the literal data of an
+// OpenPGP message. Close must be called to finish the message.
+type pgpWriter struct {
+	literal *pgpPartialWriter
+	mdc     hash.Hash
+	data    io.Writer
+	seipd   *pgpPartialWriter
+	closed  bool
+}
+
+// newPGPWriter writes the session key packets of a new message to w, one for
+// each of the keys and one for the passphrase if it isn't empty, and returns
+// a writer that encrypts into w.
+func newPGPWriter(w io.Writer, keys []*pgpKey, passphrase []byte) (*pgpWriter, error) {
+	if len(keys) == 0 && len(passphrase) == 0 {
+		return nil, errors.New("Please provide a keyring with --pgp-keyring or a passphrase with --passphrase to encrypt an OpenPGP message")
+	}
+
+	c := pgpCiphers[pgpDefaultCipher]
+	sessionKey := &pgpSessionKey{cipher: pgpDefaultCipher, key: make([]byte, c.keySize)}
+	if _, err := io.ReadFull(rand.Reader, sessionKey.key); err != nil {
+		return nil, err
+	}
+
+	var header []byte
+	for _, key := range keys {
+		body, err := key.encryptSessionKey(sessionKey)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, pgpPacket(pgpTagPKESK, body)...)
+	}
+	if len(passphrase) > 0 {
+		body, err := newPGPSKESK(passphrase, sessionKey)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, pgpPacket(pgpTagSKESK, body)...)
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	block, err := c.newCipher(sessionKey.key)
+	if err != nil {
+		return nil, err
+	}
+	p := &pgpWriter{seipd: newPGPPartialWriter(w, pgpTagSEIPD), mdc: sha1.New()}
+	if _, err := p.seipd.Write([]byte{1}); err != nil {
+		return nil, err
+	}
+	encrypted := &cipher.StreamWriter{S: cipher.NewCFBEncrypter(block, make([]byte, block.BlockSize())), W: p.seipd}
+	p.data = io.MultiWriter(p.mdc, encrypted)
+
+	prefix := make([]byte, block.BlockSize()+2)
+	if _, err := io.ReadFull(rand.Reader, prefix[:block.BlockSize()]); err != nil {
+		return nil, err
+	}
+	copy(prefix[block.BlockSize():], prefix[block.BlockSize()-2:])
+	if _, err := p.data.Write(prefix); err != nil {
+		return nil, err
+	}
+
+	// binary data with no file name or date
+	p.literal = newPGPPartialWriter(p.data, pgpTagLiteral)
+	if _, err := p.literal.Write([]byte{'b', 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *pgpWriter) Write(b []byte) (int, error) {
+	if p.closed {
+		return 0, errors.New("Write to a closed OpenPGP message")
+	}
+	return p.literal.Write(b)
+}
+
+// Close writes the rest of the literal data and the modification detection
+// code. It doesn't close the underlying writer.
+func (p *pgpWriter) Close() error {
+	if p.closed {
+		return errors.New("OpenPGP message is already closed")
+	}
+	p.closed = true
+	if err := p.literal.Close(); err != nil {
+		return err
+	}
+	if _, err := p.data.Write([]byte{0xd3, sha1.Size}); err != nil {
+		return err
+	}
+	if _, err := p.data.Write(p.mdc.Sum(nil)); err != nil {
+		return err
+	}
+	return p.seipd.Close()
+}
+
+// newPGPSKESK returns the body of a packet with sessionKey encrypted with a
+// key derived from passphrase.
+func newPGPSKESK(passphrase []byte, sessionKey *pgpSessionKey) ([]byte, error) {
+	s2k, err := newPGPS2K()
+	if err != nil {
+		return nil, err
+	}
+	c := pgpCiphers[pgpDefaultCipher]
+	key, err := s2k.deriveKey(passphrase, c.keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := c.newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := append([]byte{sessionKey.cipher}, sessionKey.key...)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCFBEncrypter(block, make([]byte, block.BlockSize())).XORKeyStream(encrypted, plain)
+
+	body := append([]byte{4, pgpDefaultCipher}, s2k.marshal()...)
+	return append(body, encrypted...), nil
+}
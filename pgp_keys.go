@@ -0,0 +1,1260 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/dsa"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/golang.org/x/crypto/cast5"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+// OpenPGP keys are read from a keyring, which is what gpg --export or
+// gpg --export-secret-keys writes, armored or not. Messages are encrypted to
+// one key of each certificate in the keyring and decrypted with whichever
+// secret key they were encrypted to. Keys protected with a passphrase are
+// unlocked with the passphrase from the flags.
+//
+// The keyring is trusted as it is, but its self signatures are only followed
+// once they have been checked against the primary key, so keys and flags
+// added by someone else are ignored. Their key flags, expiry and revocations
+// are followed when picking the key to encrypt to, the same way gpg would.
+
+// public key algorithms
+const (
+	pgpRSA        = 1
+	pgpRSAEncrypt = 2
+	pgpElGamal    = 16
+	pgpDSA        = 17
+	pgpECDH       = 18
+	pgpECDSA      = 19
+	pgpEdDSA      = 22
+)
+
+// symmetric algorithms
+const (
+	pgpCipher3DES   = 2
+	pgpCipherCAST5  = 3
+	pgpCipherAES128 = 7
+	pgpCipherAES192 = 8
+	pgpCipherAES256 = 9
+)
+
+// hash algorithms
+const (
+	pgpMD5    = 1
+	pgpSHA1   = 2
+	pgpSHA256 = 8
+	pgpSHA384 = 9
+	pgpSHA512 = 10
+	pgpSHA224 = 11
+)
+
+// string-to-key specifiers
+const (
+	pgpS2KSimple   = 0
+	pgpS2KSalted   = 1
+	pgpS2KIterated = 3
+	pgpS2KGNU      = 101
+)
+
+// key flags that allow encryption
+const pgpFlagsEncrypt = 0x04 | 0x08
+
+type pgpCipher struct {
+	keySize   int
+	newCipher func(key []byte) (cipher.Block, error)
+}
+
+var pgpCiphers = map[byte]pgpCipher{
+	pgpCipher3DES: {24, des.NewTripleDESCipher},
+	pgpCipherCAST5: {16, func(key []byte) (cipher.Block, error) {
+		return cast5.NewCipher(key)
+	}},
+	pgpCipherAES128: {16, aes.NewCipher},
+	pgpCipherAES192: {24, aes.NewCipher},
+	pgpCipherAES256: {32, aes.NewCipher},
+}
+
+var pgpHashes = map[byte]func() hash.Hash{
+	pgpMD5:    md5.New,
+	pgpSHA1:   sha1.New,
+	pgpSHA256: sha256.New,
+	pgpSHA384: sha512.New384,
+	pgpSHA512: sha512.New,
+	pgpSHA224: sha256.New224,
+}
+
+// curves for ECDH, by OID
+var pgpCurves = map[string]ecdh.Curve{
+	"\x2b\x06\x01\x04\x01\x97\x55\x01\x05\x01": ecdh.X25519(),
+	"\x2a\x86\x48\xce\x3d\x03\x01\x07":         ecdh.P256(),
+	"\x2b\x81\x04\x00\x22":                     ecdh.P384(),
+	"\x2b\x81\x04\x00\x23":                     ecdh.P521(),
+}
+
+// curves for ECDSA, by OID
+var pgpSigningCurves = map[string]elliptic.Curve{
+	"\x2a\x86\x48\xce\x3d\x03\x01\x07": elliptic.P256(),
+	"\x2b\x81\x04\x00\x22":             elliptic.P384(),
+	"\x2b\x81\x04\x00\x23":             elliptic.P521(),
+}
+
+// pgpOIDEd25519 is the curve of EdDSA keys.
+const pgpOIDEd25519 = "\x2b\x06\x01\x04\x01\xda\x47\x0f\x01"
+
+// hashes signatures can be made with. MD5 is too weak to trust.
+var pgpSignatureHashes = map[byte]crypto.Hash{
+	pgpSHA1:   crypto.SHA1,
+	pgpSHA256: crypto.SHA256,
+	pgpSHA384: crypto.SHA384,
+	pgpSHA512: crypto.SHA512,
+	pgpSHA224: crypto.SHA224,
+}
+
+// pgpEncryptionAlgorithm reports whether a public key algorithm is one
+// gosecret can encrypt to and decrypt with.
+func pgpEncryptionAlgorithm(algorithm byte) bool {
+	switch algorithm {
+	case pgpRSA, pgpRSAEncrypt, pgpElGamal, pgpECDH:
+		return true
+	}
+	return false
+}
+
+// pgpS2K turns a passphrase into a key.
+type pgpS2K struct {
+	mode  byte
+	hash  byte
+	salt  []byte
+	count int
+}
+
+// newPGPS2K returns a salted and iterated S2K with the most iterations
+// OpenPGP allows.
+func newPGPS2K() (*pgpS2K, error) {
+	s := &pgpS2K{mode: pgpS2KIterated, hash: pgpSHA256, salt: make([]byte, 8), count: pgpS2KCount(0xff)}
+	if _, err := io.ReadFull(rand.Reader, s.salt); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// pgpS2KCount decodes the one byte iteration count of an S2K.
+func pgpS2KCount(c byte) int {
+	return (16 + int(c&15)) << (uint(c>>4) + 6)
+}
+
+func readPGPS2K(r *bytes.Reader) (*pgpS2K, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, errBadPGP
+	}
+	s := &pgpS2K{mode: b[0], hash: b[1]}
+
+	switch s.mode {
+	case pgpS2KSimple:
+	case pgpS2KSalted, pgpS2KIterated:
+		s.salt = make([]byte, 8)
+		if _, err := io.ReadFull(r, s.salt); err != nil {
+			return nil, errBadPGP
+		}
+		if s.mode == pgpS2KIterated {
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, errBadPGP
+			}
+			s.count = pgpS2KCount(c)
+		}
+	case pgpS2KGNU:
+		// a gpg extension for secret keys that aren't there, either left
+		// out of the export or on a smartcard
+		var gnu [4]byte
+		if _, err := io.ReadFull(r, gnu[:]); err != nil || string(gnu[:3]) != "GNU" {
+			return nil, errBadPGP
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("Unsupported OpenPGP string-to-key specifier %d", s.mode)
+	}
+
+	if _, ok := pgpHashes[s.hash]; !ok {
+		return nil, fmt.Errorf("Unsupported OpenPGP hash algorithm %d", s.hash)
+	}
+	return s, nil
+}
+
+// marshal encodes an iterated S2K made by newPGPS2K.
+func (s *pgpS2K) marshal() []byte {
+	return append(append([]byte{s.mode, s.hash}, s.salt...), 0xff)
+}
+
+// deriveKey returns a key of size bytes derived from passphrase.
+func (s *pgpS2K) deriveKey(passphrase []byte, size int) ([]byte, error) {
+	newHash, ok := pgpHashes[s.hash]
+	if !ok || s.mode == pgpS2KGNU {
+		return nil, errors.New("Unsupported OpenPGP string-to-key specifier")
+	}
+
+	data := append(append([]byte{}, s.salt...), passphrase...)
+	total := len(data)
+	if s.mode == pgpS2KIterated && s.count > total {
+		total = s.count
+	}
+
+	// each hash is preloaded with one more zero byte than the last
+	var key []byte
+	for i := 0; len(key) < size; i++ {
+		h := newHash()
+		h.Write(make([]byte, i))
+		for written := 0; written < total; written += len(data) {
+			if total-written < len(data) {
+				h.Write(data[:total-written])
+			} else {
+				h.Write(data)
+			}
+		}
+		key = h.Sum(key)
+	}
+	return key[:size], nil
+}
+
+// pgpKey is a public key or subkey from a keyring, along with its secret key
+// if the keyring has one.
+type pgpKey struct {
+	algorithm   byte
+	created     uint32
+	fingerprint []byte
+	packet      []byte // the public part of the key packet, which signatures are over
+
+	// for checking signatures: an *rsa.PublicKey, *dsa.PublicKey,
+	// *ecdsa.PublicKey or ed25519.PublicKey, or nil if the key can't sign
+	verifier      crypto.PublicKey
+	signAlgorithm byte
+
+	// public key material, depending on the algorithm
+	rsa     *rsa.PublicKey
+	elgamal *pgpElGamalKey
+	ecdh    *pgpECDHKey
+
+	// secret key material as it is stored, possibly encrypted
+	secret *pgpSecretKey
+	// set once the secret key is unlocked
+	rsaPrivate  *rsa.PrivateKey
+	elgamalX    *big.Int
+	ecdhPrivate *ecdh.PrivateKey
+
+	// from the newest self signature
+	flags    byte
+	hasFlags bool
+	expires  uint32
+	signed   uint32
+	revoked  bool
+}
+
+type pgpElGamalKey struct {
+	p, g, y *big.Int
+}
+
+type pgpECDHKey struct {
+	oid       []byte
+	curve     ecdh.Curve
+	public    *ecdh.PublicKey
+	kdfHash   byte
+	kdfCipher byte
+}
+
+// pgpSecretKey is the secret part of a secret key packet.
+type pgpSecretKey struct {
+	usage  byte
+	cipher byte
+	s2k    *pgpS2K
+	iv     []byte
+	data   []byte
+}
+
+// pgpCert is a primary key and its subkeys.
+type pgpCert struct {
+	primary *pgpKey
+	subkeys []*pgpKey
+}
+
+// keyID is the last 8 bytes of the fingerprint.
+func (k *pgpKey) keyID() uint64 {
+	return binary.BigEndian.Uint64(k.fingerprint[len(k.fingerprint)-8:])
+}
+
+// formatPGPKeyID returns the printable form of a key ID, as gpg shows it.
+func formatPGPKeyID(id uint64) string {
+	return fmt.Sprintf("%016X", id)
+}
+
+// readPGPKeyring returns the certificates in a keyring, which can be
+// armored.
+func readPGPKeyring(contents []byte) ([]*pgpCert, error) {
+	decoded, err := decodePGPArmor(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*pgpCert
+	var last *pgpKey
+	var userID []byte
+	r := bytes.NewReader(decoded)
+	for {
+		tag, body, err := readPGPPacket(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("Keyring isn't a valid OpenPGP keyring")
+		}
+
+		switch tag {
+		case pgpTagPublicKey, pgpTagSecretKey, pgpTagPublicSubkey, pgpTagSecretSubkey:
+			b, err := readPGPBody(body)
+			if err != nil {
+				return nil, err
+			}
+			// keys of versions or algorithms that aren't supported are
+			// skipped along with their signatures
+			last, err = parsePGPKey(b, tag == pgpTagSecretKey || tag == pgpTagSecretSubkey)
+			if err != nil {
+				return nil, err
+			}
+			userID = nil
+
+			if tag == pgpTagPublicKey || tag == pgpTagSecretKey {
+				certs = append(certs, &pgpCert{primary: last})
+			} else if len(certs) > 0 && last != nil {
+				cert := certs[len(certs)-1]
+				cert.subkeys = append(cert.subkeys, last)
+			}
+		case pgpTagSignature:
+			b, err := readPGPBody(body)
+			if err != nil {
+				return nil, err
+			}
+			if len(certs) > 0 {
+				applyPGPSignature(certs[len(certs)-1], last, userID, b)
+			}
+		case pgpTagUserID:
+			if userID, err = readPGPBody(body); err != nil {
+				return nil, err
+			}
+		case pgpTagUserAttribute:
+			// certifications that follow are over the attribute
+			userID = nil
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, err
+			}
+		default:
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// certificates with a primary key that isn't supported are dropped
+	var supported []*pgpCert
+	for _, cert := range certs {
+		if cert.primary != nil {
+			supported = append(supported, cert)
+		}
+	}
+	if len(supported) == 0 {
+		return nil, errors.New("The keyring doesn't contain any OpenPGP keys")
+	}
+	return supported, nil
+}
+
+// parsePGPKey decodes a version 4 key packet. A nil key is returned for
+// other versions and unknown algorithms. Signing keys are returned with an
+// algorithm of zero, since their subkeys can still be used.
+func parsePGPKey(body []byte, secret bool) (*pgpKey, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, nil
+	}
+	k := &pgpKey{created: binary.BigEndian.Uint32(body[1:5]), algorithm: body[5]}
+	r := bytes.NewReader(body[6:])
+
+	var err error
+	switch k.algorithm {
+	case pgpRSA, pgpRSAEncrypt:
+		var n, e *big.Int
+		if n, err = readPGPMPI(r); err == nil {
+			e, err = readPGPMPI(r)
+		}
+		if err == nil {
+			if !e.IsInt64() || e.Int64() > 1<<31-1 {
+				return nil, errBadPGP
+			}
+			k.rsa = &rsa.PublicKey{N: n, E: int(e.Int64())}
+			if k.algorithm == pgpRSA {
+				k.verifier, k.signAlgorithm = k.rsa, pgpRSA
+			}
+		}
+	case pgpElGamal:
+		k.elgamal = &pgpElGamalKey{}
+		if k.elgamal.p, err = readPGPMPI(r); err == nil {
+			if k.elgamal.g, err = readPGPMPI(r); err == nil {
+				k.elgamal.y, err = readPGPMPI(r)
+			}
+		}
+	case pgpECDH:
+		k.ecdh, err = readPGPECDHKey(r)
+	case pgpDSA, pgpECDSA, pgpEdDSA:
+		// signing only, so only kept for checking signatures
+		if k.verifier, err = readPGPVerifier(r, k.algorithm); err != nil {
+			return nil, err
+		}
+		k.signAlgorithm, k.algorithm = k.algorithm, 0
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	public := body[:len(body)-r.Len()]
+	k.packet = public
+	h := sha1.New()
+	h.Write([]byte{0x99, byte(len(public) >> 8), byte(len(public))})
+	h.Write(public)
+	k.fingerprint = h.Sum(nil)
+
+	if secret && k.algorithm != 0 {
+		if k.secret, err = readPGPSecretKey(r); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// readPGPVerifier decodes the public key of a DSA, ECDSA or EdDSA key. A nil
+// key is returned for curves that aren't supported.
+func readPGPVerifier(r *bytes.Reader, algorithm byte) (crypto.PublicKey, error) {
+	if algorithm == pgpDSA {
+		var mpis [4]*big.Int
+		for i := range mpis {
+			var err error
+			if mpis[i], err = readPGPMPI(r); err != nil {
+				return nil, err
+			}
+		}
+		params := dsa.Parameters{P: mpis[0], Q: mpis[1], G: mpis[2]}
+		return &dsa.PublicKey{Parameters: params, Y: mpis[3]}, nil
+	}
+
+	oid, err := readPGPOID(r)
+	if err != nil {
+		return nil, err
+	}
+	point, err := readPGPMPIBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == pgpEdDSA {
+		if string(oid) != pgpOIDEd25519 {
+			return nil, nil
+		}
+		if len(point) != 33 || point[0] != 0x40 {
+			return nil, errBadPGP
+		}
+		return ed25519.PublicKey(point[1:]), nil
+	}
+
+	curve, ok := pgpSigningCurves[string(oid)]
+	if !ok {
+		return nil, nil
+	}
+	// the ECDH curve checks the point is on it
+	if _, err := decodePGPPoint(pgpCurves[string(oid)], point); err != nil {
+		return nil, err
+	}
+	size := (len(point) - 1) / 2
+	x := new(big.Int).SetBytes(point[1 : 1+size])
+	y := new(big.Int).SetBytes(point[1+size:])
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// readPGPECDHKey decodes the curve, point and KDF parameters of an ECDH key.
+func readPGPECDHKey(r *bytes.Reader) (*pgpECDHKey, error) {
+	oid, err := readPGPOID(r)
+	if err != nil {
+		return nil, err
+	}
+	point, err := readPGPMPIBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	var kdf [4]byte
+	if _, err := io.ReadFull(r, kdf[:]); err != nil || kdf[0] != 3 || kdf[1] != 1 {
+		return nil, errBadPGP
+	}
+
+	k := &pgpECDHKey{oid: oid, kdfHash: kdf[2], kdfCipher: kdf[3]}
+	curve, ok := pgpCurves[string(oid)]
+	if !ok {
+		return k, nil
+	}
+	k.curve = curve
+	if k.public, err = decodePGPPoint(curve, point); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// decodePGPPoint decodes a public point. Curve25519 points are prefixed with
+// 0x40 and the others are uncompressed.
+func decodePGPPoint(curve ecdh.Curve, point []byte) (*ecdh.PublicKey, error) {
+	if curve == ecdh.X25519() {
+		if len(point) != 33 || point[0] != 0x40 {
+			return nil, errBadPGP
+		}
+		point = point[1:]
+	}
+	public, err := curve.NewPublicKey(point)
+	if err != nil {
+		return nil, errBadPGP
+	}
+	return public, nil
+}
+
+// encodePGPPoint reverses decodePGPPoint.
+func encodePGPPoint(public *ecdh.PublicKey) []byte {
+	if public.Curve() == ecdh.X25519() {
+		return append([]byte{0x40}, public.Bytes()...)
+	}
+	return public.Bytes()
+}
+
+// readPGPSecretKey reads the secret part of a secret key packet. A nil key
+// is returned when the secret isn't in the keyring or is protected in a way
+// that isn't supported.
+func readPGPSecretKey(r *bytes.Reader) (*pgpSecretKey, error) {
+	usage, err := r.ReadByte()
+	if err != nil {
+		return nil, errBadPGP
+	}
+	s := &pgpSecretKey{usage: usage}
+
+	switch usage {
+	case 0:
+	case 254, 255:
+		if s.cipher, err = r.ReadByte(); err != nil {
+			return nil, errBadPGP
+		}
+		if s.s2k, err = readPGPS2K(r); err != nil {
+			return nil, err
+		}
+		c, ok := pgpCiphers[s.cipher]
+		if s.s2k.mode == pgpS2KGNU || !ok {
+			return nil, nil
+		}
+		block, err := c.newCipher(make([]byte, c.keySize))
+		if err != nil {
+			return nil, err
+		}
+		s.iv = make([]byte, block.BlockSize())
+		if _, err := io.ReadFull(r, s.iv); err != nil {
+			return nil, errBadPGP
+		}
+	default:
+		return nil, nil
+	}
+
+	s.data = make([]byte, r.Len())
+	r.Read(s.data)
+	return s, nil
+}
+
+// unlock decrypts the secret key with passphrase if it is protected.
+func (k *pgpKey) unlock(passphrase []byte) error {
+	if k.rsaPrivate != nil || k.elgamalX != nil || k.ecdhPrivate != nil {
+		return nil
+	}
+	id := formatPGPKeyID(k.keyID())
+
+	s := k.secret
+	data := s.data
+	if s.usage != 0 {
+		if len(passphrase) == 0 {
+			return fmt.Errorf("Secret key %s is protected, please provide its passphrase with --passphrase or $GOSECRET_PASSPHRASE", id)
+		}
+		c := pgpCiphers[s.cipher]
+		key, err := s.s2k.deriveKey(passphrase, c.keySize)
+		if err != nil {
+			return err
+		}
+		block, err := c.newCipher(key)
+		if err != nil {
+			return err
+		}
+		data = make([]byte, len(s.data))
+		cipher.NewCFBDecrypter(block, s.iv).XORKeyStream(data, s.data)
+	}
+
+	// the key material is followed by a SHA-1 hash or a 16 bit checksum
+	wrong := fmt.Errorf("Passphrase for secret key %s is wrong", id)
+	if s.usage == 254 {
+		if len(data) < sha1.Size {
+			return wrong
+		}
+		sum := sha1.Sum(data[:len(data)-sha1.Size])
+		if subtle.ConstantTimeCompare(sum[:], data[len(data)-sha1.Size:]) != 1 {
+			return wrong
+		}
+		data = data[:len(data)-sha1.Size]
+	} else {
+		if len(data) < 2 || pgpChecksum(data[:len(data)-2]) != binary.BigEndian.Uint16(data[len(data)-2:]) {
+			return wrong
+		}
+		data = data[:len(data)-2]
+	}
+
+	r := bytes.NewReader(data)
+	switch k.algorithm {
+	case pgpRSA, pgpRSAEncrypt:
+		var mpis [4]*big.Int
+		for i := range mpis {
+			var err error
+			if mpis[i], err = readPGPMPI(r); err != nil {
+				return err
+			}
+		}
+		private := &rsa.PrivateKey{PublicKey: *k.rsa, D: mpis[0], Primes: []*big.Int{mpis[1], mpis[2]}}
+		if err := private.Validate(); err != nil {
+			return fmt.Errorf("Secret key %s is invalid", id)
+		}
+		private.Precompute()
+		k.rsaPrivate = private
+	case pgpElGamal:
+		x, err := readPGPMPI(r)
+		if err != nil {
+			return err
+		}
+		k.elgamalX = x
+	case pgpECDH:
+		if k.ecdh.curve == nil {
+			return fmt.Errorf("Secret key %s uses an unsupported curve", id)
+		}
+		d, err := readPGPMPIBytes(r)
+		if err != nil {
+			return err
+		}
+		if k.ecdhPrivate, err = decodePGPScalar(k.ecdh.curve, d); err != nil {
+			return fmt.Errorf("Secret key %s is invalid", id)
+		}
+	}
+	return nil
+}
+
+// decodePGPScalar decodes the secret scalar of an ECDH key. Curve25519
+// scalars are stored in reverse.
+func decodePGPScalar(curve ecdh.Curve, d []byte) (*ecdh.PrivateKey, error) {
+	size := pgpScalarSize(curve)
+	if len(d) > size {
+		return nil, errBadPGP
+	}
+	scalar := make([]byte, size)
+	copy(scalar[size-len(d):], d)
+	if curve == ecdh.X25519() {
+		for i, j := 0, len(scalar)-1; i < j; i, j = i+1, j-1 {
+			scalar[i], scalar[j] = scalar[j], scalar[i]
+		}
+	}
+	return curve.NewPrivateKey(scalar)
+}
+
+func pgpScalarSize(curve ecdh.Curve) int {
+	switch curve {
+	case ecdh.P384():
+		return 48
+	case ecdh.P521():
+		return 66
+	}
+	return 32
+}
+
+// pgpChecksum is the sum of b modulo 65536.
+func pgpChecksum(b []byte) uint16 {
+	var sum uint16
+	for _, c := range b {
+		sum += uint16(c)
+	}
+	return sum
+}
+
+// readPGPMPI reads a multiprecision integer.
+func readPGPMPI(r *bytes.Reader) (*big.Int, error) {
+	b, err := readPGPMPIBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// readPGPMPIBytes reads a multiprecision integer as big endian bytes.
+func readPGPMPIBytes(r *bytes.Reader) ([]byte, error) {
+	var bits [2]byte
+	if _, err := io.ReadFull(r, bits[:]); err != nil {
+		return nil, errBadPGP
+	}
+	b := make([]byte, (int(binary.BigEndian.Uint16(bits[:]))+7)/8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errBadPGP
+	}
+	return b, nil
+}
+
+// pgpMPI encodes b as a multiprecision integer.
+func pgpMPI(b []byte) []byte {
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	bits := 0
+	if len(b) > 0 {
+		bits = (len(b)-1)*8 + big.NewInt(int64(b[0])).BitLen()
+	}
+	return append([]byte{byte(bits >> 8), byte(bits)}, b...)
+}
+
+// readPGPOID reads a curve OID, which is prefixed with its length.
+func readPGPOID(r *bytes.Reader) ([]byte, error) {
+	size, err := r.ReadByte()
+	if err != nil || size == 0 || size == 0xff {
+		return nil, errBadPGP
+	}
+	oid := make([]byte, size)
+	if _, err := io.ReadFull(r, oid); err != nil {
+		return nil, errBadPGP
+	}
+	return oid, nil
+}
+
+// signature types
+const (
+	pgpSigCertFirst     = 0x10
+	pgpSigCertLast      = 0x13
+	pgpSigSubkeyBinding = 0x18
+	pgpSigKeyRevoke     = 0x20
+	pgpSigSubkeyRevoke  = 0x28
+)
+
+// signature subpackets
+const (
+	pgpSubCreated   = 2
+	pgpSubExpires   = 9
+	pgpSubIssuer    = 16
+	pgpSubKeyFlags  = 27
+	pgpSubIssuerFPR = 33
+)
+
+// applyPGPSignature applies a self signature of cert to key, the last key
+// read before it. userID is the last user ID read since key, which
+// certifications of the primary key are over. Other signatures, and self
+// signatures that don't verify with the primary key, are ignored.
+func applyPGPSignature(cert *pgpCert, key *pgpKey, userID []byte, body []byte) {
+	if cert.primary == nil || key == nil || len(body) < 4 || body[0] != 4 {
+		return
+	}
+	sigType := body[1]
+
+	var created, expires uint32
+	var flags byte
+	var hashedSize int
+	hasFlags, fromPrimary := false, false
+	r := bytes.NewReader(body[4:])
+	for hashed := true; ; hashed = false {
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		area := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(r, area); err != nil {
+			return
+		}
+		if hashed {
+			hashedSize = len(body) - r.Len()
+		}
+
+		for len(area) > 0 {
+			var n int
+			switch {
+			case area[0] < 192:
+				n, area = int(area[0]), area[1:]
+			case area[0] < 255 && len(area) >= 2:
+				n, area = int(area[0]-192)<<8+int(area[1])+192, area[2:]
+			case area[0] == 255 && len(area) >= 5:
+				n, area = int(binary.BigEndian.Uint32(area[1:5])), area[5:]
+			default:
+				return
+			}
+			if n == 0 || n > len(area) {
+				return
+			}
+			sub, data := area[0]&0x7f, area[1:n]
+			area = area[n:]
+
+			switch {
+			case sub == pgpSubIssuer && len(data) == 8:
+				fromPrimary = binary.BigEndian.Uint64(data) == cert.primary.keyID()
+			case sub == pgpSubIssuerFPR && len(data) == 21:
+				fromPrimary = bytes.Equal(data[1:], cert.primary.fingerprint)
+			case !hashed:
+				// only the issuer can be trusted outside the hashed area
+			case sub == pgpSubCreated && len(data) == 4:
+				created = binary.BigEndian.Uint32(data)
+			case sub == pgpSubExpires && len(data) == 4:
+				expires = binary.BigEndian.Uint32(data)
+			case sub == pgpSubKeyFlags && len(data) > 0:
+				flags, hasFlags = data[0], true
+			}
+		}
+		if !hashed {
+			break
+		}
+	}
+	if !fromPrimary {
+		return
+	}
+
+	// what the signature is over, besides its own hashed part
+	var signed [][]byte
+	switch {
+	case sigType == pgpSigKeyRevoke:
+		signed = [][]byte{cert.primary.signedPacket()}
+	case (sigType == pgpSigSubkeyRevoke || sigType == pgpSigSubkeyBinding) && key != cert.primary:
+		signed = [][]byte{cert.primary.signedPacket(), key.signedPacket()}
+	case sigType >= pgpSigCertFirst && sigType <= pgpSigCertLast && key == cert.primary && userID != nil:
+		prefix := make([]byte, 5)
+		prefix[0] = 0xb4
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(userID)))
+		signed = [][]byte{cert.primary.signedPacket(), prefix, userID}
+	default:
+		return
+	}
+	if !cert.primary.verifySignature(body, hashedSize, signed, r) {
+		return
+	}
+
+	switch sigType {
+	case pgpSigKeyRevoke:
+		cert.primary.revoked = true
+	case pgpSigSubkeyRevoke:
+		key.revoked = true
+	default:
+		// the newest signature wins
+		if created < key.signed {
+			return
+		}
+		key.signed, key.expires = created, expires
+		key.flags, key.hasFlags = flags, hasFlags
+	}
+}
+
+// signedPacket returns the key packet the way signatures over it hash it.
+func (k *pgpKey) signedPacket() []byte {
+	return append([]byte{0x99, byte(len(k.packet) >> 8), byte(len(k.packet))}, k.packet...)
+}
+
+// verifySignature reports whether body is a valid version 4 signature by
+// the key over signed. The first hashedSize bytes of body are hashed along
+// with signed, and r holds the rest of the signature after its subpackets.
+func (k *pgpKey) verifySignature(body []byte, hashedSize int, signed [][]byte, r *bytes.Reader) bool {
+	hash, ok := pgpSignatureHashes[body[3]]
+	if !ok || k.verifier == nil || body[2] != k.signAlgorithm {
+		return false
+	}
+	h := hash.New()
+	for _, b := range signed {
+		h.Write(b)
+	}
+	h.Write(body[:hashedSize])
+	trailer := []byte{4, 0xff, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(trailer[2:], uint32(hashedSize))
+	h.Write(trailer)
+	digest := h.Sum(nil)
+
+	// the first two bytes of the digest are a quick check
+	var left [2]byte
+	if _, err := io.ReadFull(r, left[:]); err != nil || !bytes.Equal(left[:], digest[:2]) {
+		return false
+	}
+
+	switch key := k.verifier.(type) {
+	case *rsa.PublicKey:
+		sig, err := readPGPMPIBytes(r)
+		if err != nil || len(sig) > key.Size() {
+			return false
+		}
+		padded := make([]byte, key.Size())
+		copy(padded[len(padded)-len(sig):], sig)
+		return rsa.VerifyPKCS1v15(key, hash, digest, padded) == nil
+	case ed25519.PublicKey:
+		sig := make([]byte, ed25519.SignatureSize)
+		for i := 0; i < 2; i++ {
+			b, err := readPGPMPIBytes(r)
+			if err != nil || len(b) > 32 {
+				return false
+			}
+			copy(sig[32*i+32-len(b):], b)
+		}
+		return ed25519.Verify(key, digest, sig)
+	}
+
+	rs, err := readPGPMPI(r)
+	if err != nil {
+		return false
+	}
+	ss, err := readPGPMPI(r)
+	if err != nil {
+		return false
+	}
+	switch key := k.verifier.(type) {
+	case *dsa.PublicKey:
+		// the digest is cut down to the size of q
+		if n := (key.Q.BitLen() + 7) / 8; len(digest) > n {
+			digest = digest[:n]
+		}
+		return dsa.Verify(key, digest, rs, ss)
+	case *ecdsa.PublicKey:
+		return ecdsa.Verify(key, digest, rs, ss)
+	}
+	return false
+}
+
+// expired reports whether the key has expired by now.
+func (k *pgpKey) expired(now time.Time) bool {
+	return k.expires != 0 && now.Unix() >= int64(k.created)+int64(k.expires)
+}
+
+// canEncrypt reports whether the key can be encrypted to now.
+func (k *pgpKey) canEncrypt(now time.Time) bool {
+	if !pgpEncryptionAlgorithm(k.algorithm) || k.revoked || k.expired(now) {
+		return false
+	}
+	if k.algorithm == pgpECDH && (k.ecdh.curve == nil || !pgpKEKSupported(k.ecdh.kdfCipher)) {
+		return false
+	}
+	return !k.hasFlags || k.flags&pgpFlagsEncrypt != 0
+}
+
+// encryptionKey returns the key to encrypt to now: the newest subkey that
+// can be used, or else the primary key. It returns nil when there isn't one.
+func (c *pgpCert) encryptionKey(now time.Time) *pgpKey {
+	if c.primary.revoked || c.primary.expired(now) {
+		return nil
+	}
+	var key *pgpKey
+	for _, k := range c.subkeys {
+		// subkeys without a binding signature that verifies aren't part of the
+		// certificate
+		if k.signed != 0 && k.canEncrypt(now) && (key == nil || k.created >= key.created) {
+			key = k
+		}
+	}
+	if key == nil && c.primary.canEncrypt(now) {
+		key = c.primary
+	}
+	return key
+}
+
+// decryptSessionKey decrypts the session key in p with the unlocked secret
+// key.
+func (k *pgpKey) decryptSessionKey(p *pgpPKESK) (*pgpSessionKey, error) {
+	if p.algorithm != k.algorithm && !(p.algorithm == pgpRSA && k.algorithm == pgpRSAEncrypt) {
+		return nil, errBadPGP
+	}
+	r := bytes.NewReader(p.body)
+
+	var message []byte
+	switch k.algorithm {
+	case pgpRSA, pgpRSAEncrypt:
+		c, err := readPGPMPIBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		size := k.rsa.Size()
+		if len(c) > size {
+			return nil, errAuthFailed
+		}
+		padded := make([]byte, size)
+		copy(padded[size-len(c):], c)
+		if message, err = rsa.DecryptPKCS1v15(nil, k.rsaPrivate, padded); err != nil {
+			return nil, errAuthFailed
+		}
+	case pgpElGamal:
+		c1, err := readPGPMPI(r)
+		if err != nil {
+			return nil, err
+		}
+		c2, err := readPGPMPI(r)
+		if err != nil {
+			return nil, err
+		}
+		// m = c2 * c1^-x mod p, with c1^-x = c1^(p-1-x)
+		e := new(big.Int).Sub(k.elgamal.p, big.NewInt(1))
+		e.Sub(e, k.elgamalX)
+		m := new(big.Int).Exp(c1, e, k.elgamal.p)
+		m.Mul(m, c2).Mod(m, k.elgamal.p)
+		if message = unpadPKCS1(m.Bytes(), (k.elgamal.p.BitLen()+7)/8); message == nil {
+			return nil, errAuthFailed
+		}
+	case pgpECDH:
+		point, err := readPGPMPIBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.ReadByte()
+		if err != nil || int(size) != r.Len() {
+			return nil, errBadPGP
+		}
+		wrapped := make([]byte, size)
+		r.Read(wrapped)
+
+		ephemeral, err := decodePGPPoint(k.ecdh.curve, point)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := k.ecdhPrivate.ECDH(ephemeral)
+		if err != nil {
+			return nil, errAuthFailed
+		}
+		kek, err := k.ecdhKEK(shared)
+		if err != nil {
+			return nil, err
+		}
+		padded, err := aesKeyUnwrap(kek, wrapped)
+		if err != nil {
+			return nil, err
+		}
+		// remove the PKCS5 padding
+		n := int(padded[len(padded)-1])
+		if n == 0 || n > 8 || n > len(padded) {
+			return nil, errAuthFailed
+		}
+		for _, b := range padded[len(padded)-n:] {
+			if int(b) != n {
+				return nil, errAuthFailed
+			}
+		}
+		message = padded[:len(padded)-n]
+	}
+
+	// the cipher, the key and a checksum of the key
+	if len(message) < 3 {
+		return nil, errAuthFailed
+	}
+	sessionKey := &pgpSessionKey{cipher: message[0], key: message[1 : len(message)-2]}
+	c, ok := pgpCiphers[sessionKey.cipher]
+	if !ok || c.keySize != len(sessionKey.key) || pgpChecksum(sessionKey.key) != binary.BigEndian.Uint16(message[len(message)-2:]) {
+		return nil, errAuthFailed
+	}
+	return sessionKey, nil
+}
+
+// encryptSessionKey returns the body of a packet with sessionKey encrypted
+// to the key.
+func (k *pgpKey) encryptSessionKey(sessionKey *pgpSessionKey) ([]byte, error) {
+	message := append([]byte{sessionKey.cipher}, sessionKey.key...)
+	message = append(message, byte(pgpChecksum(sessionKey.key)>>8), byte(pgpChecksum(sessionKey.key)))
+
+	body := make([]byte, 10)
+	body[0] = 3
+	binary.BigEndian.PutUint64(body[1:9], k.keyID())
+	body[9] = k.algorithm
+
+	switch k.algorithm {
+	case pgpRSA, pgpRSAEncrypt:
+		c, err := rsa.EncryptPKCS1v15(rand.Reader, k.rsa, message)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, pgpMPI(c)...)
+	case pgpElGamal:
+		p := k.elgamal.p
+		padded, err := padPKCS1(message, (p.BitLen()+7)/8)
+		if err != nil {
+			return nil, err
+		}
+		// a random 1 <= x < p-1
+		x, err := rand.Int(rand.Reader, new(big.Int).Sub(p, big.NewInt(2)))
+		if err != nil {
+			return nil, err
+		}
+		x.Add(x, big.NewInt(1))
+		c1 := new(big.Int).Exp(k.elgamal.g, x, p)
+		c2 := new(big.Int).Exp(k.elgamal.y, x, p)
+		c2.Mul(c2, new(big.Int).SetBytes(padded)).Mod(c2, p)
+		body = append(body, pgpMPI(c1.Bytes())...)
+		body = append(body, pgpMPI(c2.Bytes())...)
+	case pgpECDH:
+		ephemeral, err := k.ecdh.curve.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(k.ecdh.public)
+		if err != nil {
+			return nil, err
+		}
+		kek, err := k.ecdhKEK(shared)
+		if err != nil {
+			return nil, err
+		}
+		// PKCS5 padding to a multiple of 8 bytes
+		n := 8 - len(message)%8
+		for i := 0; i < n; i++ {
+			message = append(message, byte(n))
+		}
+		wrapped, err := aesKeyWrap(kek, message)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, pgpMPI(encodePGPPoint(ephemeral.PublicKey()))...)
+		body = append(body, byte(len(wrapped)))
+		body = append(body, wrapped...)
+	default:
+		return nil, fmt.Errorf("Key %s can't be encrypted to", formatPGPKeyID(k.keyID()))
+	}
+	return body, nil
+}
+
+// pgpKEKSupported reports whether an ECDH key wraps session keys with a
+// cipher gosecret has.
+func pgpKEKSupported(c byte) bool {
+	return c == pgpCipherAES128 || c == pgpCipherAES192 || c == pgpCipherAES256
+}
+
+// ecdhKEK derives the key that wraps the session key from the shared secret
+// of an ECDH key, as in RFC 6637.
+func (k *pgpKey) ecdhKEK(shared []byte) ([]byte, error) {
+	newHash, ok := pgpHashes[k.ecdh.kdfHash]
+	if !ok || !pgpKEKSupported(k.ecdh.kdfCipher) {
+		return nil, fmt.Errorf("Key %s uses unsupported ECDH parameters", formatPGPKeyID(k.keyID()))
+	}
+
+	h := newHash()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(shared)
+	h.Write([]byte{byte(len(k.ecdh.oid))})
+	h.Write(k.ecdh.oid)
+	h.Write([]byte{pgpECDH, 3, 1, k.ecdh.kdfHash, k.ecdh.kdfCipher})
+	h.Write([]byte("Anonymous Sender    "))
+	h.Write(k.fingerprint)
+	return h.Sum(nil)[:pgpCiphers[k.ecdh.kdfCipher].keySize], nil
+}
+
+// padPKCS1 pads message to size bytes as in PKCS #1 v1.5 encryption.
+func padPKCS1(message []byte, size int) ([]byte, error) {
+	if len(message) > size-11 {
+		return nil, errors.New("Session key is too long for the key")
+	}
+	padded := make([]byte, size)
+	padded[1] = 2
+	ps := padded[2 : size-len(message)-1]
+	if _, err := io.ReadFull(rand.Reader, ps); err != nil {
+		return nil, err
+	}
+	for i := range ps {
+		for ps[i] == 0 {
+			if _, err := io.ReadFull(rand.Reader, ps[i:i+1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	copy(padded[size-len(message):], message)
+	return padded, nil
+}
+
+// unpadPKCS1 reverses padPKCS1 on m, which has lost its leading zeros. It
+// returns nil if the padding is wrong.
+func unpadPKCS1(m []byte, size int) []byte {
+	if len(m) != size-1 || m[0] != 2 {
+		return nil
+	}
+	i := bytes.IndexByte(m[1:], 0)
+	if i < 8 {
+		return nil
+	}
+	return m[i+2:]
+}
+
+// aesKeyWrapIV is the initial value of RFC 3394.
+var aesKeyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// aesKeyWrap wraps plain, a multiple of 8 bytes, with kek as in RFC 3394.
+func aesKeyWrap(kek, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(plain) / 8
+	out := make([]byte, 8+len(plain))
+	copy(out, aesKeyWrapIV)
+	copy(out[8:], plain)
+
+	var b [16]byte
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b[:8], out[:8])
+			copy(b[8:], out[8*i:8*i+8])
+			block.Encrypt(b[:], b[:])
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(b[:8])^t)
+			copy(out[8*i:], b[8:])
+		}
+	}
+	return out, nil
+}
+
+// aesKeyUnwrap reverses aesKeyWrap.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errBadPGP
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	out := make([]byte, len(wrapped))
+	copy(out, wrapped)
+
+	var b [16]byte
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(out[:8])^t)
+			copy(b[8:], out[8*i:8*i+8])
+			block.Decrypt(b[:], b[:])
+			copy(out[:8], b[:8])
+			copy(out[8*i:], b[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(out[:8], aesKeyWrapIV) != 1 {
+		return nil, errAuthFailed
+	}
+	return out[8:], nil
+}
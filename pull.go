@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"path/filepath"
+)
+
+// args. pull takes the union of the decrypt and download flags, so it shares
+// their variables.
+var pullFilenameArg string
+var pullDestinationFilenameArg string
+
+var pullDoc = `
+Usage: pull [options] file [destination file]
+
+Download a file from an s3 bucket and decrypt it in one step. The plaintext
+is only readable by the current user and the destination is replaced
+atomically, so a file that fails to decrypt never leaves partial output.
+If a destination file isn't specified the file is written under its own base name.
+`
+
+func pullAction() error {
+	// make sure that we have all of the required data
+	if decryptStructuredFlag || decryptFormatFlag != "" {
+		return errors.New("pull doesn't support --structured files")
+	}
+	if pullFilenameArg == "" {
+		return errors.New("Please provide a valid filename to pull")
+	}
+	if pullDestinationFilenameArg == "" {
+		pullDestinationFilenameArg = filepath.Base(pullFilenameArg)
+	}
+	if downloadBucketNameFlag == "" {
+		return errors.New("Please provide an S3 bucket name with --bucket or $GOSECRET_BUCKET")
+	}
+	if downloadAccessKeyFlag == "" {
+		return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+	}
+	if downloadSecretKeyFlag == "" {
+		return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+	}
+
+	c, err := decryptFlagCredentials()
+	if err != nil {
+		return err
+	}
+
+	config := newS3Config(downloadAccessKeyFlag, downloadSecretKeyFlag, downloadSessionTokenFlag, downloadRegionFlag)
+	if err := setS3Endpoint(config, downloadEndpointFlag, downloadPathStyleFlag, downloadCABundleFlag); err != nil {
+		return err
+	}
+	if err := setS3Retry(config, downloadMaxAttemptsFlag, downloadRetryDelayFlag, downloadRetryMaxDelayFlag); err != nil {
+		return err
+	}
+	state, err := loadS3State()
+	if err != nil {
+		return err
+	}
+	info, err := pull(downloadBucketNameFlag, pullFilenameArg, pullDestinationFilenameArg, c, config)
+	if err != nil {
+		return err
+	}
+	// pushing the file again will check it hasn't changed since
+	return state.record(downloadBucketNameFlag, pullFilenameArg, info)
+}
+
+// pullFlagInit initializes the flagset for the pull command
+func pullFlagInit(fs *flag.FlagSet) {
+	decryptFlagInit(fs)
+	downloadFlagInit(fs)
+}
+
+// pullFlagPostParse sets the filenames from the arguments provided by the flagset
+func pullFlagPostParse(fs *flag.FlagSet) {
+	if filename := fs.Arg(0); filename != "" {
+		pullFilenameArg = filename
+	}
+
+	if destFilename := fs.Arg(1); destFilename != "" {
+		pullDestinationFilenameArg = destFilename
+	}
+}
+
+// pull downloads remoteName from an s3 bucket and decrypts it into destFile
+// with the credentials, and returns the ETag and version of the download.
+func pull(bucket, remoteName, destFile string, c *credentials, config *s3util.Config) (*s3util.ObjectInfo, error) {
+	s3File, info, err := openS3FileVersion(bucket, remoteName, "", nil, config)
+	if err != nil {
+		return nil, err
+	}
+	defer s3File.Close()
+
+	// decrypt on the way down
+	decrypted, err := newDecryptReader(s3File, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(destFile, decrypted, 0600); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
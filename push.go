@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// args. push takes the union of the encrypt and upload flags, so it shares
+// their variables.
+var pushFilenameArg string
+var pushRemoteNameArg string
+
+var pushDoc = `
+Usage: push [options] file [remote name]
+
+Encrypt a file and upload it to an s3 bucket in one step. The ciphertext is
+streamed straight to S3 and never written to disk.
+If a remote name isn't specified the file is uploaded under its own base name.
+
+Like upload, push fails if someone else has uploaded the file since you
+last pulled or pushed it, unless --force is given.
+`
+
+func pushAction() error {
+	// make sure that we have all of the required data
+	if encryptStructuredFlag || encryptFormatFlag != "" {
+		return errors.New("push doesn't support --structured files")
+	}
+	if pushFilenameArg == "" {
+		return errors.New("Please provide a valid filename to push")
+	}
+	if pushRemoteNameArg == "" {
+		pushRemoteNameArg = filepath.Base(pushFilenameArg)
+	}
+	if uploadBucketNameFlag == "" {
+		return errors.New("Please provide an S3 bucket name with --bucket or $GOSECRET_BUCKET")
+	}
+	if uploadAccessKeyFlag == "" {
+		return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+	}
+	if uploadSecretKeyFlag == "" {
+		return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+	}
+
+	// derive the key before touching S3 so a bad key or passphrase doesn't
+	// leave a half started upload behind
+	h, key, err := encryptFlagHeader()
+	if err != nil {
+		return err
+	}
+
+	sse, err := sseHeaders(uploadSSEFlag, uploadSSEKMSKeyIDFlag, uploadSSECustomerKeyFlag)
+	if err != nil {
+		return err
+	}
+
+	state, err := loadS3State()
+	if err != nil {
+		return err
+	}
+	if !uploadForceFlag {
+		for k, vs := range state.conditionalHeaders(uploadBucketNameFlag, pushRemoteNameArg) {
+			sse[k] = vs
+		}
+	}
+
+	config := newS3Config(uploadAccessKeyFlag, uploadSecretKeyFlag, uploadSessionTokenFlag, uploadRegionFlag)
+	if err := setS3Endpoint(config, uploadEndpointFlag, uploadPathStyleFlag, uploadCABundleFlag); err != nil {
+		return err
+	}
+	if err := setS3Retry(config, uploadMaxAttemptsFlag, uploadRetryDelayFlag, uploadRetryMaxDelayFlag); err != nil {
+		return err
+	}
+	info, err := push(uploadBucketNameFlag, pushFilenameArg, pushRemoteNameArg, h, key, sse, config)
+	if err == s3util.ErrPreconditionFailed {
+		return s3ConflictError(uploadBucketNameFlag, pushRemoteNameArg, "")
+	}
+	if err != nil {
+		return err
+	}
+	return state.record(uploadBucketNameFlag, pushRemoteNameArg, info)
+}
+
+// pushFlagInit initializes the flagset for the push command
+func pushFlagInit(fs *flag.FlagSet) {
+	encryptFlagInit(fs)
+	uploadFlagInit(fs)
+}
+
+// pushFlagPostParse sets the filename and remote name from the arguments provided by the flagset
+func pushFlagPostParse(fs *flag.FlagSet) {
+	// make sure the input file is reachable
+	if filename := fs.Arg(0); filename != "" {
+		if fi, err := os.Stat(filename); err == nil && !fi.IsDir() {
+			pushFilenameArg = filename
+		}
+	}
+
+	if remoteName := fs.Arg(1); remoteName != "" {
+		pushRemoteNameArg = remoteName
+	}
+}
+
+// push encrypts a local file with the key for header h and streams the
+// result into an s3 bucket as remoteName with the extra headers sh, such as
+// the server-side encryption or conditional headers. It returns the ETag and
+// version of the uploaded file.
+func push(bucket, file, remoteName string, h *header, key []byte, sh http.Header, config *s3util.Config) (*s3util.ObjectInfo, error) {
+	// open the local file to push
+	localFile, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer localFile.Close()
+
+	s3File, err := createS3File(bucket, remoteName, sh, config)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := newStreamWriter(s3File, h, key)
+	if err != nil {
+		s3File.Abort()
+		return nil, err
+	}
+
+	// encrypt on the way up. closing would upload what was written so far,
+	// so a failure aborts the upload instead
+	if _, err := io.Copy(encrypted, localFile); err != nil {
+		s3File.Abort()
+		return nil, err
+	}
+	if err := encrypted.Close(); err != nil {
+		s3File.Abort()
+		return nil, err
+	}
+	if err := s3File.Close(); err != nil {
+		return nil, err
+	}
+	return s3File.Info(), nil
+}
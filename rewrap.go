@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// flags and args. rewrap also takes the decrypt flags for the current key,
+// passphrase or identity and the format of structured files.
+var rewrapNewKeyFlag stringsFlag
+var rewrapNewRecipientFlag stringsFlag
+var rewrapNewPassphraseFlag string
+var rewrapAddFlag bool
+var rewrapFilenameArg string
+
+var rewrapDoc = `
+Usage: rewrap [options] file
+
+Change the master keys of a file without re-encrypting it. The data key is
+unwrapped with --key, --passphrase or --identity and wrapped again with each
+--new-key, --new-recipient and --new-passphrase, replacing the old master
+keys unless --add is given. Only the header is rewritten, the encrypted
+contents stay the same.
+
+Use --structured for files encrypted with encrypt --structured.
+`
+
+func rewrapAction() error {
+	// make sure that we have all of the required data
+	if rewrapFilenameArg == "" {
+		return errors.New("Please provide a valid filename to rewrap")
+	}
+	if len(rewrapNewKeyFlag) == 0 && len(rewrapNewRecipientFlag) == 0 && rewrapNewPassphraseFlag == "" {
+		return errors.New("Please provide a new master key with --new-key, --new-recipient or --new-passphrase")
+	}
+
+	recipients, err := parseX25519Recipients(rewrapNewRecipientFlag)
+	if err != nil {
+		return err
+	}
+	m := &masterKeys{keys: rewrapNewKeyFlag.bytes(), recipients: recipients}
+	if rewrapNewPassphraseFlag != "" {
+		params, err := newScryptParams(defaultScryptLogN, defaultScryptR, defaultScryptP)
+		if err != nil {
+			return err
+		}
+		m.passphrase, m.scrypt = []byte(rewrapNewPassphraseFlag), params
+	}
+
+	fi, err := os.Stat(rewrapFilenameArg)
+	if err != nil {
+		return err
+	}
+
+	c, err := decryptFlagCredentials()
+	if err != nil {
+		return err
+	}
+	rewrapHeader := func(h *header) (*header, []byte, error) {
+		dataKey, err := unlockKey(h, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		rewrapped, err := h.rewrap(dataKey, m, rewrapAddFlag)
+		return rewrapped, dataKey, err
+	}
+
+	if decryptStructuredFlag || decryptFormatFlag != "" {
+		format, err := structuredFormat(rewrapFilenameArg, decryptFormatFlag)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(rewrapFilenameArg)
+		if err != nil {
+			return err
+		}
+		rewrapped, err := rewrapStructured(format, contents, rewrapHeader)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(rewrapFilenameArg, bytes.NewReader(rewrapped), fi.Mode().Perm())
+	}
+
+	file, err := os.Open(rewrapFilenameArg)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rewrapped, err := rewrap(file, rewrapHeader)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rewrapFilenameArg, rewrapped, fi.Mode().Perm())
+}
+
+// rewrapFlagInit initializes the flagset for the rewrap command
+func rewrapFlagInit(fs *flag.FlagSet) {
+	decryptFlagInit(fs)
+
+	fs.Var(&rewrapNewKeyFlag, "new-key", "A 16, 24 or 32 byte master key to wrap the data key with. Can be repeated")
+	fs.Var(&rewrapNewRecipientFlag, "new-recipient", "A public key from keygen to wrap the data key for. Can be repeated")
+	fs.StringVar(&rewrapNewPassphraseFlag, "new-passphrase", "", "A passphrase to wrap the data key with")
+	fs.BoolVar(&rewrapAddFlag, "add", false, "Keep the current master keys and add the new ones")
+}
+
+// rewrapFlagPostParse sets the filename from the arguments provided by the flagset
+func rewrapFlagPostParse(fs *flag.FlagSet) {
+	// make sure the file is reachable
+	if filename := fs.Arg(0); filename != "" {
+		if fi, err := os.Stat(filename); err == nil && !fi.IsDir() {
+			rewrapFilenameArg = filename
+		}
+	}
+}
+
+// rewrap reads the header of an encrypted file from r and returns a reader of
+// the file with the header replaced by rewrapHeader. The body is passed
+// through untouched.
+func rewrap(r io.Reader, rewrapHeader func(h *header) (*header, []byte, error)) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if peekAgeHeader(br) {
+		return nil, errors.New("age files can't be rewrapped, please decrypt and encrypt it again")
+	}
+	if peekPGPMessage(br) {
+		return nil, errors.New("OpenPGP messages can't be rewrapped, please decrypt and encrypt it again")
+	}
+	if !peekHeader(br) {
+		return nil, errors.New("Legacy files can't be rewrapped, please decrypt and encrypt it again")
+	}
+
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if h.version < 4 {
+		return nil, errors.New("File was encrypted without a data key, please decrypt and encrypt it again to rewrap it")
+	}
+
+	rewrapped, _, err := rewrapHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(rewrapped.marshal()), br), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// args. rollback takes the download flags for the bucket and AWS keys, so it
+// shares their variables.
+var rollbackFilenameArg string
+var rollbackVersionArg string
+
+var rollbackDoc = `
+Usage: rollback [options] file version
+
+Make an older version of a file in the --bucket the latest one again. The
+version is copied over the file, so the versions after it are kept and the
+rollback can itself be undone. Use history to find the version.
+`
+
+func rollbackAction() error {
+	// make sure that we have all of the required data
+	if rollbackFilenameArg == "" {
+		return errors.New("Please provide a valid filename to roll back")
+	}
+	if rollbackVersionArg == "" {
+		return errors.New("Please provide the version to roll back to, the history command lists them")
+	}
+	if downloadBucketNameFlag == "" {
+		return errors.New("Please provide an S3 bucket name with --bucket or $GOSECRET_BUCKET")
+	}
+	if downloadAccessKeyFlag == "" {
+		return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+	}
+	if downloadSecretKeyFlag == "" {
+		return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+	}
+
+	config := newS3Config(downloadAccessKeyFlag, downloadSecretKeyFlag, downloadSessionTokenFlag, downloadRegionFlag)
+	if err := setS3Endpoint(config, downloadEndpointFlag, downloadPathStyleFlag, downloadCABundleFlag); err != nil {
+		return err
+	}
+	if err := setS3Retry(config, downloadMaxAttemptsFlag, downloadRetryDelayFlag, downloadRetryMaxDelayFlag); err != nil {
+		return err
+	}
+
+	return rollback(downloadBucketNameFlag, rollbackFilenameArg, rollbackVersionArg, config, os.Stdout)
+}
+
+// rollbackFlagInit initializes the flagset for the rollback command
+func rollbackFlagInit(fs *flag.FlagSet) {
+	downloadFlagInit(fs)
+}
+
+// rollbackFlagPostParse sets the filename and version from the arguments provided by the flagset
+func rollbackFlagPostParse(fs *flag.FlagSet) {
+	rollbackFilenameArg = fs.Arg(0)
+	rollbackVersionArg = fs.Arg(1)
+}
+
+// rollback copies the version versionID of name in an s3 bucket over name,
+// making it the latest version, and reports what it did on w.
+func rollback(bucket, name, versionID string, config *s3util.Config, w io.Writer) error {
+	versions, err := s3History(bucket, name, config)
+	if err != nil {
+		return err
+	}
+
+	var version *s3util.Version
+	for i := range versions {
+		if versions[i].VersionId == versionID {
+			version = &versions[i]
+		}
+	}
+	switch {
+	case version == nil:
+		return fmt.Errorf("%s has no version %s", name, versionID)
+	case version.IsDeleteMarker():
+		return fmt.Errorf("Version %s of %s is a delete marker and can't be rolled back to", versionID, name)
+	case version.IsLatest:
+		fmt.Fprintf(w, "Version %s is already the latest version of %s\n", versionID, name)
+		return nil
+	}
+
+	source := (&url.URL{Path: "/" + bucket + "/" + name}).EscapedPath() + "?versionId=" + url.QueryEscape(versionID)
+	headers := http.Header{}
+	headers.Add("x-amz-acl", "private")
+	if err := s3util.Copy(generateS3Url(bucket, name), source, headers, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Rolled back %s to version %s\n", name, versionID)
+	return nil
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// flags and args. rotate takes the download flags for the bucket and AWS
+// keys when --s3 is given, so it shares their variables.
+var rotateOldKeyFlag string
+var rotateNewKeyFlag string
+var rotateS3Flag bool
+var rotateDryRunFlag bool
+var rotateLegacyFlag bool
+var rotatePathArg string
+
+var rotateDoc = `
+Usage: rotate [options] --old-key key --new-key key directory
+
+Re-encrypt every file in a directory under a new key. Each file is
+decrypted with --old-key and encrypted again with --new-key and a new data
+key, so nothing encrypted under the old key is left. Files are only
+replaced once they have been decrypted in full, and structured files stay
+structured.
+
+Files that other master keys, recipients or passphrases can decrypt too
+keep their data key, since it can't be wrapped for them again, and only
+the --old-key is swapped for the --new-key. Anyone who kept a copy from
+before can still decrypt them with the old key.
+
+With --s3 the objects under a prefix of the --bucket are rotated instead,
+and the prefix can be left out to rotate the whole bucket.
+
+Files already encrypted under the new key and not the old one are skipped,
+so an interrupted rotation can be resumed by running it again. Use
+--dry-run to see what would be rotated without changing anything.
+
+Files without a gosecret header are ignored unless --legacy is given, since
+legacy files can't be told apart from files that aren't encrypted at all.
+`
+
+func rotateAction() error {
+	// make sure that we have all of the required data
+	if rotatePathArg == "" && !rotateS3Flag {
+		return errors.New("Please provide a valid directory to rotate")
+	}
+	if rotateOldKeyFlag == "" {
+		return errors.New("Please provide the current key with --old-key or $GOSECRET_KEY")
+	}
+	if rotateNewKeyFlag == "" {
+		return errors.New("Please provide the key to rotate to with --new-key")
+	}
+	if rotateOldKeyFlag == rotateNewKeyFlag {
+		return errors.New("Please provide a new key that is different from the old one")
+	}
+	for _, key := range []string{rotateOldKeyFlag, rotateNewKeyFlag} {
+		if _, err := aes.NewCipher([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	var store rotateStore = &localRotateStore{dir: rotatePathArg}
+	if rotateS3Flag {
+		if downloadBucketNameFlag == "" {
+			return errors.New("Please provide an S3 bucket name with --bucket or $GOSECRET_BUCKET")
+		}
+		if downloadAccessKeyFlag == "" {
+			return errors.New("Please provide an AWS access key with --access-key or $GOSECRET_ACCESS_KEY")
+		}
+		if downloadSecretKeyFlag == "" {
+			return errors.New("Please provide an AWS secrety key with --secret-key or $GOSECRET_SECRET_KEY")
+		}
+		config := newS3Config(downloadAccessKeyFlag, downloadSecretKeyFlag, downloadSessionTokenFlag, downloadRegionFlag)
+		if err := setS3Endpoint(config, downloadEndpointFlag, downloadPathStyleFlag, downloadCABundleFlag); err != nil {
+			return err
+		}
+		if err := setS3Retry(config, downloadMaxAttemptsFlag, downloadRetryDelayFlag, downloadRetryMaxDelayFlag); err != nil {
+			return err
+		}
+		store = &s3RotateStore{bucket: downloadBucketNameFlag, prefix: rotatePathArg, config: config}
+	}
+
+	r := &rotation{oldKey: []byte(rotateOldKeyFlag), newKey: []byte(rotateNewKeyFlag), dryRun: rotateDryRunFlag, legacy: rotateLegacyFlag}
+	summary, err := r.run(store, os.Stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Println(summary)
+	if summary.failed > 0 {
+		return fmt.Errorf("%d files couldn't be rotated, please fix them and run rotate again", summary.failed)
+	}
+	return nil
+}
+
+// rotateFlagInit initializes the flagset for the rotate command
+func rotateFlagInit(fs *flag.FlagSet) {
+	downloadFlagInit(fs)
+
+	defaultKey := os.Getenv("GOSECRET_KEY")
+	fs.StringVar(&rotateOldKeyFlag, "old-key", defaultKey, "The 16, 24 or 32 byte key the files are encrypted with now. Defaults to value in $GOSECRET_KEY")
+	fs.StringVar(&rotateNewKeyFlag, "new-key", "", "The 16, 24 or 32 byte key to encrypt the files with")
+
+	fs.BoolVar(&rotateS3Flag, "s3", false, "Rotate the objects under a prefix of the S3 bucket instead of a local directory")
+	fs.BoolVar(&rotateDryRunFlag, "dry-run", false, "Report what would be rotated without changing anything")
+	fs.BoolVar(&rotateLegacyFlag, "legacy", false, "Also rotate files without a header as legacy files")
+}
+
+// rotateFlagPostParse sets the directory or prefix from the arguments provided by the flagset
+func rotateFlagPostParse(fs *flag.FlagSet) {
+	rotatePathArg = fs.Arg(0)
+}
+
+// rotateStore is a set of encrypted files that can be rotated, either a
+// local directory or an S3 prefix.
+type rotateStore interface {
+	// list returns the names of every file, including those in
+	// subdirectories.
+	list() ([]string, error)
+	open(name string) (io.ReadCloser, error)
+	// write replaces a file with what is read from r in one step, and
+	// leaves it as it was if reading fails.
+	write(name string, r io.Reader) error
+}
+
+// localRotateStore is a local directory.
+type localRotateStore struct {
+	dir string
+}
+
+func (s *localRotateStore) list() ([]string, error) {
+	var names []string
+	err := filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			names = append(names, path)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (s *localRotateStore) open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (s *localRotateStore) write(name string, r io.Reader) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, r, fi.Mode().Perm())
+}
+
+// s3RotateStore is a prefix of an s3 bucket.
+type s3RotateStore struct {
+	bucket string
+	prefix string
+	config *s3util.Config
+
+	// ETags of the files read, so files changed by someone else in the
+	// meantime aren't overwritten
+	etags map[string]string
+}
+
+func (s *s3RotateStore) list() ([]string, error) {
+	entries, err := listS3(s.bucket, s.prefix, true, s.config)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Key
+	}
+	return names, nil
+}
+
+func (s *s3RotateStore) open(name string) (io.ReadCloser, error) {
+	s3File, info, err := openS3FileVersion(s.bucket, name, "", nil, s.config)
+	if err != nil {
+		return nil, err
+	}
+	if s.etags == nil {
+		s.etags = map[string]string{}
+	}
+	s.etags[name] = info.ETag
+	return s3File, nil
+}
+
+func (s *s3RotateStore) write(name string, r io.Reader) error {
+	var headers http.Header
+	if etag := s.etags[name]; etag != "" {
+		headers = http.Header{"If-Match": {`"` + etag + `"`}}
+	}
+	s3File, err := createS3File(s.bucket, name, headers, s.config)
+	if err != nil {
+		return err
+	}
+	_, err = copyToS3(s3File, r)
+	if err == s3util.ErrPreconditionFailed {
+		return errors.New("File was changed by someone else while rotating it, please run rotate again")
+	}
+	return err
+}
+
+// rotateSummary counts what happened to the files of a rotation.
+type rotateSummary struct {
+	rotated int
+	skipped int
+	ignored int
+	failed  int
+	dryRun  bool
+}
+
+func (s *rotateSummary) String() string {
+	verb := "rotated"
+	if s.dryRun {
+		verb = "to rotate"
+	}
+	return fmt.Sprintf("%d %s, %d already rotated, %d ignored, %d failed", s.rotated, verb, s.skipped, s.ignored, s.failed)
+}
+
+// rotation re-encrypts files from one key to another.
+type rotation struct {
+	oldKey []byte
+	newKey []byte
+	dryRun bool
+	// rotate files without a header as legacy files
+	legacy bool
+}
+
+// what rotateFile did with a file
+const (
+	rotateRotated     = "rotated"
+	rotateWouldRotate = "would rotate"
+	rotateSkipped     = "skipped"
+	rotateIgnored     = "ignored"
+)
+
+// run rotates every file in the store, writing a line for each file to out.
+// A file that can't be rotated is reported and counted, and the rest are
+// still rotated. Only an error listing the files is returned.
+func (r *rotation) run(store rotateStore, out io.Writer) (*rotateSummary, error) {
+	names, err := store.list()
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &rotateSummary{dryRun: r.dryRun}
+	for _, name := range names {
+		status, err := r.rotateFile(store, name)
+		switch {
+		case err != nil:
+			summary.failed++
+			fmt.Fprintf(out, "failed %s: %s\n", name, err)
+			continue
+		case status == rotateSkipped:
+			summary.skipped++
+		case status == rotateIgnored:
+			summary.ignored++
+		default:
+			summary.rotated++
+		}
+		fmt.Fprintf(out, "%s %s\n", status, name)
+	}
+	return summary, nil
+}
+
+// rotateFile rotates a single file of the store and returns what was done.
+// Structured files are rotated in memory, and the rest are streamed from the
+// store back into it.
+func (r *rotation) rotateFile(store rotateStore, name string) (string, error) {
+	f, err := store.open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	in := bufio.NewReader(f)
+
+	// only files named like a structured file can be one
+	if _, err := structuredFormat(name, ""); err == nil && !peekHeader(in) {
+		contents, err := ioutil.ReadAll(in)
+		if err != nil {
+			return "", err
+		}
+		if format := detectStructuredFormat(name, contents); format != "" {
+			return r.rotateStructured(store, name, format, contents)
+		}
+		in = bufio.NewReader(bytes.NewReader(contents))
+	}
+
+	if !peekHeader(in) && !r.legacy {
+		return rotateIgnored, nil
+	}
+	var rawHeader bytes.Buffer
+	var h *header
+	if peekHeader(in) {
+		if h, err = readHeader(io.TeeReader(in, &rawHeader)); err != nil {
+			return "", err
+		}
+		if headerRotatedTo(h, r.oldKey, r.newKey) {
+			return rotateSkipped, nil
+		}
+	}
+
+	rotated, err := rotateStream(h, rawHeader.Bytes(), in, r.oldKey, r.newKey)
+	if err != nil {
+		return "", err
+	}
+	defer rotated.Close()
+	return r.write(store, name, rotated)
+}
+
+// rotateStructured rotates a structured file of the store.
+func (r *rotation) rotateStructured(store rotateStore, name, format string, contents []byte) (string, error) {
+	if rotatedTo(format, contents, r.oldKey, r.newKey) {
+		return rotateSkipped, nil
+	}
+	rotated, err := rotateContents(format, contents, r.oldKey, r.newKey)
+	if err != nil {
+		return "", err
+	}
+	return r.write(store, name, bytes.NewReader(rotated))
+}
+
+// write replaces a file of the store with the rotated file read from
+// rotated. A dry run only reads it, which still checks that it decrypts.
+func (r *rotation) write(store rotateStore, name string, rotated io.Reader) (string, error) {
+	if r.dryRun {
+		if _, err := io.Copy(ioutil.Discard, rotated); err != nil {
+			return "", err
+		}
+		return rotateWouldRotate, nil
+	}
+	if err := store.write(name, rotated); err != nil {
+		return "", err
+	}
+	return rotateRotated, nil
+}
+
+// rotatedTo reports whether the header of a file has a stanza for newKey and
+// none for oldKey, which is how a rotated file looks.
+func rotatedTo(format string, contents []byte, oldKey, newKey []byte) bool {
+	h, err := encryptedHeader(format, contents)
+	return err == nil && headerRotatedTo(h, oldKey, newKey)
+}
+
+// headerRotatedTo reports whether a header has a stanza for newKey and none
+// for oldKey.
+func headerRotatedTo(h *header, oldKey, newKey []byte) bool {
+	oldID, newID := keyID(oldKey), keyID(newKey)
+	hasNew := false
+	for _, s := range h.stanzas {
+		if s.kind != stanzaKey {
+			continue
+		}
+		if bytes.Equal(s.keyID, oldID) {
+			return false
+		}
+		hasNew = hasNew || bytes.Equal(s.keyID, newID)
+	}
+	return hasNew
+}
+
+// encryptedHeader returns the header of a file in format, or encrypted as a
+// whole if format is empty.
+func encryptedHeader(format string, contents []byte) (*header, error) {
+	if format == "" {
+		h, _, err := parseHeader(contents)
+		return h, err
+	}
+	doc, err := structuredFormats[format](contents)
+	if err != nil {
+		return nil, err
+	}
+	h, _, _, err := takeStructuredHeader(doc)
+	return h, err
+}
+
+// rotateContents decrypts a structured file with oldKey and returns it
+// encrypted with newKey. A file other master keys, recipients or passphrases
+// can decrypt too keeps its data key, and only the stanza for oldKey is
+// swapped for one for newKey, so they still can.
+func rotateContents(format string, contents []byte, oldKey, newKey []byte) ([]byte, error) {
+	// decrypting in full checks the file is intact before it's replaced
+	decrypted, err := decryptStructured(format, contents, &credentials{key: oldKey})
+	if err != nil {
+		return nil, err
+	}
+
+	if h, err := encryptedHeader(format, contents); err == nil && hasOtherStanzas(h, oldKey, newKey) {
+		return rewrapStructured(format, contents, swapKeyStanza(oldKey, newKey))
+	}
+
+	h, key, err := newKeyHeader(newKey)
+	if err != nil {
+		return nil, err
+	}
+	return encryptStructured(format, h, key, decrypted)
+}
+
+// rotateStream returns a reader of a whole file encrypted with newKey instead
+// of oldKey, given its header h and the raw bytes of it, or a nil header for
+// legacy files, and a reader of the rest of the file. The file is decrypted
+// as it is read, and reading fails if it isn't intact. As with
+// rotateContents, a file others can decrypt too only has the stanza for
+// oldKey swapped, and its payload is passed on as it is.
+func rotateStream(h *header, rawHeader []byte, r io.Reader, oldKey, newKey []byte) (io.ReadCloser, error) {
+	file := io.MultiReader(bytes.NewReader(rawHeader), r)
+	if h != nil && hasOtherStanzas(h, oldKey, newKey) {
+		rewrapped, _, err := swapKeyStanza(oldKey, newKey)(h)
+		if err != nil {
+			return nil, err
+		}
+		checked := newCheckedReader(r, func(payload io.Reader) error {
+			decrypted, err := newDecryptReader(io.MultiReader(bytes.NewReader(rawHeader), payload), &credentials{key: oldKey})
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, decrypted)
+			}
+			return err
+		})
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(rewrapped.marshal()), checked), checked}, nil
+	}
+
+	decrypted, err := newDecryptReader(file, &credentials{key: oldKey})
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		encrypted, err := newEncryptWriter(pw, newKey)
+		if err == nil {
+			_, err = io.Copy(encrypted, decrypted)
+		}
+		if err == nil {
+			err = encrypted.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// checkedReader passes on what it reads while a check reads the same in
+// another goroutine, and only ends once the check has passed, failing with
+// its error otherwise. Closing it stops the check.
+type checkedReader struct {
+	r      io.Reader
+	pw     *io.PipeWriter
+	done   chan error
+	err    error
+	closed bool
+}
+
+func newCheckedReader(r io.Reader, check func(io.Reader) error) *checkedReader {
+	pr, pw := io.Pipe()
+	c := &checkedReader{r: r, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := check(pr)
+		if err == nil {
+			// the rest still has to be taken for reading to carry on
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		c.done <- err
+	}()
+	return c
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.r.Read(p)
+	if n > 0 {
+		if _, err := c.pw.Write(p[:n]); err != nil {
+			c.err = err
+			return 0, err
+		}
+	}
+	if err == io.EOF {
+		c.pw.Close()
+		if c.err = <-c.done; c.err == nil {
+			c.err = io.EOF
+		}
+		c.closed = true
+		return n, c.err
+	}
+	return n, err
+}
+
+func (c *checkedReader) Close() error {
+	if !c.closed {
+		c.closed = true
+		c.pw.CloseWithError(io.ErrClosedPipe)
+	}
+	return nil
+}
+
+// hasOtherStanzas reports whether a header has stanzas for anything other
+// than oldKey and newKey.
+func hasOtherStanzas(h *header, oldKey, newKey []byte) bool {
+	oldID, newID := keyID(oldKey), keyID(newKey)
+	for _, s := range h.stanzas {
+		if !isRotatedStanza(s, oldID, newID) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRotatedStanza reports whether a stanza is for the old or new key of a
+// rotation, given their IDs.
+func isRotatedStanza(s *stanza, oldID, newID []byte) bool {
+	return s.kind == stanzaKey && (bytes.Equal(s.keyID, oldID) || bytes.Equal(s.keyID, newID))
+}
+
+// swapKeyStanza returns a function rewrapping a header, replacing the
+// stanzas for oldKey and newKey with a new one for newKey and keeping the
+// rest.
+func swapKeyStanza(oldKey, newKey []byte) func(h *header) (*header, []byte, error) {
+	oldID, newID := keyID(oldKey), keyID(newKey)
+	return func(h *header) (*header, []byte, error) {
+		dataKey, err := unlockKey(h, &credentials{key: oldKey})
+		if err != nil {
+			return nil, nil, err
+		}
+		kept := *h
+		kept.stanzas = nil
+		for _, s := range h.stanzas {
+			if !isRotatedStanza(s, oldID, newID) {
+				kept.stanzas = append(kept.stanzas, s)
+			}
+		}
+		rewrapped, err := kept.rewrap(dataKey, &masterKeys{keys: [][]byte{newKey}}, true)
+		return rewrapped, dataKey, err
+	}
+}
@@ -1,12 +1,198 @@
 package main
 
 import (
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// s3hostFmt formats the URL of a file from the bucket and the file name. It
+// is changed by setS3Endpoint to point at other S3-compatible services.
 var s3hostFmt = "https://%s.s3.amazonaws.com/%s"
 
+// defaultS3Endpoint is used for path-style URLs when no endpoint is given.
+const defaultS3Endpoint = "https://s3.amazonaws.com"
+
 // generateS3Url generates the URL required for the upload request to S3.
 func generateS3Url(bucket, file string) string {
 	return fmt.Sprintf(s3hostFmt, bucket, file)
 }
+
+// newS3Config creates the config needed by s3util for the given AWS keys.
+// Requests are signed with AWS Signature Version 4 for region, or us-east-1
+// if it is empty. sessionToken is only set for temporary credentials.
+func newS3Config(accessKey, secretKey, sessionToken, region string) *s3util.Config {
+	return &s3util.Config{
+		Keys: &s3.Keys{
+			AccessKey:     accessKey,
+			SecretKey:     secretKey,
+			SecurityToken: sessionToken,
+		},
+		Service: &s3.Service{
+			Domain: s3.DefaultService.Domain,
+			Region: region,
+		},
+	}
+}
+
+// setS3Endpoint points the S3 requests at endpoint, an http or https URL of
+// an S3-compatible service such as MinIO, Ceph or LocalStack. The bucket is
+// part of the host name unless pathStyle is set, in which case it is the
+// first part of the path. Nothing is changed when neither is given.
+//
+// If caBundle is set, the certificate of an https endpoint has to be signed
+// by one of the certificates in that PEM file instead of the system's.
+func setS3Endpoint(config *s3util.Config, endpoint string, pathStyle bool, caBundle string) error {
+	if caBundle != "" {
+		client, err := newS3Client(caBundle)
+		if err != nil {
+			return err
+		}
+		config.Client = client
+	}
+	if endpoint == "" && !pathStyle {
+		return nil
+	}
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Please provide an endpoint URL starting with http:// or https://, got %s", endpoint)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("Please provide an endpoint URL without a query or fragment")
+	}
+
+	// the format mustn't be thrown off by a % in the endpoint
+	host := strings.Replace(u.Host, "%", "%%", -1)
+	path := strings.Replace(strings.TrimSuffix(u.EscapedPath(), "/"), "%", "%%", -1)
+	if pathStyle {
+		s3hostFmt = u.Scheme + "://" + host + path + "/%s/%s"
+	} else {
+		s3hostFmt = u.Scheme + "://%s." + host + path + "/%s"
+	}
+	return nil
+}
+
+// s3RetryDefaults returns the defaults of the --max-attempts, --retry-delay
+// and --retry-max-delay flags, from $GOSECRET_MAX_ATTEMPTS,
+// $GOSECRET_RETRY_DELAY and $GOSECRET_RETRY_MAX_DELAY or else those of
+// s3util.
+func s3RetryDefaults() (int, time.Duration, time.Duration) {
+	maxAttempts, err := strconv.Atoi(os.Getenv("GOSECRET_MAX_ATTEMPTS"))
+	if err != nil {
+		maxAttempts = s3util.DefaultRetryPolicy.MaxAttempts
+	}
+	delay, err := time.ParseDuration(os.Getenv("GOSECRET_RETRY_DELAY"))
+	if err != nil {
+		delay = s3util.DefaultRetryPolicy.BaseDelay
+	}
+	maxDelay, err := time.ParseDuration(os.Getenv("GOSECRET_RETRY_MAX_DELAY"))
+	if err != nil {
+		maxDelay = s3util.DefaultRetryPolicy.MaxDelay
+	}
+	return maxAttempts, delay, maxDelay
+}
+
+// setS3Retry makes S3 requests that fail with a transient error, such as a
+// 503 or a reset connection, be tried up to maxAttempts times in all. The
+// wait in between starts at delay and doubles up to maxDelay, with some
+// jitter, unless S3 asks for a wait with Retry-After.
+func setS3Retry(config *s3util.Config, maxAttempts int, delay, maxDelay time.Duration) error {
+	if maxAttempts < 1 {
+		return errors.New("Please provide --max-attempts of 1 or more")
+	}
+	if delay < 0 || maxDelay < delay {
+		return errors.New("Please provide a --retry-delay that isn't negative or longer than --retry-max-delay")
+	}
+
+	policy := *s3util.DefaultRetryPolicy
+	policy.MaxAttempts, policy.BaseDelay, policy.MaxDelay = maxAttempts, delay, maxDelay
+	config.Retry = &policy
+	return nil
+}
+
+// newS3Client returns an http client that only trusts the certificates in
+// the PEM file caBundle.
+func newS3Client(caBundle string) (*http.Client, error) {
+	pem, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s doesn't contain any PEM encoded certificates", caBundle)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// sseHeaders returns the headers that ask S3 to encrypt an upload at rest
+// with mode: aes256 for keys managed by S3, aws:kms for a KMS key, which is
+// kmsKeyID or the account's default, or customer for customerKey. No headers
+// are returned when mode is empty.
+func sseHeaders(mode, kmsKeyID, customerKey string) (http.Header, error) {
+	mode = strings.ToLower(mode)
+	if kmsKeyID != "" && mode != "aws:kms" {
+		return nil, errors.New("Please provide --sse aws:kms to use --sse-kms-key-id")
+	}
+	if customerKey != "" && mode != "customer" {
+		return nil, errors.New("Please provide --sse customer to use --sse-customer-key")
+	}
+
+	headers := http.Header{}
+	switch mode {
+	case "":
+	case "aes256":
+		headers.Set("x-amz-server-side-encryption", "AES256")
+	case "aws:kms":
+		headers.Set("x-amz-server-side-encryption", "aws:kms")
+		if kmsKeyID != "" {
+			headers.Set("x-amz-server-side-encryption-aws-kms-key-id", kmsKeyID)
+		}
+	case "customer":
+		if customerKey == "" {
+			return nil, errors.New("Please provide the key to encrypt with --sse-customer-key or $GOSECRET_SSE_CUSTOMER_KEY")
+		}
+		return sseCustomerHeaders(customerKey)
+	default:
+		return nil, fmt.Errorf("Please provide aes256, aws:kms or customer with --sse, got %s", mode)
+	}
+	return headers, nil
+}
+
+// sseCustomerHeaders returns the headers that encrypt an object with
+// customerKey, a base64 encoded 256 bit key, or read an object encrypted
+// with it. S3 doesn't keep the key, so it is needed to download the object
+// again. No headers are returned when customerKey is empty.
+func sseCustomerHeaders(customerKey string) (http.Header, error) {
+	headers := http.Header{}
+	if customerKey == "" {
+		return headers, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(customerKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("Please provide a base64 encoded 32 byte key with --sse-customer-key")
+	}
+	sum := md5.Sum(key)
+	headers.Set("x-amz-server-side-encryption-customer-algorithm", "AES256")
+	headers.Set("x-amz-server-side-encryption-customer-key", customerKey)
+	headers.Set("x-amz-server-side-encryption-customer-key-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	return headers, nil
+}
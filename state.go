@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// s3State remembers the ETag and version of each file last downloaded from
+// or uploaded to a bucket, so uploading it again can check that nobody else
+// has uploaded it in between, and the progress of resumable uploads. It is
+// kept in $GOSECRET_STATE_FILE, or in ~/.gosecret/state.json.
+type s3State struct {
+	path    string
+	Files   map[string]*s3util.ObjectInfo  `json:"files"`
+	Uploads map[string]*s3util.UploadState `json:"uploads,omitempty"`
+}
+
+// s3StatePath returns where the state file is kept.
+func s3StatePath() (string, error) {
+	if path := os.Getenv("GOSECRET_STATE_FILE"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Couldn't find the state file, please set $GOSECRET_STATE_FILE: %s", err)
+	}
+	return filepath.Join(home, ".gosecret", "state.json"), nil
+}
+
+// loadS3State reads the state file, which is empty if it doesn't exist yet.
+func loadS3State() (*s3State, error) {
+	path, err := s3StatePath()
+	if err != nil {
+		return nil, err
+	}
+	s := &s3State{path: path, Files: map[string]*s3util.ObjectInfo{}, Uploads: map[string]*s3util.UploadState{}}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, s); err != nil {
+		return nil, fmt.Errorf("Couldn't read the state file %s: %s", path, err)
+	}
+	if s.Files == nil {
+		s.Files = map[string]*s3util.ObjectInfo{}
+	}
+	if s.Uploads == nil {
+		s.Uploads = map[string]*s3util.UploadState{}
+	}
+	return s, nil
+}
+
+// s3StateKey is the key of name in an s3 bucket in the state file. Buckets
+// of the same name at other endpoints than AWS are told apart by the host of
+// the endpoint, which AWS buckets are kept without.
+func s3StateKey(bucket, name string) string {
+	u, err := url.Parse(generateS3Url(bucket, ""))
+	if err != nil {
+		return bucket + "/" + name
+	}
+	host := strings.TrimPrefix(u.Host, bucket+".")
+	if host == "s3.amazonaws.com" {
+		return bucket + "/" + name
+	}
+	return host + "/" + bucket + "/" + name
+}
+
+// get returns what is known about name in an s3 bucket, or nil.
+func (s *s3State) get(bucket, name string) *s3util.ObjectInfo {
+	return s.Files[s3StateKey(bucket, name)]
+}
+
+// record remembers info about name in an s3 bucket and saves the state file.
+func (s *s3State) record(bucket, name string, info *s3util.ObjectInfo) error {
+	if info == nil || info.ETag == "" {
+		return nil
+	}
+	s.Files[s3StateKey(bucket, name)] = info
+	return s.save()
+}
+
+// recordUpload remembers the progress of a resumable upload of name into an
+// s3 bucket and saves the state file. A nil upload forgets it.
+func (s *s3State) recordUpload(bucket, name string, upload *s3util.UploadState) error {
+	if upload == nil {
+		delete(s.Uploads, s3StateKey(bucket, name))
+	} else {
+		s.Uploads[s3StateKey(bucket, name)] = upload
+	}
+	return s.save()
+}
+
+// save writes the state file.
+func (s *s3State) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, bytes.NewReader(append(b, '\n')), 0600)
+}
+
+// conditionalHeaders returns the headers that make an upload of name into an
+// s3 bucket fail unless the file there is still the one last seen, or that
+// there is no file there yet if it was never seen.
+func (s *s3State) conditionalHeaders(bucket, name string) http.Header {
+	headers := http.Header{}
+	if info := s.get(bucket, name); info != nil {
+		headers.Set("If-Match", `"`+info.ETag+`"`)
+	} else {
+		headers.Set("If-None-Match", "*")
+	}
+	return headers
+}
+
+// s3ConflictError explains that name was changed in an s3 bucket by someone
+// else, and how to carry on. A structured file being uploaded from
+// localFile can be merged.
+func s3ConflictError(bucket, name, localFile string) error {
+	msg := fmt.Sprintf("%s was changed in the %s bucket since you last downloaded or uploaded it, so it wasn't uploaded. Download it again and redo your changes", name, bucket)
+	if localFile != "" {
+		msg += fmt.Sprintf(", or merge them with gosecret merge %s out-file", localFile)
+	}
+	return fmt.Errorf("%s. Use --force to overwrite it anyway", msg)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// The body of a version 3 file is a sequence of chunks, each sealed with
+// AES-GCM under a payload key derived from the file key and the nonce in the
+// header. Every chunk but the last holds exactly chunkSize bytes of
+// plaintext. The last chunk is always shorter, possibly empty, and is sealed
+// with a final flag in its nonce so a file cut off at a chunk boundary can't
+// pass as complete.
+
+var errTruncated = errors.New("Encrypted file is truncated")
+
+// hkdfSHA256 derives a 32 byte key with HKDF-SHA256 (RFC 5869). A single
+// block of output is all gosecret ever needs.
+func hkdfSHA256(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// newPayloadAEAD returns the AES-256-GCM cipher used to seal the chunks of a
+// file with header h.
+func newPayloadAEAD(h *header, key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdfSHA256(key, h.nonce, "gosecret payload"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce builds the nonce for a chunk from its position in the stream
+// and whether it is the last one.
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// streamWriter encrypts everything written to it as chunks. Close must be
+// called to write the final chunk.
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	buf     []byte
+	counter uint64
+	closed  bool
+	err     error
+}
+
+// newStreamWriter writes header h to w and returns a writer that encrypts
+// into w with key. Since w can be any writer, this can feed the writer
+// returned by s3util.Create directly.
+func newStreamWriter(w io.Writer, h *header, key []byte) (*streamWriter, error) {
+	aead, err := newPayloadAEAD(h, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(h.marshal()); err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		w:    w,
+		aead: aead,
+		aad:  h.payloadAAD(),
+		buf:  make([]byte, 0, int(h.chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (n int, err error) {
+	if s.closed {
+		return 0, syscall.EINVAL
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	chunkSize := cap(s.buf) - s.aead.Overhead()
+	for len(p) > 0 {
+		r := copy(s.buf[len(s.buf):chunkSize], p)
+		s.buf = s.buf[:len(s.buf)+r]
+		p = p[r:]
+		n += r
+
+		// a full chunk is never the last one
+		if len(s.buf) == chunkSize {
+			if s.err = s.flush(false); s.err != nil {
+				return n, s.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush seals the buffered plaintext and writes it out.
+func (s *streamWriter) flush(last bool) error {
+	sealed := s.aead.Seal(s.buf[:0], chunkNonce(s.counter, last), s.buf, s.aad)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Close writes the final chunk. It doesn't close the underlying writer.
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return syscall.EINVAL
+	}
+	s.closed = true
+	if s.err != nil {
+		return s.err
+	}
+	return s.flush(true)
+}
+
+// streamReader authenticates and decrypts chunks as they are read.
+type streamReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	buf     []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// newStreamReader returns a reader that decrypts the body of a file from r.
+func newStreamReader(r io.Reader, h *header, key []byte) (*streamReader, error) {
+	aead, err := newPayloadAEAD(h, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		r:    r,
+		aead: aead,
+		aad:  h.payloadAAD(),
+		buf:  make([]byte, int(h.chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.readChunk()
+	}
+
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// readChunk reads and opens the next chunk. A chunk shorter than a full one
+// has to be the last.
+func (s *streamReader) readChunk() error {
+	n, err := io.ReadFull(s.r, s.buf)
+	last := false
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return errTruncated
+	default:
+		return err
+	}
+
+	plain, err := s.aead.Open(s.buf[:0], chunkNonce(s.counter, last), s.buf[:n], s.aad)
+	if err != nil {
+		return errAuthFailed
+	}
+	s.counter++
+	s.plain = plain
+	s.done = last
+	return nil
+}
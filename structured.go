@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Structured files keep their keys in cleartext and encrypt each leaf value
+// on its own, so a diff of an encrypted file shows which secrets changed.
+// Every value is sealed with its path as additional data so values can't be
+// moved between keys, and a MAC over all of the paths and ciphertexts in
+// document order catches values that are reordered or removed. The header
+// and MAC are kept under a top level metadata key.
+
+// structuredMetadataKey is the top level key holding the header and MAC.
+const structuredMetadataKey = "gosecret"
+
+// structuredDoc is a parsed structured file in one of the supported formats.
+type structuredDoc interface {
+	// encryptLeaves replaces every leaf value with its sealed marker, in
+	// document order.
+	encryptLeaves(l *leafCipher) error
+
+	// decryptLeaves restores every leaf value from its marker, in document
+	// order.
+	decryptLeaves(l *leafCipher) error
+
+	// hasMetadataKey reports whether the document uses the reserved metadata
+	// key anywhere at the top level.
+	hasMetadataKey() bool
+
+	// takeMetadata removes the metadata from the end of the document and
+	// returns the encoded header and MAC.
+	takeMetadata() (header, mac string, ok bool)
+
+	// addMetadata adds the encoded header and MAC to the end of the document.
+	addMetadata(header, mac string)
+
+	// eachLeaf calls fn with the path and plain string value of every leaf,
+	// in document order.
+	eachLeaf(fn func(path []string, value string) error) error
+
+	// eachRawLeaf calls fn with the path and raw value of every leaf, in
+	// document order. The raw value is what encryptLeaves would seal, so it
+	// keeps the type and style of the value.
+	eachRawLeaf(fn func(path []string, raw []byte) error) error
+
+	// setLeaf sets the leaf at path to a raw value from eachRawLeaf, adding
+	// it and anything leading to it that is missing. It reports false if
+	// path goes through a leaf or past the end of a sequence.
+	setLeaf(path []string, raw []byte) bool
+
+	// removeLeaf removes the leaf at path. It reports false for items of a
+	// sequence, since removing one would renumber the items after it.
+	removeLeaf(path []string) bool
+
+	encode() ([]byte, error)
+}
+
+// structuredFormats maps the names accepted by --format to their parsers.
+var structuredFormats = map[string]func(contents []byte) (structuredDoc, error){
+	"yaml":   parseYAMLDoc,
+	"json":   parseJSONDoc,
+	"dotenv": parseDotenvDoc,
+}
+
+// structuredFormat returns the format to use for filename. An explicit format
+// wins, otherwise it is guessed from the extension, ignoring a trailing .enc.
+func structuredFormat(filename, format string) (string, error) {
+	if format != "" {
+		if _, ok := structuredFormats[format]; !ok {
+			return "", fmt.Errorf("Unknown format %s, please use yaml, json or dotenv", format)
+		}
+		return format, nil
+	}
+
+	name := strings.TrimSuffix(filepath.Base(filename), ".enc")
+	switch filepath.Ext(name) {
+	case ".yml", ".yaml":
+		return "yaml", nil
+	case ".json":
+		return "json", nil
+	case ".env":
+		return "dotenv", nil
+	}
+	if strings.HasPrefix(name, ".env") {
+		return "dotenv", nil
+	}
+
+	return "", fmt.Errorf("Couldn't tell the format of %s, please use --format yaml, json or dotenv", filename)
+}
+
+const (
+	leafPrefix = "ENC["
+	leafSuffix = "]"
+)
+
+// leafCipher encrypts and decrypts the leaf values of a structured file and
+// accumulates the document MAC as it goes.
+type leafCipher struct {
+	aead cipher.AEAD
+	mac  hash.Hash
+}
+
+// newLeafCipher derives the leaf and MAC keys for a file with header h.
+func newLeafCipher(h *header, rawHeader, key []byte) (*leafCipher, error) {
+	block, err := aes.NewCipher(hkdfSHA256(key, h.nonce, "gosecret structured leaves"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, hkdfSHA256(key, h.nonce, "gosecret structured mac"))
+	mac.Write(rawHeader)
+	return &leafCipher{aead: aead, mac: mac}, nil
+}
+
+// seal encrypts a leaf value found at path and returns its marker.
+func (l *leafCipher) seal(path []string, value []byte) (string, error) {
+	nonce := make([]byte, l.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := l.aead.Seal(nonce, nonce, value, encodePath(path))
+	marker := leafPrefix + base64.StdEncoding.EncodeToString(sealed) + leafSuffix
+	l.addToMAC(path, marker)
+	return marker, nil
+}
+
+// open decrypts the leaf marker found at path.
+func (l *leafCipher) open(path []string, marker string) ([]byte, error) {
+	if !isLeafMarker(marker) {
+		return nil, fmt.Errorf("Value at %s isn't encrypted", strings.Join(path, "."))
+	}
+	l.addToMAC(path, marker)
+
+	sealed, err := base64.StdEncoding.DecodeString(marker[len(leafPrefix) : len(marker)-len(leafSuffix)])
+	if err != nil || len(sealed) < l.aead.NonceSize() {
+		return nil, fmt.Errorf("Value at %s isn't encrypted", strings.Join(path, "."))
+	}
+
+	nonce := sealed[:l.aead.NonceSize()]
+	value, err := l.aead.Open(nil, nonce, sealed[l.aead.NonceSize():], encodePath(path))
+	if err != nil {
+		return nil, fmt.Errorf("Authentication failed for the value at %s", strings.Join(path, "."))
+	}
+	return value, nil
+}
+
+func (l *leafCipher) addToMAC(path []string, marker string) {
+	l.mac.Write(encodePath(path))
+	l.mac.Write(encodePath([]string{marker}))
+}
+
+// encodePath length prefixes path and each of its parts so that different
+// paths never encode to the same bytes.
+func encodePath(path []string) []byte {
+	var b bytes.Buffer
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(path)))
+	b.Write(size[:])
+	for _, part := range path {
+		binary.BigEndian.PutUint32(size[:], uint32(len(part)))
+		b.Write(size[:])
+		b.WriteString(part)
+	}
+	return b.Bytes()
+}
+
+// isLeafMarker reports whether value is an encrypted leaf.
+func isLeafMarker(value string) bool {
+	return strings.HasPrefix(value, leafPrefix) && strings.HasSuffix(value, leafSuffix)
+}
+
+// encryptStructured encrypts every leaf value of a document in format with
+// the key for header h, leaving the keys, comments and ordering in place.
+func encryptStructured(format string, h *header, key, contents []byte) ([]byte, error) {
+	doc, err := structuredFormats[format](contents)
+	if err != nil {
+		return nil, err
+	}
+	if doc.hasMetadataKey() {
+		return nil, fmt.Errorf("The top level key %s is reserved, the file may already be encrypted", structuredMetadataKey)
+	}
+
+	rawHeader := h.marshal()
+	leaves, err := newLeafCipher(h, rawHeader, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.encryptLeaves(leaves); err != nil {
+		return nil, err
+	}
+
+	doc.addMetadata(base64.StdEncoding.EncodeToString(rawHeader), base64.StdEncoding.EncodeToString(leaves.mac.Sum(nil)))
+	return doc.encode()
+}
+
+// decryptStructured restores a document encrypted by encryptStructured, using
+// whichever of the credentials the header requires.
+func decryptStructured(format string, contents []byte, c *credentials) ([]byte, error) {
+	doc, err := structuredFormats[format](contents)
+	if err != nil {
+		return nil, err
+	}
+
+	h, rawHeader, mac, err := takeStructuredHeader(doc)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := unlockKey(h, c)
+	if err != nil {
+		return nil, err
+	}
+	leaves, err := newLeafCipher(h, rawHeader, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := doc.decryptLeaves(leaves); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, leaves.mac.Sum(nil)) {
+		return nil, errAuthFailed
+	}
+
+	return doc.encode()
+}
+
+// rewrapStructured replaces the header of a document encrypted by
+// encryptStructured with the one returned by rewrapHeader, which also returns
+// the data key. The encrypted values are kept as they are.
+func rewrapStructured(format string, contents []byte, rewrapHeader func(h *header) (*header, []byte, error)) ([]byte, error) {
+	doc, err := structuredFormats[format](contents)
+	if err != nil {
+		return nil, err
+	}
+
+	h, rawHeader, mac, err := takeStructuredHeader(doc)
+	if err != nil {
+		return nil, err
+	}
+	if h.version < 4 {
+		return nil, errors.New("File was encrypted without a data key, please decrypt and encrypt it again to rewrap it")
+	}
+	rewrapped, dataKey, err := rewrapHeader(h)
+	if err != nil {
+		return nil, err
+	}
+
+	// the old MAC has to check out before the values are vouched for under
+	// the new header
+	oldLeaves, err := newLeafCipher(h, rawHeader, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	rawRewrapped := rewrapped.marshal()
+	leaves, err := newLeafCipher(rewrapped, rawRewrapped, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	doc.eachLeaf(func(path []string, marker string) error {
+		oldLeaves.addToMAC(path, marker)
+		leaves.addToMAC(path, marker)
+		return nil
+	})
+	if !hmac.Equal(mac, oldLeaves.mac.Sum(nil)) {
+		return nil, errAuthFailed
+	}
+
+	doc.addMetadata(base64.StdEncoding.EncodeToString(rawRewrapped), base64.StdEncoding.EncodeToString(leaves.mac.Sum(nil)))
+	return doc.encode()
+}
+
+// detectStructuredFormat returns the format of a file encrypted with
+// --structured, guessed from its name and checked against its contents, or an
+// empty string for a file encrypted as a whole.
+func detectStructuredFormat(name string, contents []byte) string {
+	if hasHeader(contents) {
+		return ""
+	}
+	format, err := structuredFormat(name, "")
+	if err != nil {
+		return ""
+	}
+	doc, err := structuredFormats[format](contents)
+	if err != nil {
+		return ""
+	}
+	if _, _, ok := doc.takeMetadata(); !ok {
+		return ""
+	}
+	return format
+}
+
+// takeStructuredHeader removes the metadata from doc and returns the header
+// along with its raw bytes and the document MAC.
+func takeStructuredHeader(doc structuredDoc) (*header, []byte, []byte, error) {
+	encodedHeader, encodedMAC, ok := doc.takeMetadata()
+	if !ok {
+		return nil, nil, nil, errors.New("File doesn't have gosecret metadata, it may not be encrypted")
+	}
+	rawHeader, err := base64.StdEncoding.DecodeString(encodedHeader)
+	if err != nil {
+		return nil, nil, nil, errBadHeader
+	}
+	mac, err := base64.StdEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return nil, nil, nil, errAuthFailed
+	}
+
+	h, rest, err := parseHeader(rawHeader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(rest) > 0 || h.version < 3 {
+		return nil, nil, nil, errBadHeader
+	}
+	return h, rawHeader, mac, nil
+}
+
+// isIndexPath reports whether a missing container that next is the first
+// part below should be added as a sequence rather than a mapping. Only a
+// first item can start a new sequence.
+func isIndexPath(next string) bool {
+	return next == "0"
+}
+
+// appendPath returns a copy of path with part added to the end.
+func appendPath(path []string, part string) []string {
+	return append(append(make([]string, 0, len(path)+1), path...), part)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// dotenv metadata is stored in two assignments at the end of the file so the
+// result is still a valid dotenv file.
+var (
+	dotenvHeaderKey = structuredMetadataKey + "_header"
+	dotenvMACKey    = structuredMetadataKey + "_mac"
+)
+
+// dotenvLine is a line of a dotenv file. Blank lines and comments are kept
+// as they are, assignments are split into everything up to the = and the
+// value after it.
+type dotenvLine struct {
+	assignment bool
+	raw        string
+
+	// set for assignments
+	prefix string
+	key    string
+	value  string
+}
+
+// dotenvDoc is a dotenv file of KEY=value lines.
+type dotenvDoc struct {
+	lines           []*dotenvLine
+	trailingNewline bool
+}
+
+// parseDotenvDoc splits a dotenv file into lines. Values are kept exactly as
+// written, quotes included, so they round trip unchanged.
+func parseDotenvDoc(contents []byte) (structuredDoc, error) {
+	text := string(contents)
+	d := &dotenvDoc{trailingNewline: strings.HasSuffix(text, "\n")}
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return d, nil
+	}
+
+	for i, raw := range strings.Split(text, "\n") {
+		line := &dotenvLine{raw: raw}
+		trimmed := strings.TrimSpace(raw)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			eq := strings.Index(raw, "=")
+			if eq < 0 {
+				return nil, fmt.Errorf("Line %d of the dotenv file isn't a KEY=value assignment", i+1)
+			}
+			line.assignment = true
+			line.prefix = raw[:eq+1]
+			line.key = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(raw[:eq]), "export "))
+			line.value = raw[eq+1:]
+		}
+		d.lines = append(d.lines, line)
+	}
+	return d, nil
+}
+
+func (d *dotenvDoc) encryptLeaves(l *leafCipher) error {
+	for _, line := range d.assignments() {
+		marker, err := l.seal([]string{line.key}, []byte(line.value))
+		if err != nil {
+			return err
+		}
+		line.value = marker
+	}
+	return nil
+}
+
+func (d *dotenvDoc) decryptLeaves(l *leafCipher) error {
+	for _, line := range d.assignments() {
+		value, err := l.open([]string{line.key}, line.value)
+		if err != nil {
+			return err
+		}
+		line.value = string(value)
+	}
+	return nil
+}
+
+// eachLeaf passes values with their quotes removed. Unquoted values end at
+// a # comment.
+func (d *dotenvDoc) eachLeaf(fn func(path []string, value string) error) error {
+	for _, line := range d.assignments() {
+		if err := fn([]string{line.key}, dotenvValue(line.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dotenvDoc) eachRawLeaf(fn func(path []string, raw []byte) error) error {
+	for _, line := range d.assignments() {
+		if err := fn([]string{line.key}, []byte(line.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLeaf sets every assignment to the key, or adds one at the end.
+func (d *dotenvDoc) setLeaf(path []string, raw []byte) bool {
+	if len(path) != 1 {
+		return false
+	}
+	found := false
+	for _, line := range d.assignments() {
+		if line.key == path[0] {
+			line.value = string(raw)
+			found = true
+		}
+	}
+	if !found {
+		d.lines = append(d.lines, &dotenvLine{assignment: true, prefix: path[0] + "=", key: path[0], value: string(raw)})
+	}
+	return true
+}
+
+// removeLeaf removes every assignment to the key.
+func (d *dotenvDoc) removeLeaf(path []string) bool {
+	if len(path) != 1 {
+		return false
+	}
+	lines := d.lines[:0]
+	for _, line := range d.lines {
+		if !line.assignment || line.key != path[0] {
+			lines = append(lines, line)
+		}
+	}
+	d.lines = lines
+	return true
+}
+
+// dotenvValue returns the value of an assignment as the shell would see it.
+func dotenvValue(raw string) string {
+	value := strings.TrimSpace(raw)
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return value[1 : len(value)-1]
+		case value[0] == '"' && value[len(value)-1] == '"':
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted
+			}
+			return value[1 : len(value)-1]
+		}
+	}
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
+
+// assignments returns the KEY=value lines in order.
+func (d *dotenvDoc) assignments() []*dotenvLine {
+	var lines []*dotenvLine
+	for _, line := range d.lines {
+		if line.assignment {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (d *dotenvDoc) hasMetadataKey() bool {
+	for _, line := range d.assignments() {
+		if line.key == dotenvHeaderKey || line.key == dotenvMACKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dotenvDoc) takeMetadata() (string, string, bool) {
+	n := len(d.lines)
+	if n < 2 || d.lines[n-2].key != dotenvHeaderKey || d.lines[n-1].key != dotenvMACKey {
+		return "", "", false
+	}
+
+	header, mac := d.lines[n-2].value, d.lines[n-1].value
+	d.lines = d.lines[:n-2]
+	return header, mac, true
+}
+
+func (d *dotenvDoc) addMetadata(header, mac string) {
+	d.lines = append(d.lines,
+		&dotenvLine{assignment: true, prefix: dotenvHeaderKey + "=", key: dotenvHeaderKey, value: header},
+		&dotenvLine{assignment: true, prefix: dotenvMACKey + "=", key: dotenvMACKey, value: mac},
+	)
+}
+
+func (d *dotenvDoc) encode() ([]byte, error) {
+	lines := make([]string, len(d.lines))
+	for i, line := range d.lines {
+		if line.assignment {
+			lines[i] = line.prefix + line.value
+		} else {
+			lines[i] = line.raw
+		}
+	}
+
+	text := strings.Join(lines, "\n")
+	if d.trailingNewline {
+		text += "\n"
+	}
+	return []byte(text), nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// jsonValue is a decoded JSON value that remembers the order of object keys,
+// which encoding/json maps would lose.
+type jsonValue struct {
+	object bool
+	array  bool
+
+	// keys of an object, paired with values
+	keys []string
+	// values of an object or items of an array
+	values []*jsonValue
+	// encoded scalar
+	raw []byte
+}
+
+// jsonDoc is a JSON document whose root is an object.
+type jsonDoc struct {
+	root *jsonValue
+}
+
+// parseJSONDoc parses a JSON document whose root is an object.
+func parseJSONDoc(contents []byte) (structuredDoc, error) {
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.UseNumber()
+
+	root, err := parseJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("Structured files must contain a single JSON value")
+	}
+	if !root.object {
+		return nil, errors.New("Structured files must have an object at the top level")
+	}
+	return &jsonDoc{root: root}, nil
+}
+
+// parseJSONValue reads the next complete value from dec.
+func parseJSONValue(dec *json.Decoder) (*jsonValue, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		v := &jsonValue{object: t == '{', array: t == '['}
+		for dec.More() {
+			if v.object {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v.keys = append(v.keys, key.(string))
+			}
+			item, err := parseJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			v.values = append(v.values, item)
+		}
+		// consume the closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case string:
+		return &jsonValue{raw: encodeJSONString(t)}, nil
+	case json.Number:
+		return &jsonValue{raw: []byte(t)}, nil
+	case bool:
+		return &jsonValue{raw: []byte(strconv.FormatBool(t))}, nil
+	default:
+		return &jsonValue{raw: []byte("null")}, nil
+	}
+}
+
+// encodeJSONString quotes s without escaping HTML characters.
+func encodeJSONString(s string) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return bytes.TrimRight(b.Bytes(), "\n")
+}
+
+func (j *jsonDoc) encryptLeaves(l *leafCipher) error {
+	return walkJSON(j.root, nil, func(path []string, leaf *jsonValue) error {
+		marker, err := l.seal(path, leaf.raw)
+		if err != nil {
+			return err
+		}
+		leaf.raw = encodeJSONString(marker)
+		return nil
+	})
+}
+
+func (j *jsonDoc) decryptLeaves(l *leafCipher) error {
+	return walkJSON(j.root, nil, func(path []string, leaf *jsonValue) error {
+		var marker string
+		json.Unmarshal(leaf.raw, &marker)
+		value, err := l.open(path, marker)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(value) {
+			return errors.New("Encrypted value is malformed")
+		}
+		leaf.raw = value
+		return nil
+	})
+}
+
+// eachLeaf passes strings unquoted and every other scalar as written.
+func (j *jsonDoc) eachLeaf(fn func(path []string, value string) error) error {
+	return walkJSON(j.root, nil, func(path []string, leaf *jsonValue) error {
+		var value string
+		if err := json.Unmarshal(leaf.raw, &value); err != nil {
+			value = string(leaf.raw)
+		}
+		return fn(path, value)
+	})
+}
+
+func (j *jsonDoc) eachRawLeaf(fn func(path []string, raw []byte) error) error {
+	return walkJSON(j.root, nil, func(path []string, leaf *jsonValue) error {
+		return fn(path, leaf.raw)
+	})
+}
+
+func (j *jsonDoc) setLeaf(path []string, raw []byte) bool {
+	v := j.root
+	for i, part := range path {
+		// what to add if part is missing
+		missing := func() *jsonValue {
+			if i == len(path)-1 {
+				return &jsonValue{}
+			}
+			if isIndexPath(path[i+1]) {
+				return &jsonValue{array: true}
+			}
+			return &jsonValue{object: true}
+		}
+
+		var next *jsonValue
+		switch {
+		case v.object:
+			for k, key := range v.keys {
+				if key == part {
+					next = v.values[k]
+				}
+			}
+			if next == nil {
+				next = missing()
+				v.keys = append(v.keys, part)
+				v.values = append(v.values, next)
+			}
+		case v.array:
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 || n > len(v.values) {
+				return false
+			}
+			if n == len(v.values) {
+				v.values = append(v.values, missing())
+			}
+			next = v.values[n]
+		default:
+			return false
+		}
+		v = next
+	}
+	if v.object || v.array {
+		return false
+	}
+	v.raw = raw
+	return true
+}
+
+func (j *jsonDoc) removeLeaf(path []string) bool {
+	v := j.root
+	for _, part := range path[:len(path)-1] {
+		if !v.object {
+			return false
+		}
+		var next *jsonValue
+		for k, key := range v.keys {
+			if key == part {
+				next = v.values[k]
+			}
+		}
+		if next == nil {
+			return true
+		}
+		v = next
+	}
+	if !v.object {
+		return false
+	}
+	for k, key := range v.keys {
+		if key == path[len(path)-1] {
+			v.keys = append(v.keys[:k], v.keys[k+1:]...)
+			v.values = append(v.values[:k], v.values[k+1:]...)
+			return true
+		}
+	}
+	return true
+}
+
+func (j *jsonDoc) hasMetadataKey() bool {
+	for _, key := range j.root.keys {
+		if key == structuredMetadataKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *jsonDoc) takeMetadata() (string, string, bool) {
+	n := len(j.root.keys)
+	if n < 1 || j.root.keys[n-1] != structuredMetadataKey || !j.root.values[n-1].object {
+		return "", "", false
+	}
+
+	metadata := j.root.values[n-1]
+	j.root.keys, j.root.values = j.root.keys[:n-1], j.root.values[:n-1]
+
+	var header, mac string
+	for i, key := range metadata.keys {
+		switch key {
+		case "header":
+			json.Unmarshal(metadata.values[i].raw, &header)
+		case "mac":
+			json.Unmarshal(metadata.values[i].raw, &mac)
+		}
+	}
+	return header, mac, true
+}
+
+func (j *jsonDoc) addMetadata(header, mac string) {
+	metadata := &jsonValue{
+		object: true,
+		keys:   []string{"header", "mac"},
+		values: []*jsonValue{{raw: encodeJSONString(header)}, {raw: encodeJSONString(mac)}},
+	}
+	j.root.keys = append(j.root.keys, structuredMetadataKey)
+	j.root.values = append(j.root.values, metadata)
+}
+
+// encode writes the document back out with two space indentation.
+func (j *jsonDoc) encode() ([]byte, error) {
+	var compact, b bytes.Buffer
+	writeJSON(&compact, j.root)
+	if err := json.Indent(&b, compact.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// writeJSON writes v to b without any whitespace.
+func writeJSON(b *bytes.Buffer, v *jsonValue) {
+	switch {
+	case v.object:
+		b.WriteByte('{')
+		for i, key := range v.keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.Write(encodeJSONString(key))
+			b.WriteByte(':')
+			writeJSON(b, v.values[i])
+		}
+		b.WriteByte('}')
+	case v.array:
+		b.WriteByte('[')
+		for i, item := range v.values {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSON(b, item)
+		}
+		b.WriteByte(']')
+	default:
+		b.Write(v.raw)
+	}
+}
+
+// walkJSON calls fn for every scalar below v in document order, along with
+// the keys and array indexes leading to it.
+func walkJSON(v *jsonValue, path []string, fn func(path []string, leaf *jsonValue) error) error {
+	switch {
+	case v.object:
+		for i, key := range v.keys {
+			if err := walkJSON(v.values[i], appendPath(path, key), fn); err != nil {
+				return err
+			}
+		}
+	case v.array:
+		for i, item := range v.values {
+			if err := walkJSON(item, appendPath(path, strconv.Itoa(i)), fn); err != nil {
+				return err
+			}
+		}
+	default:
+		return fn(path, v)
+	}
+	return nil
+}
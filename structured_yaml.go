@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/robmerrell/gosecret/vendor/gopkg.in/yaml.v3"
+	"io"
+	"strconv"
+)
+
+// yamlDoc is a YAML document whose root is a mapping. Comments and key order
+// are kept by working on the node tree rather than decoded values.
+type yamlDoc struct {
+	doc  *yaml.Node
+	root *yaml.Node
+}
+
+// parseYAMLDoc parses a single YAML document whose root is a mapping.
+func parseYAMLDoc(contents []byte) (structuredDoc, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(contents))
+	doc := &yaml.Node{}
+	if err := dec.Decode(doc); err != nil {
+		return nil, err
+	}
+	if err := dec.Decode(&yaml.Node{}); err != io.EOF {
+		return nil, errors.New("Structured files must contain a single YAML document")
+	}
+	if len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("Structured files must have a mapping at the top level")
+	}
+	return &yamlDoc{doc: doc, root: doc.Content[0]}, nil
+}
+
+func (y *yamlDoc) encryptLeaves(l *leafCipher) error {
+	return walkYAML(y.root, nil, func(path []string, leaf *yaml.Node) error {
+		marker, err := l.seal(path, encodeLeaf(leaf))
+		if err != nil {
+			return err
+		}
+		leaf.Value, leaf.Tag, leaf.Style = marker, "!!str", 0
+		return nil
+	})
+}
+
+func (y *yamlDoc) decryptLeaves(l *leafCipher) error {
+	return walkYAML(y.root, nil, func(path []string, leaf *yaml.Node) error {
+		value, err := l.open(path, leaf.Value)
+		if err != nil {
+			return err
+		}
+		return decodeLeaf(leaf, value)
+	})
+}
+
+func (y *yamlDoc) eachLeaf(fn func(path []string, value string) error) error {
+	return walkYAML(y.root, nil, func(path []string, leaf *yaml.Node) error {
+		return fn(path, leaf.Value)
+	})
+}
+
+func (y *yamlDoc) eachRawLeaf(fn func(path []string, raw []byte) error) error {
+	return walkYAML(y.root, nil, func(path []string, leaf *yaml.Node) error {
+		return fn(path, encodeLeaf(leaf))
+	})
+}
+
+func (y *yamlDoc) setLeaf(path []string, raw []byte) bool {
+	n := y.root
+	for i, part := range path {
+		// what to add if part is missing
+		missing := func() *yaml.Node {
+			if i == len(path)-1 {
+				return &yaml.Node{Kind: yaml.ScalarNode}
+			}
+			if isIndexPath(path[i+1]) {
+				return &yaml.Node{Kind: yaml.SequenceNode}
+			}
+			return &yaml.Node{Kind: yaml.MappingNode}
+		}
+
+		var next *yaml.Node
+		switch n.Kind {
+		case yaml.MappingNode:
+			for k := 0; k+1 < len(n.Content); k += 2 {
+				if n.Content[k].Value == part {
+					next = n.Content[k+1]
+				}
+			}
+			if next == nil {
+				next = missing()
+				n.Content = append(n.Content, yamlScalar(part), next)
+			}
+		case yaml.SequenceNode:
+			k, err := strconv.Atoi(part)
+			if err != nil || k < 0 || k > len(n.Content) {
+				return false
+			}
+			if k == len(n.Content) {
+				n.Content = append(n.Content, missing())
+			}
+			next = n.Content[k]
+		default:
+			return false
+		}
+		n = next
+	}
+	if n.Kind != yaml.ScalarNode {
+		return false
+	}
+	return decodeLeaf(n, raw) == nil
+}
+
+func (y *yamlDoc) removeLeaf(path []string) bool {
+	n := y.root
+	for _, part := range path[:len(path)-1] {
+		if n.Kind != yaml.MappingNode {
+			return false
+		}
+		var next *yaml.Node
+		for k := 0; k+1 < len(n.Content); k += 2 {
+			if n.Content[k].Value == part {
+				next = n.Content[k+1]
+			}
+		}
+		if next == nil {
+			return true
+		}
+		n = next
+	}
+	if n.Kind != yaml.MappingNode {
+		return false
+	}
+	for k := 0; k+1 < len(n.Content); k += 2 {
+		if n.Content[k].Value == path[len(path)-1] {
+			n.Content = append(n.Content[:k], n.Content[k+2:]...)
+			return true
+		}
+	}
+	return true
+}
+
+func (y *yamlDoc) hasMetadataKey() bool {
+	for i := 0; i < len(y.root.Content); i += 2 {
+		if y.root.Content[i].Value == structuredMetadataKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (y *yamlDoc) takeMetadata() (string, string, bool) {
+	n := len(y.root.Content)
+	if n < 2 || y.root.Content[n-2].Value != structuredMetadataKey || y.root.Content[n-1].Kind != yaml.MappingNode {
+		return "", "", false
+	}
+
+	metadata := y.root.Content[n-1]
+	y.root.Content = y.root.Content[:n-2]
+	return yamlMappingValue(metadata, "header"), yamlMappingValue(metadata, "mac"), true
+}
+
+func (y *yamlDoc) addMetadata(header, mac string) {
+	metadata := &yaml.Node{Kind: yaml.MappingNode}
+	metadata.Content = []*yaml.Node{
+		yamlScalar("header"), yamlScalar(header),
+		yamlScalar("mac"), yamlScalar(mac),
+	}
+	y.root.Content = append(y.root.Content, yamlScalar(structuredMetadataKey), metadata)
+}
+
+// encode writes the document back out with two space indentation.
+func (y *yamlDoc) encode() ([]byte, error) {
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(y.doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// walkYAML calls fn for every scalar value below n in document order, along
+// with the keys and sequence indexes leading to it. Mapping keys aren't
+// leaves, and aliases are skipped since the node they refer to is visited
+// where it's defined.
+func walkYAML(n *yaml.Node, path []string, fn func(path []string, leaf *yaml.Node) error) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if err := walkYAML(n.Content[i+1], appendPath(path, n.Content[i].Value), fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			if err := walkYAML(item, appendPath(path, strconv.Itoa(i)), fn); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		return fn(path, n)
+	}
+	return nil
+}
+
+// encodeLeaf packs the style, tag and value of a scalar so all three can be
+// restored after decryption.
+func encodeLeaf(n *yaml.Node) []byte {
+	b := []byte{byte(n.Style)}
+	b = append(b, n.Tag...)
+	b = append(b, 0)
+	return append(b, n.Value...)
+}
+
+// decodeLeaf restores a scalar from the output of encodeLeaf.
+func decodeLeaf(n *yaml.Node, b []byte) error {
+	if len(b) < 1 {
+		return errors.New("Encrypted value is malformed")
+	}
+	i := bytes.IndexByte(b[1:], 0) + 1
+	if i < 1 {
+		return errors.New("Encrypted value is malformed")
+	}
+	n.Style = yaml.Style(b[0])
+	n.Tag = string(b[1:i])
+	n.Value = string(b[i+1:])
+	return nil
+}
+
+// yamlMappingValue returns the value of key in a mapping node.
+func yamlMappingValue(mapping *yaml.Node, key string) string {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+func yamlScalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
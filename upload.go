@@ -3,29 +3,66 @@ package main
 import (
 	"errors"
 	"flag"
-	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3"
+	"fmt"
 	"github.com/robmerrell/gosecret/vendor/github.com/kr/s3/s3util"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 // flags and args
 var uploadBucketNameFlag string
 var uploadAccessKeyFlag string
 var uploadSecretKeyFlag string
+var uploadSessionTokenFlag string
+var uploadRegionFlag string
+var uploadEndpointFlag string
+var uploadPathStyleFlag bool
+var uploadCABundleFlag string
+var uploadMaxAttemptsFlag int
+var uploadRetryDelayFlag time.Duration
+var uploadRetryMaxDelayFlag time.Duration
+var uploadSSEFlag string
+var uploadSSEKMSKeyIDFlag string
+var uploadSSECustomerKeyFlag string
+var uploadForceFlag bool
+var uploadResumableFlag bool
+var uploadAbortStaleFlag bool
+var uploadStaleAfterFlag time.Duration
 var uploadFilenameArg string
 
 var uploadDoc = `
 Usage: upload [options] file
 
 Upload a file to an s3 bucket
+
+Large files are uploaded in parts. With --resumable the parts uploaded are
+kept in the state file, so if the upload fails, running it again with
+--resumable only uploads the parts that are missing. Unfinished uploads
+keep their parts in the bucket, and are billed for, until they are
+aborted. Run upload --abort-stale, without a file, to abort the ones
+started longer than --stale-after ago.
+
+Use --sse to have S3 encrypt the file at rest as well: aes256 with keys
+managed by S3, aws:kms with the KMS key given by --sse-kms-key-id or the
+default one, or customer with a key of your own given by --sse-customer-key.
+A file encrypted with a key of your own can only be downloaded with the
+same key.
+
+The upload fails if someone else has uploaded the file since you last
+downloaded or uploaded it, or if it already exists and you never did, so
+changes aren't overwritten by accident. The ETag of each file is kept in
+$GOSECRET_STATE_FILE, or ~/.gosecret/state.json, to tell. Use --force to
+upload anyway.
 `
 
 func uploadAction() error {
 	// make sure that we have all of the required data
-	if uploadFilenameArg == "" {
+	if uploadFilenameArg == "" && !uploadAbortStaleFlag {
 		return errors.New("Please provide a valid filename to upload")
 	}
 	if uploadBucketNameFlag == "" {
@@ -39,15 +76,51 @@ func uploadAction() error {
 	}
 
 	// create the config needed for the uploader
-	config := &s3util.Config{
-		Keys: &s3.Keys{
-			AccessKey: uploadAccessKeyFlag,
-			SecretKey: uploadSecretKeyFlag,
-		},
-		Service: s3.DefaultService,
+	config := newS3Config(uploadAccessKeyFlag, uploadSecretKeyFlag, uploadSessionTokenFlag, uploadRegionFlag)
+	if err := setS3Endpoint(config, uploadEndpointFlag, uploadPathStyleFlag, uploadCABundleFlag); err != nil {
+		return err
+	}
+	if err := setS3Retry(config, uploadMaxAttemptsFlag, uploadRetryDelayFlag, uploadRetryMaxDelayFlag); err != nil {
+		return err
+	}
+
+	state, err := loadS3State()
+	if err != nil {
+		return err
+	}
+	if uploadAbortStaleFlag {
+		return abortStaleUploads(uploadBucketNameFlag, uploadStaleAfterFlag, state, config, os.Stdout)
+	}
+
+	sse, err := sseHeaders(uploadSSEFlag, uploadSSEKMSKeyIDFlag, uploadSSECustomerKeyFlag)
+	if err != nil {
+		return err
+	}
+	remoteName := filepath.Base(uploadFilenameArg)
+	if !uploadForceFlag {
+		for k, vs := range state.conditionalHeaders(uploadBucketNameFlag, remoteName) {
+			sse[k] = vs
+		}
 	}
 
-	return upload(uploadBucketNameFlag, uploadFilenameArg, config)
+	var info *s3util.ObjectInfo
+	if uploadResumableFlag {
+		info, err = uploadResumable(uploadBucketNameFlag, uploadFilenameArg, sse, state, config)
+	} else {
+		info, err = upload(uploadBucketNameFlag, uploadFilenameArg, sse, config)
+	}
+	if err == s3util.ErrPreconditionFailed {
+		// structured files can be merged
+		mergeFile := ""
+		if contents, err := ioutil.ReadFile(uploadFilenameArg); err == nil && detectStructuredFormat(uploadFilenameArg, contents) != "" {
+			mergeFile = uploadFilenameArg
+		}
+		return s3ConflictError(uploadBucketNameFlag, remoteName, mergeFile)
+	}
+	if err != nil {
+		return err
+	}
+	return state.record(uploadBucketNameFlag, remoteName, info)
 }
 
 // uploadFlagInit initializes the flagset for the upload command
@@ -60,6 +133,48 @@ func uploadFlagInit(fs *flag.FlagSet) {
 
 	defaultSecretKey := os.Getenv("GOSECRET_SECRET_KEY")
 	fs.StringVar(&uploadSecretKeyFlag, "secret-key", defaultSecretKey, "S3 Secret Key. Defaults to value in $GOSECRET_SECRET_KEY")
+
+	defaultSessionToken := os.Getenv("GOSECRET_SESSION_TOKEN")
+	fs.StringVar(&uploadSessionTokenFlag, "session-token", defaultSessionToken, "S3 session token for temporary credentials. Defaults to value in $GOSECRET_SESSION_TOKEN")
+
+	defaultRegion := os.Getenv("GOSECRET_REGION")
+	fs.StringVar(&uploadRegionFlag, "region", defaultRegion, "AWS region of the S3 bucket. Defaults to value in $GOSECRET_REGION, or us-east-1")
+
+	defaultEndpoint := os.Getenv("GOSECRET_ENDPOINT")
+	fs.StringVar(&uploadEndpointFlag, "endpoint", defaultEndpoint, "URL of an S3-compatible service to use instead of AWS. Defaults to value in $GOSECRET_ENDPOINT")
+
+	defaultPathStyle, _ := strconv.ParseBool(os.Getenv("GOSECRET_PATH_STYLE"))
+	fs.BoolVar(&uploadPathStyleFlag, "path-style", defaultPathStyle, "Put the bucket in the URL path instead of the host name. Defaults to value in $GOSECRET_PATH_STYLE")
+
+	defaultCABundle := os.Getenv("GOSECRET_CA_BUNDLE")
+	fs.StringVar(&uploadCABundleFlag, "ca-bundle", defaultCABundle, "PEM file of the certificates to trust for the S3 endpoint. Defaults to value in $GOSECRET_CA_BUNDLE")
+
+	defaultMaxAttempts, defaultRetryDelay, defaultRetryMaxDelay := s3RetryDefaults()
+	fs.IntVar(&uploadMaxAttemptsFlag, "max-attempts", defaultMaxAttempts, "Times to try each S3 request that fails with a transient error. Defaults to value in $GOSECRET_MAX_ATTEMPTS, or 5")
+	fs.DurationVar(&uploadRetryDelayFlag, "retry-delay", defaultRetryDelay, "Wait before retrying a failed S3 request, doubled for each retry after. Defaults to value in $GOSECRET_RETRY_DELAY, or 100ms")
+	fs.DurationVar(&uploadRetryMaxDelayFlag, "retry-max-delay", defaultRetryMaxDelay, "Longest wait between tries of an S3 request. Defaults to value in $GOSECRET_RETRY_MAX_DELAY, or 20s")
+
+	defaultSSE := os.Getenv("GOSECRET_SSE")
+	fs.StringVar(&uploadSSEFlag, "sse", defaultSSE, "Server-side encryption to ask S3 for: aes256, aws:kms or customer. Defaults to value in $GOSECRET_SSE")
+
+	defaultSSEKMSKeyID := os.Getenv("GOSECRET_SSE_KMS_KEY_ID")
+	fs.StringVar(&uploadSSEKMSKeyIDFlag, "sse-kms-key-id", defaultSSEKMSKeyID, "ID or ARN of the KMS key for --sse aws:kms. Defaults to value in $GOSECRET_SSE_KMS_KEY_ID")
+
+	defaultSSECustomerKey := os.Getenv("GOSECRET_SSE_CUSTOMER_KEY")
+	fs.StringVar(&uploadSSECustomerKeyFlag, "sse-customer-key", defaultSSECustomerKey, "Base64 encoded 32 byte key for --sse customer. Defaults to value in $GOSECRET_SSE_CUSTOMER_KEY")
+
+	fs.BoolVar(&uploadForceFlag, "force", false, "Upload even if someone else has changed the file since you last downloaded or uploaded it")
+}
+
+// uploadCommandFlagInit initializes the flagset for the upload command
+// itself, which can also resume uploads and clean up unfinished ones. push
+// shares the upload flags with uploadFlagInit.
+func uploadCommandFlagInit(fs *flag.FlagSet) {
+	uploadFlagInit(fs)
+
+	fs.BoolVar(&uploadResumableFlag, "resumable", false, "Keep the progress of the upload, so running it again after it fails carries on where it stopped")
+	fs.BoolVar(&uploadAbortStaleFlag, "abort-stale", false, "Abort the unfinished uploads in the bucket started longer than --stale-after ago, instead of uploading")
+	fs.DurationVar(&uploadStaleAfterFlag, "stale-after", 24*time.Hour, "How long ago an unfinished upload has to have started for --abort-stale")
 }
 
 // uploadFlagPostParse sets the uploadable filename from the arguments provided by the flagset
@@ -72,24 +187,141 @@ func uploadFlagPostParse(fs *flag.FlagSet) {
 	}
 }
 
-// upload uploads a file to an s3 bucket.
-func upload(bucket, file string, config *s3util.Config) error {
+// upload uploads a file to an s3 bucket with the extra headers h, such as
+// the server-side encryption or conditional headers, and returns the ETag
+// and version of the uploaded file.
+func upload(bucket, file string, h http.Header, config *s3util.Config) (*s3util.ObjectInfo, error) {
 	// open the local file to upload
 	localFile, err := os.Open(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer localFile.Close()
 
-	headers := http.Header{}
-	headers.Add("x-amz-acl", "private")
-	s3File, err := s3util.Create(generateS3Url(bucket, filepath.Base(file)), headers, config)
+	s3File, err := createS3File(bucket, filepath.Base(file), h, config)
+	if err != nil {
+		return nil, err
+	}
+	return copyToS3(s3File, localFile)
+}
+
+// uploadResumable is like upload, but keeps the progress of the upload in
+// the state. If it fails, uploading the same file again carries on from the
+// parts already uploaded.
+func uploadResumable(bucket, file string, h http.Header, state *s3State, config *s3util.Config) (*s3util.ObjectInfo, error) {
+	localFile, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer localFile.Close()
+	return resumeUpload(bucket, filepath.Base(file), localFile, h, state, config)
+}
+
+// resumeUpload uploads r to an s3 bucket as name the way uploadResumable
+// does.
+func resumeUpload(bucket, name string, r io.Reader, h http.Header, state *s3State, config *s3util.Config) (*s3util.ObjectInfo, error) {
+	save := func(upload *s3util.UploadState) error {
+		return state.recordUpload(bucket, name, upload)
+	}
+	w, err := s3util.CreateResumable(generateS3Url(bucket, name), s3UploadHeaders(h), config, state.Uploads[s3StateKey(bucket, name)], save)
+	if err != nil {
+		return nil, err
+	}
+
+	// the parts uploaded so far are saved, so a failed copy leaves the upload
+	// open to carry on rather than closing it, which would upload what was
+	// copied
+	resumeErr := "%s. Run the upload again with --resumable to carry on from where it stopped"
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, fmt.Errorf(resumeErr, err)
+	}
+	err = w.Close()
+	if err == s3util.ErrPreconditionFailed {
+		// the upload was aborted, so there's nothing to resume
+		save(nil)
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf(resumeErr, err)
+	}
+	return w.(s3Writer).Info(), save(nil)
+}
+
+// copyToS3 copies r into an upload started by createS3File and finishes the
+// upload, returning the ETag and version of the uploaded file.
+func copyToS3(s3File s3Writer, r io.Reader) (*s3util.ObjectInfo, error) {
+	// the upload only happens once it's closed, so a failed copy aborts it
+	// rather than uploading what was copied so far
+	if _, err := io.Copy(s3File, r); err != nil {
+		s3File.Abort()
+		return nil, err
+	}
+	if err := s3File.Close(); err != nil {
+		return nil, err
+	}
+	return s3File.Info(), nil
+}
+
+// abortStaleUploads aborts the unfinished uploads in an s3 bucket that
+// started longer than olderThan ago, forgetting them in the state, and
+// reports each one on w.
+func abortStaleUploads(bucket string, olderThan time.Duration, state *s3State, config *s3util.Config, w io.Writer) error {
+	uploads, err := s3util.ListUploads(generateS3Url(bucket, ""), "", config)
 	if err != nil {
 		return err
 	}
-	defer s3File.Close()
 
-	// copy the file
-	_, err = io.Copy(s3File, localFile)
-	return err
+	cutoff := time.Now().Add(-olderThan)
+	aborted := 0
+	for _, u := range uploads {
+		if u.Initiated.After(cutoff) {
+			continue
+		}
+		if err := s3util.Abort(generateS3Url(bucket, u.Key), u.UploadId, config); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Aborted the upload of %s started at %s\n", u.Key, u.Initiated.UTC().Format(time.RFC3339))
+		aborted++
+
+		if resume := state.Uploads[s3StateKey(bucket, u.Key)]; resume != nil && resume.UploadId == u.UploadId {
+			if err := state.recordUpload(bucket, u.Key, nil); err != nil {
+				return err
+			}
+		}
+	}
+	if aborted == 0 {
+		fmt.Fprintln(w, "No stale uploads to abort")
+	}
+	return nil
+}
+
+// s3Writer is an upload started by createS3File. Info returns the ETag and
+// version of the file once it has been closed, and Abort gives up on the
+// upload, leaving the file as it was.
+type s3Writer interface {
+	io.WriteCloser
+	Info() *s3util.ObjectInfo
+	Abort() error
+}
+
+// createS3File starts a private upload of name into an s3 bucket, with the
+// extra headers h if they aren't nil. The upload is finished when the
+// returned writer is closed.
+func createS3File(bucket, name string, h http.Header, config *s3util.Config) (s3Writer, error) {
+	w, err := s3util.Create(generateS3Url(bucket, name), s3UploadHeaders(h), config)
+	if err != nil {
+		return nil, err
+	}
+	return w.(s3Writer), nil
+}
+
+// s3UploadHeaders returns the headers to start an upload with, the extra
+// headers h and those making the file private.
+func s3UploadHeaders(h http.Header) http.Header {
+	headers := http.Header{}
+	for k, vs := range h {
+		headers[k] = vs
+	}
+	headers.Add("x-amz-acl", "private")
+	return headers
 }
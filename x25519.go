@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Recipients are X25519 public keys. The data key is wrapped for a recipient
+// with a key derived from an ephemeral key pair and the recipient's public
+// key, so anyone can encrypt to a recipient but only the holder of the
+// matching identity, the private key, can decrypt.
+//
+// Both are written as a prefix followed by the key and a 4 byte checksum in
+// unpadded base32. The checksum is the start of the SHA-256 of the prefix
+// and key, so a mistyped key is caught rather than silently encrypting to
+// nobody. Recipients are lower case and identities upper case:
+//
+//	gosecret1...           recipient
+//	GOSECRET-IDENTITY-1... identity
+//
+// The recipients and identities of age, written in Bech32 as age1... and
+// AGE-SECRET-KEY-1..., are X25519 keys too and are accepted as well.
+//
+// An identity file holds one identity per line. Blank lines and lines
+// starting with # are ignored.
+
+const (
+	recipientPrefix = "gosecret1"
+	identityPrefix  = "GOSECRET-IDENTITY-1"
+
+	x25519KeySize  = 32
+	checksumSize   = 4
+	x25519BodySize = keyIDSize + x25519KeySize + wrappedKeySize
+)
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// x25519Recipient is a public key files can be encrypted to.
+type x25519Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// x25519Identity is a private key that can decrypt files encrypted to its
+// recipient.
+type x25519Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// newX25519Identity generates a new identity.
+func newX25519Identity() (*x25519Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &x25519Identity{key: key}, nil
+}
+
+// recipient returns the recipient files for this identity are encrypted to.
+func (i *x25519Identity) recipient() *x25519Recipient {
+	return &x25519Recipient{key: i.key.PublicKey()}
+}
+
+func (i *x25519Identity) String() string {
+	return strings.ToUpper(encodeKey(identityPrefix, i.key.Bytes()))
+}
+
+func (r *x25519Recipient) String() string {
+	return strings.ToLower(encodeKey(recipientPrefix, r.key.Bytes()))
+}
+
+// id returns the non-secret identifier of the recipient stored in stanzas.
+func (r *x25519Recipient) id() []byte {
+	return keyID(r.key.Bytes())
+}
+
+// parseX25519Recipient decodes a recipient written by String, or an age
+// recipient.
+func parseX25519Recipient(s string) (*x25519Recipient, error) {
+	var b []byte
+	var err error
+	if trimmed := strings.TrimSpace(s); strings.HasPrefix(trimmed, ageRecipientHRP+"1") {
+		b, err = decodeAgeKey(ageRecipientHRP, trimmed)
+	} else {
+		b, err = decodeKey(recipientPrefix, trimmed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a valid recipient", s)
+	}
+	key, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a valid recipient", s)
+	}
+	return &x25519Recipient{key: key}, nil
+}
+
+// parseX25519Recipients decodes each of the recipients in ss.
+func parseX25519Recipients(ss []string) ([]*x25519Recipient, error) {
+	var recipients []*x25519Recipient
+	for _, s := range ss {
+		recipient, err := parseX25519Recipient(s)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// parseX25519Identities decodes the identities in an identity file.
+func parseX25519Identities(contents []byte) ([]*x25519Identity, error) {
+	var identities []*x25519Identity
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var b []byte
+		var err error
+		if strings.HasPrefix(strings.ToUpper(line), ageIdentityHRP+"1") {
+			b, err = decodeAgeKey(ageIdentityHRP, line)
+		} else {
+			b, err = decodeKey(identityPrefix, line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of the identity file isn't a valid identity", n)
+		}
+		key, err := ecdh.X25519().NewPrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of the identity file isn't a valid identity", n)
+		}
+		identities = append(identities, &x25519Identity{key: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("The identity file doesn't contain any identities")
+	}
+	return identities, nil
+}
+
+// encodeKey writes prefix followed by key and its checksum in base32.
+func encodeKey(prefix string, key []byte) string {
+	return prefix + keyEncoding.EncodeToString(append(append([]byte{}, key...), keyChecksum(prefix, key)...))
+}
+
+// decodeKey reverses encodeKey, checking the prefix and checksum. Case is
+// ignored.
+func decodeKey(prefix, s string) ([]byte, error) {
+	s = strings.ToUpper(s)
+	if !strings.HasPrefix(s, strings.ToUpper(prefix)) {
+		return nil, errors.New("Wrong prefix")
+	}
+	b, err := keyEncoding.DecodeString(s[len(prefix):])
+	if err != nil || len(b) != x25519KeySize+checksumSize {
+		return nil, errors.New("Malformed key")
+	}
+
+	key, checksum := b[:x25519KeySize], b[x25519KeySize:]
+	if !bytes.Equal(checksum, keyChecksum(prefix, key)) {
+		return nil, errors.New("Bad checksum")
+	}
+	return key, nil
+}
+
+func keyChecksum(prefix string, key []byte) []byte {
+	sum := sha256.Sum256(append([]byte(prefix), key...))
+	return sum[:checksumSize]
+}
+
+// x25519WrapKey derives the key the data key is wrapped with from the shared
+// secret and both public keys.
+func x25519WrapKey(shared, ephemeral, recipient []byte) []byte {
+	return hkdfSHA256(shared, append(append([]byte{}, ephemeral...), recipient...), "gosecret x25519")
+}
+
+// newX25519Stanza wraps dataKey for recipient. The stanza body is the
+// recipient ID, the ephemeral public key and the wrapped data key.
+func newX25519Stanza(h *header, recipient *x25519Recipient, dataKey []byte) (*stanza, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient.key)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	wrapped, err := wrapDataKey(h, x25519WrapKey(shared, ephemeralPublic, recipient.key.Bytes()), dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stanza{kind: stanzaX25519, keyID: recipient.id(), body: append(ephemeralPublic, wrapped...)}, nil
+}
+
+// unwrapX25519Stanza opens the data key in s with identity.
+func unwrapX25519Stanza(h *header, s *stanza, identity *x25519Identity) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(s.body[:x25519KeySize])
+	if err != nil {
+		return nil, errAuthFailed
+	}
+	shared, err := identity.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, errAuthFailed
+	}
+
+	wrapKey := x25519WrapKey(shared, ephemeral.Bytes(), identity.key.PublicKey().Bytes())
+	return unwrapDataKey(h, wrapKey, s.body[x25519KeySize:])
+}